@@ -30,7 +30,7 @@ func Start(configPath string) {
 		log.Fatalf("loading ini file faild, %v", err)
 	}
 
-	commandChannel := make(chan string)
+	commandChannel := make(chan gateway.Command)
 
 	err = StartByFileWithChannel(conf, commandChannel)
 	if err != nil {
@@ -38,8 +38,22 @@ func Start(configPath string) {
 	}
 }
 
-// StartByFileWithChannel starts Gateway with command Channel
-func StartByFileWithChannel(conf inidef.Config, commandChannel chan string) error {
+// StartByFileWithChannel starts Gateway with command Channel, and returns
+// after the gateway is stopped. Send commands to commandChannel from
+// another goroutine to control the gateway.
+//
+// example:
+//
+//	cmdChan := make(chan gateway.Command)
+//	ctx, stopped := context.WithCancel(context.Background())
+//	go func() {
+//		fuji.StartByFileWithChannel(conf, cmdChan)
+//		stopped()
+//	}()
+//	result := gateway.Do(ctx, cmdChan, gateway.Command{Type: gateway.CmdListDevices})
+//	...
+//	gateway.Do(ctx, cmdChan, gateway.Command{Type: gateway.CmdStop})
+func StartByFileWithChannel(conf inidef.Config, commandChannel chan gateway.Command) error {
 	gw, err := gateway.NewGateway(conf)
 	if err != nil {
 		log.Fatalf("gateway create error, %v", err)
@@ -48,13 +62,18 @@ func StartByFileWithChannel(conf inidef.Config, commandChannel chan string) erro
 	if err != nil {
 		log.Fatalf("broker(s) create error, %v", err)
 	}
-	deviceList, err := device.NewDevices(conf, brokerList, gw.DeviceChan)
+	bridgeList, err := broker.NewBridges(conf, brokerList)
+	if err != nil {
+		log.Fatalf("bridge create error, %v", err)
+	}
+	deviceList, err := device.NewDevices(conf, brokerList)
 	if err != nil {
 		log.Fatalf("device create error, %v", err)
 	}
 
 	gw.Devices = deviceList
 	gw.Brokers = brokerList
+	gw.Bridges = bridgeList
 	gw.CmdChan = commandChannel
 
 	status, err := device.NewStatus(conf)
@@ -73,8 +92,12 @@ func StartByFileWithChannel(conf inidef.Config, commandChannel chan string) erro
 			continue
 		}
 	}
+	if gw.Remote != nil {
+		gw.Remote.AddTo(gw.Brokers)
+	}
 
 	// Start brokers and devices
+	gw.WatchBrokers()
 	for _, b := range gw.Brokers {
 		err := b.MQTTClientSetup(gw.Name)
 		if err != nil {
@@ -82,13 +105,7 @@ func StartByFileWithChannel(conf inidef.Config, commandChannel chan string) erro
 			continue
 		}
 	}
-	for _, device := range gw.Devices {
-		err := device.Start(gw.MsgChan)
-		if err != nil {
-			log.Errorf("device start error, %v", err)
-			continue
-		}
-	}
+	gw.StartDevices()
 
 	// start gateway
 	return gw.Start()
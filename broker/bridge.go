@@ -0,0 +1,218 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// Bridge relays messages which match Topic from the From broker to
+// the To broker.
+type Bridge struct {
+	Name        string `validate:"max=256"`
+	From        string `validate:"nonzero,max=256"`
+	To          string `validate:"nonzero,max=256"`
+	Topic       string `validate:"nonzero,max=256"` // topic filter subscribed on From
+	QoS         byte   `validate:"min=0,max=2"`
+	PublishQoS  int    `validate:"min=-1,max=2"` // -1 keeps QoS of the received message
+	StripPrefix string `validate:"max=256"`
+	AddPrefix   string `validate:"max=256,validtopic"`
+}
+
+func (bridge *Bridge) String() string {
+	return fmt.Sprintf("%#v", bridge)
+}
+
+// NewBridges returns []*Bridge from inidef.Config, and adds the topic
+// filters to Subscribed of the From brokers.
+//
+// example:
+//
+//	[bridge "alerts"]
+//	    from = local
+//	    to = sango
+//	    topic = alerts/#
+//	    strip_prefix = alerts
+//	    add_prefix = ham/alerts
+func NewBridges(conf inidef.Config, brokers Brokers) ([]*Bridge, error) {
+	var bridges []*Bridge
+
+	for _, section := range conf.Sections {
+		if section.Type != "bridge" {
+			continue
+		}
+		values := section.Values
+
+		bridge := &Bridge{
+			Name:        section.Name,
+			From:        values["from"],
+			To:          values["to"],
+			Topic:       values["topic"],
+			PublishQoS:  -1,
+			StripPrefix: strings.TrimSuffix(values["strip_prefix"], "/"),
+			AddPrefix:   strings.TrimSuffix(values["add_prefix"], "/"),
+		}
+		if q, ok := values["qos"]; ok {
+			qos, err := strconv.Atoi(q)
+			if err != nil || qos < 0 || qos > 2 {
+				return nil, fmt.Errorf("bridge %s: invalid qos, %v", bridge.Name, q)
+			}
+			bridge.QoS = byte(qos)
+		}
+		if q, ok := values["publish_qos"]; ok {
+			qos, err := strconv.Atoi(q)
+			if err != nil {
+				return nil, fmt.Errorf("bridge %s: invalid publish_qos, %v", bridge.Name, q)
+			}
+			bridge.PublishQoS = qos
+		}
+
+		// Validation
+		if err := validator.Validate(bridge); err != nil {
+			return nil, fmt.Errorf("bridge %s: %v", bridge.Name, err)
+		}
+		if !message.ValidTopicFilter(bridge.Topic) {
+			return nil, fmt.Errorf("bridge %s: invalid topic, %v", bridge.Name, bridge.Topic)
+		}
+		if bridge.From == bridge.To {
+			return nil, fmt.Errorf("bridge %s: from and to are the same broker", bridge.Name)
+		}
+		from := brokers.Group(bridge.From)
+		if len(from) == 0 {
+			return nil, fmt.Errorf("bridge %s: broker does not exists: %s", bridge.Name, bridge.From)
+		}
+		if len(brokers.Group(bridge.To)) == 0 {
+			return nil, fmt.Errorf("bridge %s: broker does not exists: %s", bridge.Name, bridge.To)
+		}
+
+		// a new loop always goes through the new bridge
+		if loop := bridge.loop(append(bridges, bridge)); loop != nil {
+			return nil, fmt.Errorf("bridge %s: messages loop through bridges %s", bridge.Name, strings.Join(loop, " -> "))
+		}
+
+		for _, b := range from {
+			log.Infof("bridge %s subscribe: %#v", bridge.Name, bridge.Topic)
+			b.Subscribed.Add(bridge.Topic, bridge.QoS)
+		}
+		bridges = append(bridges, bridge)
+	}
+
+	return bridges, nil
+}
+
+// loop follows the message relayed by the bridge through bridges, and
+// returns the names of the bridges on the way if it comes back to the
+// bridge, so that it is relayed forever. Returns nil if not.
+// The topic filter with the wildcards replaced is used as the message.
+func (bridge *Bridge) loop(bridges []*Bridge) []string {
+	var walk func(path []*Bridge, topic string) []string
+	walk = func(path []*Bridge, topic string) []string {
+		last := path[len(path)-1]
+		topic = last.rewriteTopic(topic)
+		if topic == "" {
+			return nil
+		}
+		for _, next := range bridges {
+			if next.From != last.To || !message.MatchTopic(next.Topic, topic) {
+				continue
+			}
+			if next == bridge {
+				var names []string
+				for _, b := range append(path, bridge) {
+					names = append(names, b.Name)
+				}
+				return names
+			}
+			if onPath(path, next) { // another loop, found when it is added
+				continue
+			}
+			if names := walk(append(path, next), topic); names != nil {
+				return names
+			}
+		}
+		return nil
+	}
+
+	levels := strings.Split(bridge.Topic, "/")
+	for i, l := range levels {
+		if l == "+" || l == "#" {
+			levels[i] = "x"
+		}
+	}
+	return walk([]*Bridge{bridge}, strings.Join(levels, "/"))
+}
+
+func onPath(path []*Bridge, bridge *Bridge) bool {
+	for _, b := range path {
+		if b == bridge {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns true if the message subscribed on the From broker
+// matches Topic.
+func (bridge *Bridge) Match(msg message.Message) bool {
+	return msg.Type == message.TypeSubscribed &&
+		msg.Sender == bridge.From &&
+		message.MatchTopic(bridge.Topic, msg.Topic)
+}
+
+// Rewrite returns the message to publish on the To broker. StripPrefix
+// is removed from the topic and AddPrefix is prepended. Returns error if
+// the topic becomes empty, ex: the topic is StripPrefix itself without
+// AddPrefix.
+func (bridge *Bridge) Rewrite(msg message.Message) (message.Message, error) {
+	topic := bridge.rewriteTopic(msg.Topic)
+	if topic == "" {
+		return msg, fmt.Errorf("bridge %s: topic %s is empty after strip_prefix", bridge.Name, msg.Topic)
+	}
+
+	msg.Type = message.TypeBridged
+	msg.BrokerName = bridge.To
+	msg.Topic = topic
+	msg.TopicTemplate = message.BridgedTopicTemplate
+	if bridge.PublishQoS >= 0 {
+		msg.QoS = byte(bridge.PublishQoS)
+	}
+	return msg, nil
+}
+
+func (bridge *Bridge) rewriteTopic(topic string) string {
+	if bridge.StripPrefix != "" {
+		if topic == bridge.StripPrefix {
+			topic = ""
+		} else if strings.HasPrefix(topic, bridge.StripPrefix+"/") {
+			topic = topic[len(bridge.StripPrefix)+1:]
+		}
+	}
+	if bridge.AddPrefix != "" {
+		if topic == "" {
+			topic = bridge.AddPrefix
+		} else {
+			topic = bridge.AddPrefix + "/" + topic
+		}
+	}
+	return topic
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+const bridgeBrokers = `
+[gateway]
+    name = ham
+[broker "local"]
+    embedded = true
+[broker "sango/1"]
+    host = 192.168.1.22
+    port = 1883
+[broker "sango/2"]
+    host = 192.168.1.23
+    port = 1883
+`
+
+func TestNewBridges(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := bridgeBrokers + `
+[bridge "alerts"]
+    from = local
+    to = sango
+    topic = ` + "`alerts/#`" + `
+    qos = 1
+    publish_qos = 0
+    strip_prefix = alerts/
+    add_prefix = ham/alerts
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	bridges, err := NewBridges(conf, brokers)
+	assert.Nil(err)
+	assert.Equal(1, len(bridges))
+	br := bridges[0]
+	assert.Equal("alerts", br.Name)
+	assert.Equal("local", br.From)
+	assert.Equal("sango", br.To)
+	assert.Equal(byte(1), br.QoS)
+	assert.Equal(0, br.PublishQoS)
+	assert.Equal("alerts", br.StripPrefix)
+
+	// subscribed on the from broker only
+	local := brokers.Group("local")[0]
+	assert.Equal(byte(1), local.Subscribed.List()["alerts/#"])
+	for _, b := range brokers.Group("sango") {
+		assert.Equal(0, b.Subscribed.Length())
+	}
+}
+
+func TestNewBridgesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	invalids := []string{
+		"from = local\n    to = sango",                                  // without topic
+		"to = sango\n    topic = alerts/+",                              // without from
+		"from = local\n    to = local\n    topic = alerts/+",            // same broker
+		"from = akane\n    to = sango\n    topic = alerts/+",            // unknown broker
+		"from = local\n    to = akane\n    topic = alerts/+",            // unknown broker
+		"from = local\n    to = sango\n    topic = alerts/+x",           // invalid filter
+		"from = local\n    to = sango\n    topic = alerts\n    qos = 3", // invalid qos
+		"from = local\n    to = sango\n    topic = alerts\n    publish_qos = 3",
+		"from = local\n    to = sango\n    topic = alerts\n    add_prefix = ham/+",
+	}
+	for _, v := range invalids {
+		iniStr := bridgeBrokers + `
+[bridge "alerts"]
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		brokers, err := NewBrokers(conf, make(chan message.Message))
+		assert.Nil(err)
+		_, err = NewBridges(conf, brokers)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestNewBridgesLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		reverse string
+		loops   bool
+	}{
+		{"topic = `ham/alerts/#`\n    strip_prefix = ham", true},
+		{"topic = `ham/#`", false}, // relayed back once, but not again
+		{"topic = `ham/alerts/+`\n    strip_prefix = ham\n    add_prefix = sango", false},
+		{"topic = `cmd/#`", false},
+	} {
+		iniStr := bridgeBrokers + `
+[bridge "alerts"]
+    from = local
+    to = sango
+    topic = ` + "`alerts/#`" + `
+    add_prefix = ham
+[bridge "reverse"]
+    from = sango
+    to = local
+    ` + c.reverse + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		brokers, err := NewBrokers(conf, make(chan message.Message))
+		assert.Nil(err)
+		_, err = NewBridges(conf, brokers)
+		assert.Equal(c.loops, err != nil, c.reverse)
+	}
+
+	// local -> sango -> remote -> local
+	for _, c := range []struct {
+		back  string
+		loops bool
+	}{
+		{"`ham/alerts/#`", true},
+		{"`cmd/#`", false},
+	} {
+		iniStr := bridgeBrokers + `
+[broker "remote"]
+    host = 192.168.1.24
+    port = 1883
+[bridge "alerts"]
+    from = local
+    to = sango
+    topic = ` + "`alerts/#`" + `
+    add_prefix = ham
+[bridge "forward"]
+    from = sango
+    to = remote
+    topic = ` + "`ham/#`" + `
+[bridge "back"]
+    from = remote
+    to = local
+    topic = ` + c.back + `
+    strip_prefix = ham
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		brokers, err := NewBrokers(conf, make(chan message.Message))
+		assert.Nil(err)
+		_, err = NewBridges(conf, brokers)
+		assert.Equal(c.loops, err != nil, c.back)
+	}
+}
+
+func TestBridgeRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	br := &Bridge{
+		Name:        "alerts",
+		From:        "local",
+		To:          "sango",
+		Topic:       "alerts/#",
+		PublishQoS:  -1,
+		StripPrefix: "alerts",
+		AddPrefix:   "ham/alerts",
+	}
+	msg := message.Message{
+		Sender: "local",
+		Type:   message.TypeSubscribed,
+		Topic:  "alerts/fire/1",
+		Body:   []byte("hot"),
+		QoS:    1,
+	}
+	assert.True(br.Match(msg))
+
+	out, err := br.Rewrite(msg)
+	assert.Nil(err)
+	assert.Equal(message.TypeBridged, out.Type)
+	assert.Equal("sango", out.BrokerName)
+	assert.Equal("ham/alerts/fire/1", out.Topic)
+	assert.Equal(byte(1), out.QoS)
+	assert.Equal([]byte("hot"), out.Body)
+
+	// published as is
+	b := &Broker{Name: "sango", TopicPrefix: "prefix", GatewayName: "ham"}
+	topic, err := b.GenerateTopic(&out)
+	assert.Nil(err)
+	assert.Equal("ham/alerts/fire/1", topic.Str)
+
+	msg.Topic = "alerts"
+	out, err = br.Rewrite(msg)
+	assert.Nil(err)
+	assert.Equal("ham/alerts", out.Topic)
+	msg.Topic = "alertsfoo/1" // not at level boundary
+	br.Topic = "#"
+	out, err = br.Rewrite(msg)
+	assert.Nil(err)
+	assert.Equal("ham/alerts/alertsfoo/1", out.Topic)
+
+	br.PublishQoS = 0
+	out, err = br.Rewrite(msg)
+	assert.Nil(err)
+	assert.Equal(byte(0), out.QoS)
+
+	// empty topic
+	br.AddPrefix = ""
+	msg.Topic = "alerts"
+	_, err = br.Rewrite(msg)
+	assert.NotNil(err)
+
+	// not matched
+	assert.False(br.Match(message.Message{Sender: "sango", Type: message.TypeSubscribed, Topic: "alerts/1"}))
+	br.Topic = "alerts/#"
+	assert.False(br.Match(message.Message{Sender: "local", Type: message.TypeSubscribed, Topic: "status/1"}))
+}
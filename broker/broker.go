@@ -17,42 +17,77 @@ package broker
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
-	"io/ioutil"
+	"net/http"
+	"path/filepath"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
 	log "github.com/Sirupsen/logrus"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
 	validator "gopkg.in/validator.v2"
 
+	"github.com/shiguredo/fuji/broker/embedded"
 	"github.com/shiguredo/fuji/inidef"
 	"github.com/shiguredo/fuji/message"
 	"github.com/shiguredo/fuji/utils"
 )
 
 type Broker struct {
-	GatewayName   string
-	Name          string `validate:"max=256,regexp=[^/]+,validtopic"`
-	Priority      int    `validate:"min=1,max=3"`
-	Host          string `validate:"max=256"`
-	Port          int    `validate:"min=1,max=65535"`
-	Username      string `validate:"max=256"`
-	Password      string `validate:"max=256"`
-	RetryInterval int    `validate:"min=0"`
-	TopicPrefix   string `validate:"max=256"`
-	WillMessage   []byte `validate:"max=256"`
-	Tls           bool
-	CaCert        string `validate:"max=256"`
-	TLSConfig     *tls.Config
-	Subscribed    Subscribed // list of subscribed topics
+	GatewayName     string
+	Name            string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Priority        int    `validate:"min=1,max=3"`
+	Host            string `validate:"max=256"`
+	Port            int    `validate:"min=1,max=65535"`
+	Username        string `validate:"max=256"`
+	Password        string `validate:"max=256"`
+	RetryInterval   int    `validate:"min=0"` // first delay to reconnect, sec
+	Backoff         Backoff
+	TopicPrefix     string `validate:"max=256"`
+	TopicTemplate   message.TopicTemplate
+	ProtocolVersion int    `validate:"min=4,max=5"`
+	WillMessage     []byte `validate:"max=256"`
+	WillTopic       message.TopicTemplate
+	WillQoS         byte `validate:"max=2"`
+	WillRetain      bool
+	BirthMessage    []byte `validate:"max=256"` // published on every connect, if set
+	BirthTopic      message.TopicTemplate
+	OfflineMessage  []byte `validate:"max=256"` // published before graceful disconnect, if set
+	Tls             bool
+	CaCert          string `validate:"max=256"`
+	ClientCert      string `validate:"max=256"`
+	ClientKey       string `validate:"max=256"`
+	ServerName      string `validate:"max=256"`
+	TLSMinVersion   uint16
+	TLSCiphers      []uint16
+	TLSConfig       *tls.Config
+	Transport       string `validate:"max=256"`
+	WSPath          string `validate:"max=256"`
+	Proxy           string `validate:"max=256"`
+	WSHeaders       http.Header
+	Subscribed      Subscribed // list of subscribed topics
+	Queue           *Queue     // stores messages while disconnected, nil if disabled
+	Embedded        bool       // runs the MQTT broker inside the gateway
 
 	GwChan chan message.Message
 
-	MQTTClient *MQTT.Client
-	connected  bool
+	MQTTClient  *MQTT.Client
+	MQTT5Client *paho.Client // used instead of MQTTClient on MQTT 5.0
+	server      *embedded.Server
+	seq         uint64
+
+	mu       sync.Mutex // protects below and the clients
+	state    ConnState
+	stopped  bool
+	closed   chan bool  // closed by Close to stop the reconnect loop
+	lost     chan error // notifies the reconnect loop of the lost connection
+	wsBridge *wsBridge
+	watchers []chan StateChange
 }
 
 func (broker *Broker) String() string {
@@ -73,37 +108,56 @@ func (bs Brokers) Less(i, j int) bool {
 	return bs[i].Priority < bs[j].Priority
 }
 
+// Group returns the brokers which have the name, ordered by Priority.
+// Brokers which have the same name are a failover group.
+func (bs Brokers) Group(name string) Brokers {
+	var group Brokers
+	for _, b := range bs {
+		if b.Name == name {
+			group = append(group, b)
+		}
+	}
+	sort.Stable(group)
+	return group
+}
+
+// Active returns the highest priority connected broker in the failover
+// group. If no broker in the group is connected, returns nil.
+func (bs Brokers) Active(name string) *Broker {
+	for _, b := range bs.Group(name) {
+		if b.IsConnected() {
+			return b
+		}
+	}
+	return nil
+}
+
 // init is automatically invoked at initial time.
 func init() {
 	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
 }
 
-// NewTLSConfig returns TLS config from CA Cert file path.
-func NewTLSConfig(caCertFilePath string) (*tls.Config, error) {
-	certPool := x509.NewCertPool()
-	pemCerts, err := ioutil.ReadFile(caCertFilePath)
+// NewBrokers returns []*Broker from inidef.Config, and opens their queues.
+// If validation failes, retrun error.
+func NewBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error) {
+	brokers, err := ParseBrokers(conf, gwChan)
 	if err != nil {
-		return nil, inidef.Error("Cert File could not be read.")
-	}
-	appendCertOk := certPool.AppendCertsFromPEM(pemCerts)
-	if appendCertOk != true {
-		return nil, inidef.Error("Server Certificate parse failed")
-	}
-
-	// only server certificate checked
-	return &tls.Config{
-		RootCAs:    certPool,
-		ClientAuth: tls.NoClientCert,
-		ClientCAs:  nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true,
-	}, nil
+		return nil, err
+	}
+	for _, b := range brokers {
+		if b.Queue == nil {
+			continue
+		}
+		if err := b.Queue.Open(); err != nil {
+			return nil, err
+		}
+	}
+	return brokers, nil
 }
 
-// NewBrokers returns []*Broker from inidef.Config.
-// If validation failes, retrun error.
-func NewBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error) {
+// ParseBrokers returns []*Broker from inidef.Config same as NewBrokers,
+// but their queues are not opened. Call Queue.Open before using them.
+func ParseBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error) {
 	var brokers Brokers
 
 	for _, section := range conf.Sections {
@@ -139,13 +193,29 @@ func NewBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error
 		}
 		broker.Priority = int(priority)
 
-		port, err := strconv.Atoi(values["port"])
+		portStr := values["port"]
+		if portStr == "" && values["embedded"] == "true" {
+			portStr = strconv.Itoa(DefaultEmbeddedPort)
+		}
+		port, err := strconv.Atoi(portStr)
 		if err != nil {
 			return nil, fmt.Errorf("broker port parse failed, %v", values["port"])
 		}
 		broker.Port = int(port)
 
 		// OPTIONAL fields
+		if values["topic"] != "" {
+			broker.TopicTemplate, err = message.ParseTopicTemplate(values["topic"])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		broker.ProtocolVersion, err = parseProtocolVersion(values["protocol_version"])
+		if err != nil {
+			return nil, err
+		}
+
 		if values["retry_interval"] != "" {
 			retry_interval, err := strconv.Atoi(values["retry_interval"])
 			if err != nil {
@@ -155,11 +225,35 @@ func NewBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error
 			}
 		}
 
-		if values["tls"] == "true" && values["cacert"] != "" {
-			// validate certificate
-			broker.Tls = true
-			broker.CaCert = values["cacert"]
-			broker.TLSConfig, err = NewTLSConfig(broker.CaCert)
+		if err := setBackoffValues(broker, values); err != nil {
+			return nil, err
+		}
+
+		if err := setWillValues(broker, values); err != nil {
+			return nil, err
+		}
+
+		if err := setTransportValues(broker, values); err != nil {
+			return nil, err
+		}
+		if values["tls"] == "true" || broker.Transport == TransportWSS {
+			if err := setTLSValues(broker, values); err != nil {
+				return nil, err
+			}
+			broker.TLSConfig, err = NewTLSConfig(broker)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if values["embedded"] == "true" {
+			if err := setEmbeddedValues(broker, values); err != nil {
+				return nil, err
+			}
+		}
+
+		if values["queue_dir"] != "" {
+			broker.Queue, err = newQueueFromValues(broker, values)
 			if err != nil {
 				return nil, err
 			}
@@ -178,33 +272,78 @@ func NewBrokers(conf inidef.Config, gwChan chan message.Message) (Brokers, error
 	return brokers, nil
 }
 
+// newQueueFromValues returns the store-and-forward queue of the broker,
+// which is not opened yet. Each broker has its own directory under queue_dir.
+func newQueueFromValues(b *Broker, values map[string]string) (*Queue, error) {
+	maxSize := DefaultQueueMaxSize
+	if values["queue_max_size"] != "" {
+		size, err := strconv.Atoi(values["queue_max_size"])
+		if err != nil {
+			return nil, fmt.Errorf("queue_max_size parse failed, %v", values["queue_max_size"])
+		}
+		maxSize = size
+	}
+	maxAge := 0
+	if values["queue_max_age"] != "" {
+		age, err := strconv.Atoi(values["queue_max_age"])
+		if err != nil {
+			return nil, fmt.Errorf("queue_max_age parse failed, %v", values["queue_max_age"])
+		}
+		maxAge = age
+	}
+
+	dir := filepath.Join(values["queue_dir"], fmt.Sprintf("%s_%d", b.Name, b.Priority))
+	return newQueue(dir, maxSize, time.Duration(maxAge)*time.Second, values["queue_drop"])
+}
+
 func (b *Broker) IsConnected() bool {
-	if b.MQTTClient != nil && b.MQTTClient.IsConnected() && b.connected {
-		return true
+	if b.State() != StateConnected {
+		return false
 	}
-	return false
+	if b.ProtocolVersion == ProtocolVersion5 {
+		return b.client5() != nil
+	}
+	cli := b.client()
+	return cli != nil && cli.IsConnected()
+}
+
+// client returns MQTTClient. It is replaced on every reconnect.
+func (b *Broker) client() *MQTT.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.MQTTClient
+}
+
+// client5 returns MQTT5Client. It is replaced on every reconnect.
+func (b *Broker) client5() *paho.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.MQTT5Client
 }
 
 func (b *Broker) onConnectionLost(client *MQTT.Client, reason error) {
-	log.Errorf("MQTT broker disconnected(%s): %s", b.Name, reason)
-	b.connected = false
+	b.connectionLost(reason)
 }
 
 func (b *Broker) onMessageReceived(client *MQTT.Client, m MQTT.Message) {
 	log.Debugf("topic:%s / msg:%s", m.Topic(), m.Payload())
 
 	msg := message.Message{
-		Sender: b.Name,
-		Type:   message.TypeSubscribed,
-		Body:   m.Payload(),
-		Topic:  m.Topic(),
+		Sender:         b.Name,
+		SenderPriority: b.Priority,
+		Type:           message.TypeSubscribed,
+		Body:           m.Payload(),
+		Topic:          m.Topic(),
+		QoS:            m.Qos(),
+		Retained:       m.Retained(),
 	}
 	b.GwChan <- msg
 }
 
 func (b *Broker) SubscribeOnConnect(client *MQTT.Client) {
 	log.Infof("client connected")
-	b.connected = true
+	b.setState(StateConnected, nil, 0)
+	b.publishBirth()
 
 	if b.Subscribed.Length() > 0 {
 		// subscribe
@@ -214,37 +353,101 @@ func (b *Broker) SubscribeOnConnect(client *MQTT.Client) {
 			log.Error(token.Error())
 		}
 	}
+
+	if b.Queue != nil && b.Queue.Len() > 0 {
+		go b.drain()
+	}
 }
 
 // MQTTClientSetup setup MQTTOptions and connect ot broker.
+// If the connect fails, it is retried with backoff in background until
+// the broker is closed.
 func (b *Broker) MQTTClientSetup(gwName string) error {
+	if b.Embedded {
+		if err := b.startEmbedded(); err != nil {
+			return err
+		}
+	}
+
+	closed, lost := b.start()
+	err := b.connect(gwName, lost)
+	go b.keep(gwName, err, closed, lost)
+	return nil
+}
+
+// connect3 connects to the broker by MQTT 3.1.1 with a new client.
+func (b *Broker) connect3(gwName string) error {
 	cli, err := MQTTConnect(gwName, b)
 	if err != nil {
 		return err
 	}
 
+	// set before Connect, the on connect handler publishes by it
+	b.mu.Lock()
+	b.MQTTClient = cli
+	b.mu.Unlock()
 	if token := cli.Connect(); token.Wait() && token.Error() != nil {
-		log.Errorf("Failed to start MQTT client: %v", token.Error())
 		return token.Error()
 	}
-
-	b.MQTTClient = cli
 	return nil
 }
 
+// disconnect sends DISCONNECT to the broker.
+func (b *Broker) disconnect() {
+	if cli := b.client5(); cli != nil {
+		cli.Disconnect(&paho.Disconnect{ReasonCode: 0})
+	}
+	if cli := b.client(); cli != nil {
+		cli.Disconnect(250)
+	}
+}
+
+// Publish publishes the message to the broker. If the broker has a queue,
+// the message is queued while the broker is disconnected or older queued
+// messages remain, and sent after reconnect.
 func (b *Broker) Publish(msg *message.Message) error {
-	if b.MQTTClient == nil || !b.IsConnected() {
+	if msg.Seq == 0 {
+		msg.Seq = atomic.AddUint64(&b.seq, 1)
+	}
+	if b.Queue != nil && (!b.IsConnected() || b.Queue.Len() > 0) {
+		if err := b.Queue.Push(*msg); err != nil {
+			log.Errorf("failed to queue message: %v", err)
+			return err
+		}
+		if b.IsConnected() {
+			go b.drain()
+		}
+		return nil
+	}
+
+	if !b.IsConnected() {
 		log.Warn("message got but Broker not connected")
 		return nil
 	}
 
+	err := b.publish(msg)
+	if err != nil && b.Queue != nil && !b.IsConnected() {
+		// connection lost while publishing
+		return b.Queue.Push(*msg)
+	}
+	return err
+}
+
+func (b *Broker) publish(msg *message.Message) error {
 	topic, err := b.GenerateTopic(msg)
 	if err != nil {
 		return err
 	}
 
 	log.Debugf("message got: %v", topic)
-	token := b.MQTTClient.Publish(topic.Str, msg.QoS, msg.Retained, msg.Body)
+	if b.ProtocolVersion == ProtocolVersion5 {
+		if err := b.publish5(topic.Str, msg); err != nil {
+			return err
+		}
+		log.Debugf("message published: %v", topic)
+		return nil
+	}
+	token := b.client().Publish(topic.Str, msg.QoS, msg.Retained, msg.Body)
 	log.Debugf("message published: %v", topic)
 	token.Wait()
 	if token.Error() != nil {
@@ -255,18 +458,92 @@ func (b *Broker) Publish(msg *message.Message) error {
 	return nil
 }
 
-// GenerateTopic generates topic from topicprefix, gwname and message.
+// drain publishes the queued messages in order while the broker is connected.
+// Only one drain runs at a time for a broker. Returns false if another drain
+// is already running.
+func (b *Broker) drain() bool {
+	if !b.Queue.startDrain() {
+		return false
+	}
+	log.Infof("start sending queued messages, broker: %s", b.Name)
+
+	for {
+		if !b.IsConnected() {
+			b.Queue.stopDrain()
+			return true
+		}
+		msg, ok, err := b.Queue.nextDrain()
+		if err != nil {
+			// never be read, drop it not to block the queue
+			log.Errorf("queued message dropped, failed to read: %v", err)
+			b.Queue.Remove()
+			continue
+		}
+		if !ok { // all sent
+			log.Infof("queued messages sent, broker: %s", b.Name)
+			return true
+		}
+		if _, err := b.GenerateTopic(&msg); err != nil {
+			// never be published, drop it not to block the queue
+			log.Errorf("queued message dropped, %v", err)
+			b.Queue.Remove()
+			continue
+		}
+		if err := b.publish(&msg); err != nil {
+			b.Queue.stopDrain()
+			return true
+		}
+		if err := b.Queue.Remove(); err != nil {
+			log.Errorf("failed to remove queued message: %v", err)
+		}
+	}
+}
+
+// Flush sends the queued messages now and returns after all of them are
+// sent. If a drain is already running, waits for it to end instead.
+// Returns error if the broker is not connected.
+func (b *Broker) Flush() error {
+	if b.Queue == nil {
+		return fmt.Errorf("broker %s does not have queue", b.Name)
+	}
+	if !b.IsConnected() {
+		return fmt.Errorf("broker %s(priority %d) not connected", b.Name, b.Priority)
+	}
+	if !b.drain() {
+		if done := b.Queue.drainWait(); done != nil {
+			<-done
+		}
+	}
+	if n := b.Queue.Len(); n > 0 {
+		return fmt.Errorf("broker %s(priority %d) %d messages left in queue", b.Name, b.Priority, n)
+	}
+	return nil
+}
+
+// GenerateTopic renders the topic template of the message, or of the
+// broker if the message does not have it.
 func (b *Broker) GenerateTopic(msg *message.Message) (message.TopicString, error) {
-	var topicString string
-	switch msg.Sender {
-	case "status": // status device topic structure is difference
-		topicString = strings.Join([]string{b.TopicPrefix, msg.Topic}, "/")
+	tmpl := msg.TopicTemplate
+	switch {
+	case tmpl != "":
+	case b.TopicTemplate != "":
+		tmpl = b.TopicTemplate
+	case msg.SenderType == "status": // the status device, not configurable
+		tmpl = message.StatusTopicTemplate
 	default:
-		topicString = strings.Join([]string{b.TopicPrefix, b.GatewayName, msg.Sender, msg.Type}, "/")
+		tmpl = message.DefaultTopicTemplate
 	}
 
 	topic := message.TopicString{
-		Str: topicString,
+		Str: tmpl.Render(message.TopicVars{
+			Prefix:  b.TopicPrefix,
+			Gateway: b.GatewayName,
+			Device:  msg.Sender,
+			Type:    msg.Type,
+			Broker:  b.Name,
+			Seq:     msg.Seq,
+			Topic:   msg.Topic,
+		}),
 	}
 	if err := topic.Validate(); err != nil {
 		log.Errorf("topic validation error, %v", err)
@@ -277,41 +554,76 @@ func (b *Broker) GenerateTopic(msg *message.Message) (message.TopicString, error
 }
 
 func (b *Broker) Close() error {
-	if b.MQTTClient != nil {
-		b.MQTTClient.Disconnect(250)
+	b.publishOffline()
+	b.stop()
+	b.disconnect()
+	b.closeWSBridge()
+	if b.server != nil {
+		b.server.Close()
+		b.server = nil
 	}
 	return nil
 }
 
+// FourceClose disconnects from the broker so that the broker publishes
+// the will message. It closes the connection without DISCONNECT on MQTT
+// 3.1.1, and sends DISCONNECT with the reason code 0x04 on MQTT 5.0.
+// The embedded broker keeps running.
 func (b *Broker) FourceClose() error {
-	if b.MQTTClient != nil {
-		b.MQTTClient.ForceDisconnect()
+	b.stop()
+	if cli := b.client5(); cli != nil {
+		cli.Disconnect(&paho.Disconnect{ReasonCode: packets.DisconnectDisconnectWithWillMessage})
+	}
+	if cli := b.client(); cli != nil {
+		cli.ForceDisconnect()
 	}
+	b.closeWSBridge()
 	return nil
 }
 
+// closeWSBridge closes the WebSocket bridge of the last connect if any.
+func (b *Broker) closeWSBridge() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.wsBridge != nil {
+		b.wsBridge.Close()
+		b.wsBridge = nil
+	}
+}
+
 // MQTTConnect returns MQTTClient with options.
 func MQTTConnect(gwName string, b *Broker) (*MQTT.Client, error) {
 	opts := MQTT.NewClientOptions()
 
-	defaulturl := fmt.Sprintf("tcp://%s:%d", b.Host, b.Port)
-	if b.Tls {
-		defaulturl := fmt.Sprintf("ssl://%s:%d", b.Host, b.Port)
-		opts.AddBroker(defaulturl)
-		opts.SetClientID(gwName)
+	defaulturl := fmt.Sprintf("tcp://%s:%d", b.clientHost(), b.Port)
+	switch {
+	case b.IsWebsocket():
+		// TLS is handled by the bridge
+		b.closeWSBridge()
+		bridge, err := newWSBridge(b, gwName)
+		if err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		b.wsBridge = bridge
+		b.mu.Unlock()
+		log.Infof("broker connecting to: %s://%s:%d%s", b.Transport, b.Host, b.Port, b.WSPath)
+		opts.AddBroker(bridge.URL())
+		opts.SetClientID(bridge.LocalID())
+	case b.Tls:
+		defaulturl = fmt.Sprintf("ssl://%s:%d", b.Host, b.Port)
 		opts.SetTLSConfig(b.TLSConfig)
-	} else {
+		fallthrough
+	default:
+		log.Infof("broker connecting to: %v", defaulturl)
 		opts.AddBroker(defaulturl)
 		opts.SetClientID(gwName)
 	}
-	log.Infof("broker connecting to: %v", defaulturl)
 
 	opts.SetUsername(b.Username)
 	opts.SetPassword(b.Password)
 	if !inidef.IsNil(b.WillMessage) {
-		willTopic := strings.Join([]string{b.TopicPrefix, gwName, "will"}, "/")
-		willQoS := 0
-		opts.SetBinaryWill(willTopic, b.WillMessage, byte(willQoS), true)
+		opts.SetBinaryWill(b.willTopic(gwName), b.WillMessage, b.WillQoS, b.WillRetain)
 	}
 	opts.SetOnConnectHandler(b.SubscribeOnConnect)
 	opts.SetConnectionLostHandler(b.onConnectionLost)
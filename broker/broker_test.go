@@ -205,21 +205,79 @@ func TestGenerateTopicStatus(t *testing.T) {
 	}
 
 	msg1 := &message.Message{
-		Sender: "status",
-		Type:   "t",
+		Sender:     "status",
+		SenderType: "status",
+		Type:       "status",
 	}
 	t1, err := b.GenerateTopic(msg1)
 	assert.Nil(err)
 	assert.Equal("prefix/", t1.Str)
 
 	msg2 := &message.Message{
-		Topic:  "$SYS/gw/cpu/total",
-		Sender: "status",
-		Type:   "t",
+		Topic:      "$SYS/gw/cpu/total",
+		Sender:     "status",
+		SenderType: "status",
+		Type:       "status",
 	}
 	t2, err := b.GenerateTopic(msg2)
 	assert.Nil(err)
 	assert.Equal("prefix/$SYS/gw/cpu/total", t2.Str)
+
+	// a device of type status is not the status device
+	t3, err := b.GenerateTopic(&message.Message{Sender: "dora", SenderType: "dummy", Type: "status"})
+	assert.Nil(err)
+	assert.Equal("prefix/gw/dora/status", t3.Str)
+
+	// the topic template of the broker is used for status too
+	b.TopicTemplate = "{prefix}/system/{gateway}/{topic}"
+	t2, err = b.GenerateTopic(msg2)
+	assert.Nil(err)
+	assert.Equal("prefix/system/gw/$SYS/gw/cpu/total", t2.Str)
+}
+
+func TestGenerateTopicTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[gateway]
+    name = ham
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    topic_prefix = prefix
+    topic = {prefix}/devices/{device}/events/{type}/{seq}
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+
+	msg := &message.Message{Sender: "dora", Type: "dummy", Seq: 3}
+	topic, err := b.GenerateTopic(msg)
+	assert.Nil(err)
+	assert.Equal("prefix/devices/dora/events/dummy/3", topic.Str)
+
+	// device template overrides broker template
+	msg.TopicTemplate = "{broker}/{gateway}/{device}"
+	topic, err = b.GenerateTopic(msg)
+	assert.Nil(err)
+	assert.Equal("sango/ham/dora", topic.Str)
+
+	// rendered topic is validated
+	msg.TopicTemplate = "{prefix}/{device}"
+	msg.Sender = "a+b"
+	_, err = b.GenerateTopic(msg)
+	assert.NotNil(err)
+
+	iniStr = `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    topic = {prefix}/{unknown}
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	_, err = NewBrokers(conf, make(chan message.Message))
+	assert.NotNil(err)
 }
 
 func TestBrokersPrioritySort(t *testing.T) {
@@ -253,3 +311,42 @@ func TestBrokersPrioritySort(t *testing.T) {
 	assert.Equal(3, bs[2].Priority)
 
 }
+
+func TestBrokersGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[broker "sango/2"]
+    host = 192.168.1.22
+    port = 1883
+[broker "akane"]
+    host = 192.168.1.23
+    port = 1883
+[broker "sango/1"]
+    host = 192.168.1.21
+    port = 1883
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	bs, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+
+	g := bs.Group("sango")
+	assert.Equal(2, len(g))
+	assert.Equal(1, g[0].Priority)
+	assert.Equal("192.168.1.21", g[0].Host)
+	assert.Equal(2, g[1].Priority)
+
+	assert.Equal(1, len(bs.Group("akane")))
+	assert.Equal(0, len(bs.Group("doesNotExist")))
+}
+
+func TestBrokersActiveNotConnected(t *testing.T) {
+	assert := assert.New(t)
+
+	bs := Brokers{
+		&Broker{Name: "sango", Priority: 1},
+		&Broker{Name: "sango", Priority: 2},
+	}
+	assert.Nil(bs.Active("sango"))
+	assert.Nil(bs.Active("doesNotExist"))
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/shiguredo/fuji/broker/embedded"
+)
+
+const DefaultEmbeddedPort = 1883
+
+// setEmbeddedValues checks the settings of the embedded broker.
+// The embedded broker speaks MQTT 3.1.1 over plain TCP only.
+func setEmbeddedValues(b *Broker, values map[string]string) error {
+	b.Embedded = true
+	if values["tls"] == "true" || b.Transport != TransportTCP {
+		return fmt.Errorf("embedded broker supports only plain tcp")
+	}
+	if b.ProtocolVersion != ProtocolVersion311 {
+		return fmt.Errorf("embedded broker supports only MQTT 3.1.1")
+	}
+	return nil
+}
+
+// startEmbedded starts the embedded broker on Host:Port, once.
+// Username and Password are required to local clients if set.
+func (b *Broker) startEmbedded() error {
+	if b.server != nil {
+		return nil
+	}
+	s := embedded.NewServer(net.JoinHostPort(b.Host, strconv.Itoa(b.Port)))
+	s.Username = b.Username
+	s.Password = b.Password
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("embedded broker start failed, %v", err)
+	}
+	b.server = s
+	return nil
+}
+
+// clientHost returns the host which the gateway connects to.
+// The embedded broker listening on all interfaces is connected by loopback.
+func (b *Broker) clientHost() string {
+	if !b.Embedded {
+		return b.Host
+	}
+	switch b.Host {
+	case "", "0.0.0.0", "::":
+		return "127.0.0.1"
+	}
+	return b.Host
+}
@@ -0,0 +1,297 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedded
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MQTT control packet types.
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	UNSUBACK    = 11
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+// CONNACK return codes.
+const (
+	connAccepted           = 0x00
+	connRefusedVersion     = 0x01
+	connRefusedIdentifier  = 0x02
+	connRefusedBadUserPass = 0x04
+)
+
+const (
+	subackFailure = 0x80
+
+	// MaxPacketSize is the largest packet accepted from clients.
+	MaxPacketSize = 16 * 1024 * 1024
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a raw MQTT control packet.
+type packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// readPacket reads one control packet.
+func readPacket(r *bufio.Reader) (packet, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+
+	length := 0
+	for i, shift := 0, uint(0); ; i, shift = i+1, shift+7 {
+		if i == 4 {
+			return packet{}, errMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > MaxPacketSize {
+		return packet{}, fmt.Errorf("packet too large: %d", length)
+	}
+
+	p := packet{Type: h >> 4, Flags: h & 0x0f, Body: make([]byte, length)}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+// encode returns the packet with its fixed header.
+func (p packet) encode() []byte {
+	buf := []byte{p.Type<<4 | p.Flags}
+	length := len(p.Body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, p.Body...)
+}
+
+// reader reads fields of a packet body.
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.buf) < 1 {
+		r.err = errMalformed
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.buf) < 2 {
+		r.err = errMalformed
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.buf)
+	r.buf = r.buf[2:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.buf) < n {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	return append(appendUint16(buf, uint16(len(b))), b...)
+}
+
+// connect is a parsed CONNECT packet.
+type connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+	ClientID      string
+
+	WillFlag    bool
+	WillQoS     byte
+	WillRetain  bool
+	WillTopic   string
+	WillMessage []byte
+
+	UsernameFlag bool
+	Username     string
+	PasswordFlag bool
+	Password     string
+}
+
+func parseConnect(body []byte) (connect, error) {
+	r := &reader{buf: body}
+	c := connect{
+		ProtocolName:  r.string(),
+		ProtocolLevel: r.byte(),
+	}
+	flags := r.byte()
+	c.KeepAlive = r.uint16()
+	c.ClientID = r.string()
+	if flags&0x01 != 0 {
+		return c, errMalformed // reserved
+	}
+	c.CleanSession = flags&0x02 != 0
+	c.WillFlag = flags&0x04 != 0
+	c.WillQoS = (flags >> 3) & 0x03
+	c.WillRetain = flags&0x20 != 0
+	c.PasswordFlag = flags&0x40 != 0
+	c.UsernameFlag = flags&0x80 != 0
+	if c.WillFlag {
+		c.WillTopic = r.string()
+		c.WillMessage = append([]byte{}, r.bytes()...)
+	}
+	if c.UsernameFlag {
+		c.Username = r.string()
+	}
+	if c.PasswordFlag {
+		c.Password = r.string()
+	}
+	if c.WillQoS > 2 {
+		return c, errMalformed
+	}
+	return c, r.err
+}
+
+// Message is an application message routed by the server.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+func parsePublish(p packet) (Message, uint16, error) {
+	r := &reader{buf: p.Body}
+	m := Message{
+		Topic:  r.string(),
+		QoS:    (p.Flags >> 1) & 0x03,
+		Retain: p.Flags&0x01 != 0,
+	}
+	var id uint16
+	if m.QoS > 0 {
+		id = r.uint16()
+	}
+	if r.err != nil || m.QoS > 2 {
+		return m, 0, errMalformed
+	}
+	m.Payload = append([]byte{}, r.buf...)
+	return m, id, nil
+}
+
+func publishPacket(m Message, id uint16) packet {
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 0x01
+	}
+	body := appendBytes(nil, []byte(m.Topic))
+	if m.QoS > 0 {
+		body = appendUint16(body, id)
+	}
+	return packet{Type: PUBLISH, Flags: flags, Body: append(body, m.Payload...)}
+}
+
+// ackPacket returns PUBACK, PUBREC, PUBREL, PUBCOMP or UNSUBACK.
+func ackPacket(t byte, id uint16) packet {
+	var flags byte
+	if t == PUBREL {
+		flags = 0x02
+	}
+	return packet{Type: t, Flags: flags, Body: appendUint16(nil, id)}
+}
+
+// subscription is a topic filter and its requested QoS.
+type subscription struct {
+	Filter string
+	QoS    byte
+}
+
+func parseSubscribe(body []byte) (uint16, []subscription, error) {
+	r := &reader{buf: body}
+	id := r.uint16()
+	var subs []subscription
+	for r.err == nil && len(r.buf) > 0 {
+		subs = append(subs, subscription{Filter: r.string(), QoS: r.byte()})
+	}
+	if r.err != nil || len(subs) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, subs, nil
+}
+
+func parseUnsubscribe(body []byte) (uint16, []string, error) {
+	r := &reader{buf: body}
+	id := r.uint16()
+	var filters []string
+	for r.err == nil && len(r.buf) > 0 {
+		filters = append(filters, r.string())
+	}
+	if r.err != nil || len(filters) == 0 {
+		return 0, nil, errMalformed
+	}
+	return id, filters, nil
+}
@@ -0,0 +1,464 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// embedded is an package about a minimal MQTT 3.1.1 broker which runs
+// inside the gateway.
+//
+// It supports QoS 0, 1 and 2, retained messages, will messages and
+// subscriptions of persistent sessions. Messages are not stored for
+// disconnected clients and unacknowledged messages are not resent.
+package embedded
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	connectTimeout = 10 * time.Second
+	writeTimeout   = 30 * time.Second
+	outQueueSize   = 1024
+)
+
+// Server is an embedded MQTT broker.
+type Server struct {
+	Addr     string // host:port to listen
+	Username string // if set, clients must connect with Username and Password
+	Password string
+
+	mu       sync.Mutex
+	listener net.Listener
+	clients  map[string]*client
+	sessions map[string]map[string]byte // subscriptions of disconnected persistent sessions
+	retained map[string]Message
+	closed   bool
+	lastID   uint64
+}
+
+// NewServer returns a Server which listens on addr.
+func NewServer(addr string) *Server {
+	return &Server{
+		Addr:     addr,
+		clients:  make(map[string]*client),
+		sessions: make(map[string]map[string]byte),
+		retained: make(map[string]Message),
+	}
+}
+
+// Start listens on Addr and serves clients in background.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	log.Infof("embedded broker listening on: %s", l.Addr())
+	go s.Serve(l)
+	return nil
+}
+
+// Serve accepts clients on the listener until the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return fmt.Errorf("server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// ListenAddr returns the address which the server is listening on,
+// or nil before Start.
+func (s *Server) ListenAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the listener and disconnects all clients.
+// Will messages of the clients are not published.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for _, c := range s.clients {
+		c.will = nil
+		c.close()
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// Publish routes the message to subscribing clients, and stores it if
+// retained.
+func (s *Server) Publish(m Message) {
+	type target struct {
+		c   *client
+		qos byte
+	}
+	var targets []target
+
+	s.mu.Lock()
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(s.retained, m.Topic)
+		} else {
+			s.retained[m.Topic] = m
+		}
+	}
+	for _, c := range s.clients {
+		if qos, ok := c.match(m.Topic); ok {
+			targets = append(targets, target{c, qos})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, t := range targets {
+		out := m
+		out.Retain = false
+		if t.qos < out.QoS {
+			out.QoS = t.qos
+		}
+		t.c.publish(out)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, err := readPacket(r)
+	if err != nil || p.Type != CONNECT {
+		conn.Close()
+		return
+	}
+	cp, err := parseConnect(p.Body)
+	if err != nil {
+		log.Debugf("embedded broker: invalid CONNECT from %s, %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	code := byte(connAccepted)
+	switch {
+	case !(cp.ProtocolName == "MQTT" && cp.ProtocolLevel == 4) &&
+		!(cp.ProtocolName == "MQIsdp" && cp.ProtocolLevel == 3):
+		code = connRefusedVersion
+	case cp.ClientID == "" && !cp.CleanSession:
+		code = connRefusedIdentifier
+	case s.Username != "" && (cp.Username != s.Username || cp.Password != s.Password):
+		code = connRefusedBadUserPass
+	}
+	if code != connAccepted {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		conn.Write(packet{Type: CONNACK, Body: []byte{0, code}}.encode())
+		conn.Close()
+		return
+	}
+	if cp.ClientID == "" {
+		cp.ClientID = fmt.Sprintf("fuji-embedded-%d", atomic.AddUint64(&s.lastID, 1))
+	}
+
+	c := &client{
+		server: s,
+		conn:   conn,
+		id:     cp.ClientID,
+		clean:  cp.CleanSession,
+		subs:   make(map[string]byte),
+		out:    make(chan packet, outQueueSize),
+		done:   make(chan struct{}),
+	}
+	if cp.WillFlag {
+		c.will = &Message{Topic: cp.WillTopic, Payload: cp.WillMessage, QoS: cp.WillQoS, Retain: cp.WillRetain}
+	}
+
+	present, ok := s.register(c)
+	if !ok {
+		conn.Close()
+		return
+	}
+	var ack byte
+	if present {
+		ack = 0x01
+	}
+	c.send(packet{Type: CONNACK, Body: []byte{ack, connAccepted}})
+	log.Debugf("embedded broker: client connected: %s", c.id)
+
+	go c.writeLoop()
+	graceful := c.readLoop(r, time.Duration(cp.KeepAlive)*time.Second)
+	c.close()
+	s.unregister(c, graceful)
+	log.Debugf("embedded broker: client disconnected: %s", c.id)
+}
+
+// register adds the client. An existing client which has the same ID is
+// disconnected. Returns true as session present if the persistent
+// session is resumed.
+func (s *Server) register(c *client) (present bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, false
+	}
+	if old, ok := s.clients[c.id]; ok {
+		old.close()
+		if !old.clean {
+			s.sessions[c.id] = old.subs
+		}
+	}
+	s.clients[c.id] = c
+
+	if c.clean {
+		delete(s.sessions, c.id)
+		return false, true
+	}
+	if subs, ok := s.sessions[c.id]; ok {
+		c.subs = subs
+		delete(s.sessions, c.id)
+		return true, true
+	}
+	return false, true
+}
+
+// unregister removes the client, and publishes its will message unless
+// disconnected by DISCONNECT.
+func (s *Server) unregister(c *client, graceful bool) {
+	s.mu.Lock()
+	if cur, ok := s.clients[c.id]; ok && cur == c {
+		delete(s.clients, c.id)
+		if !c.clean {
+			s.sessions[c.id] = c.subs
+		}
+	}
+	will := c.will
+	s.mu.Unlock()
+
+	if !graceful && will != nil {
+		s.Publish(*will)
+	}
+}
+
+// subscribe adds subscriptions to the client, and returns retained
+// messages which match them.
+func (s *Server) subscribe(c *client, subs []subscription) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []Message
+	for _, sub := range subs {
+		c.subs[sub.Filter] = sub.QoS
+		for _, m := range s.retained {
+			if message.MatchTopic(sub.Filter, m.Topic) {
+				if sub.QoS < m.QoS {
+					m.QoS = sub.QoS
+				}
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	return msgs
+}
+
+func (s *Server) unsubscribe(c *client, filters []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range filters {
+		delete(c.subs, f)
+	}
+}
+
+type client struct {
+	server *Server
+	conn   net.Conn
+	id     string
+	clean  bool
+	will   *Message
+	subs   map[string]byte // topic filter to QoS, guarded by server.mu
+
+	out       chan packet
+	done      chan struct{}
+	closeOnce sync.Once
+	lastID    uint32
+}
+
+// match returns the maximum QoS of the subscriptions which match the
+// topic. Must be called with server.mu held.
+func (c *client) match(topic string) (byte, bool) {
+	var qos byte
+	matched := false
+	for filter, q := range c.subs {
+		if message.MatchTopic(filter, topic) {
+			matched = true
+			if q > qos {
+				qos = q
+			}
+		}
+	}
+	return qos, matched
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// send queues the packet to the client. A client which does not read
+// fast enough is disconnected.
+func (c *client) send(p packet) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	default:
+		log.Warnf("embedded broker: client %s is too slow, disconnected", c.id)
+		c.close()
+	}
+}
+
+func (c *client) publish(m Message) {
+	var id uint16
+	if m.QoS > 0 {
+		for id == 0 {
+			id = uint16(atomic.AddUint32(&c.lastID, 1))
+		}
+	}
+	c.send(publishPacket(m, id))
+}
+
+func (c *client) writeLoop() {
+	for {
+		select {
+		case p := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err := c.conn.Write(p.encode()); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// readLoop handles packets from the client until disconnected. Returns
+// true if the client sent DISCONNECT.
+func (c *client) readLoop(r *bufio.Reader, keepAlive time.Duration) bool {
+	for {
+		if keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(r)
+		if err != nil {
+			return false
+		}
+
+		switch p.Type {
+		case PUBLISH:
+			m, id, err := parsePublish(p)
+			if err != nil || !validTopic(m.Topic) {
+				return false
+			}
+			switch m.QoS {
+			case 1:
+				c.send(ackPacket(PUBACK, id))
+			case 2:
+				c.send(ackPacket(PUBREC, id))
+			}
+			c.server.Publish(m)
+		case PUBREL:
+			c.send(ackPacket(PUBCOMP, packetID(p)))
+		case PUBREC:
+			c.send(ackPacket(PUBREL, packetID(p)))
+		case PUBACK, PUBCOMP:
+			// unacknowledged messages are not resent
+		case SUBSCRIBE:
+			id, subs, err := parseSubscribe(p.Body)
+			if err != nil {
+				return false
+			}
+			codes := make([]byte, 0, len(subs))
+			var granted []subscription
+			for _, sub := range subs {
+				if sub.QoS > 2 {
+					return false
+				}
+				if !message.ValidTopicFilter(sub.Filter) {
+					codes = append(codes, subackFailure)
+					continue
+				}
+				codes = append(codes, sub.QoS)
+				granted = append(granted, sub)
+			}
+			retained := c.server.subscribe(c, granted)
+			c.send(packet{Type: SUBACK, Body: append(appendUint16(nil, id), codes...)})
+			for _, m := range retained {
+				c.publish(m)
+			}
+		case UNSUBSCRIBE:
+			id, filters, err := parseUnsubscribe(p.Body)
+			if err != nil {
+				return false
+			}
+			c.server.unsubscribe(c, filters)
+			c.send(ackPacket(UNSUBACK, id))
+		case PINGREQ:
+			c.send(packet{Type: PINGRESP})
+		case DISCONNECT:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+func packetID(p packet) uint16 {
+	r := &reader{buf: p.Body}
+	return r.uint16()
+}
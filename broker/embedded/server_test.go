@@ -0,0 +1,215 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedded
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T) *Server {
+	s := NewServer("127.0.0.1:0")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// connectClient connects a client which sends received messages to the
+// returned channel.
+func connectClient(t *testing.T, s *Server, id string, opts *MQTT.ClientOptions) (*MQTT.Client, chan MQTT.Message) {
+	if opts == nil {
+		opts = MQTT.NewClientOptions()
+	}
+	msgs := make(chan MQTT.Message, 10)
+	opts.AddBroker(fmt.Sprintf("tcp://%s", s.ListenAddr()))
+	opts.SetClientID(id)
+	opts.SetDefaultPublishHandler(func(client *MQTT.Client, msg MQTT.Message) {
+		msgs <- msg
+	})
+	c := MQTT.NewClient(opts)
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return c, msgs
+}
+
+func subscribe(t *testing.T, c *MQTT.Client, filter string, qos byte, msgs chan MQTT.Message) {
+	token := c.Subscribe(filter, qos, func(client *MQTT.Client, msg MQTT.Message) {
+		msgs <- msg
+	})
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+func receive(t *testing.T, msgs chan MQTT.Message) MQTT.Message {
+	select {
+	case m := <-msgs:
+		return m
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not received")
+	}
+	return nil
+}
+
+func TestServerPubSub(t *testing.T) {
+	assert := assert.New(t)
+
+	s := startServer(t)
+	defer s.Close()
+
+	sub, msgs := connectClient(t, s, "sub", nil)
+	defer sub.Disconnect(250)
+	subscribe(t, sub, "prefix/ham/+/dummy", 1, msgs)
+
+	pub, _ := connectClient(t, s, "pub", nil)
+	defer pub.Disconnect(250)
+	for _, qos := range []byte{0, 1, 2} {
+		token := pub.Publish("prefix/ham/dora/dummy", qos, false, []byte("hello"))
+		token.Wait()
+		assert.Nil(token.Error())
+
+		m := receive(t, msgs)
+		assert.Equal("prefix/ham/dora/dummy", m.Topic())
+		assert.Equal([]byte("hello"), m.Payload())
+		if qos > 1 {
+			qos = 1 // subscribed by QoS 1
+		}
+		assert.Equal(qos, m.Qos())
+	}
+
+	// not matched
+	pub.Publish("prefix/ham/dora/serial", 0, false, []byte("hello")).Wait()
+	select {
+	case m := <-msgs:
+		t.Errorf("unexpected message: %s", m.Topic())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestServerRetain(t *testing.T) {
+	assert := assert.New(t)
+
+	s := startServer(t)
+	defer s.Close()
+
+	pub, _ := connectClient(t, s, "pub", nil)
+	defer pub.Disconnect(250)
+	pub.Publish("ham/status", 1, true, []byte("online")).Wait()
+
+	sub, msgs := connectClient(t, s, "sub", nil)
+	defer sub.Disconnect(250)
+	subscribe(t, sub, "ham/#", 0, msgs)
+	m := receive(t, msgs)
+	assert.Equal("ham/status", m.Topic())
+	assert.Equal([]byte("online"), m.Payload())
+	assert.True(m.Retained())
+
+	// empty payload deletes the retained message
+	pub.Publish("ham/status", 1, true, []byte{}).Wait()
+	receive(t, msgs)
+	sub2, msgs2 := connectClient(t, s, "sub2", nil)
+	defer sub2.Disconnect(250)
+	subscribe(t, sub2, "ham/#", 0, msgs2)
+	select {
+	case m := <-msgs2:
+		t.Errorf("unexpected retained message: %s", m.Topic())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestServerWill(t *testing.T) {
+	assert := assert.New(t)
+
+	s := startServer(t)
+	defer s.Close()
+
+	sub, msgs := connectClient(t, s, "sub", nil)
+	defer sub.Disconnect(250)
+	subscribe(t, sub, "ham/will", 0, msgs)
+
+	// connect by raw connection to close without DISCONNECT
+	conn, err := net.Dial("tcp", s.ListenAddr().String())
+	assert.Nil(err)
+	body := appendBytes(nil, []byte("MQTT"))
+	body = append(body, 4, 0x04|0x02) // will, clean session
+	body = appendUint16(body, 60)
+	body = appendBytes(body, []byte("gw"))
+	body = appendBytes(body, []byte("ham/will"))
+	body = appendBytes(body, []byte("bye"))
+	conn.Write(packet{Type: CONNECT, Body: body}.encode())
+	p, err := readPacket(bufio.NewReader(conn))
+	assert.Nil(err)
+	assert.Equal(byte(CONNACK), p.Type)
+	assert.Equal([]byte{0, connAccepted}, p.Body)
+	conn.Close()
+
+	m := receive(t, msgs)
+	assert.Equal("ham/will", m.Topic())
+	assert.Equal([]byte("bye"), m.Payload())
+}
+
+func TestServerAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewServer("127.0.0.1:0")
+	s.Username = "fuji-gw"
+	s.Password = "123"
+	assert.Nil(s.Start())
+	defer s.Close()
+
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", s.ListenAddr()))
+	opts.SetClientID("bad")
+	opts.SetUsername("fuji-gw")
+	opts.SetPassword("456")
+	c := MQTT.NewClient(opts)
+	token := c.Connect()
+	token.Wait()
+	assert.NotNil(token.Error())
+
+	opts = MQTT.NewClientOptions()
+	opts.SetUsername("fuji-gw")
+	opts.SetPassword("123")
+	c, _ = connectClient(t, s, "good", opts)
+	c.Disconnect(250)
+}
+
+func TestServerPersistentSession(t *testing.T) {
+	s := startServer(t)
+	defer s.Close()
+
+	opts := MQTT.NewClientOptions().SetCleanSession(false)
+	sub, msgs := connectClient(t, s, "sub", opts)
+	subscribe(t, sub, "ham/#", 0, msgs)
+	sub.Disconnect(250)
+
+	// subscriptions are kept after reconnect
+	opts = MQTT.NewClientOptions().SetCleanSession(false)
+	sub, msgs = connectClient(t, s, "sub", opts)
+	defer sub.Disconnect(250)
+
+	pub, _ := connectClient(t, s, "pub", nil)
+	defer pub.Disconnect(250)
+	pub.Publish("ham/dora", 0, false, []byte("hello")).Wait()
+	receive(t, msgs)
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewBrokersEmbedded(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[gateway]
+    name = ham
+[broker "local"]
+    embedded = true
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.True(b[0].Embedded)
+	assert.Equal(DefaultEmbeddedPort, b[0].Port)
+	assert.Equal("127.0.0.1", b[0].clientHost())
+
+	invalids := []string{
+		"tls = true",
+		"transport = ws",
+		"protocol_version = 5",
+	}
+	for _, v := range invalids {
+		iniStr := `
+[broker "local"]
+    embedded = true
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewBrokers(conf, make(chan message.Message))
+		assert.NotNil(err, v)
+	}
+}
+
+func TestEmbeddedPublish(t *testing.T) {
+	assert := assert.New(t)
+
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	iniStr := fmt.Sprintf(`
+[gateway]
+    name = ham
+[broker "local"]
+    embedded = true
+    host = 127.0.0.1
+    port = %d
+    topic_prefix = prefix
+`, port)
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+	assert.Nil(b.MQTTClientSetup("ham"))
+	defer b.Close()
+
+	// local client
+	received := make(chan MQTT.Message, 1)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port))
+	opts.SetClientID("local")
+	c := MQTT.NewClient(opts)
+	token := c.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	defer c.Disconnect(250)
+	token = c.Subscribe("prefix/ham/#", 0, func(client *MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	for i := 0; i < 50 && !b.IsConnected(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Nil(b.Publish(&message.Message{Sender: "dora", Type: "dummy", Body: []byte("hello")}))
+	select {
+	case m := <-received:
+		assert.Equal("prefix/ham/dora/dummy", m.Topic())
+		assert.Equal([]byte("hello"), m.Payload())
+	case <-time.After(3 * time.Second):
+		t.Error("message not received")
+	}
+}
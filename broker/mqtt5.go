@@ -0,0 +1,309 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	ProtocolVersion311 = 4
+	ProtocolVersion5   = 5
+
+	mqtt5KeepAlive = 60 // sec
+	mqtt5Timeout   = 30 * time.Second
+)
+
+var reasonStrings = map[byte]string{
+	0x00: "Success",
+	0x04: "Disconnect with Will Message",
+	0x10: "No matching subscribers",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x84: "Unsupported Protocol Version",
+	0x85: "Client Identifier not valid",
+	0x86: "Bad User Name or Password",
+	0x87: "Not authorized",
+	0x88: "Server unavailable",
+	0x89: "Server busy",
+	0x8A: "Banned",
+	0x8B: "Server shutting down",
+	0x8C: "Bad authentication method",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x91: "Packet Identifier in use",
+	0x92: "Packet Identifier not found",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
+// ReasonCodeError is an error which the broker returns by an MQTT 5.0
+// reason code.
+type ReasonCodeError struct {
+	Packet string // CONNACK, PUBACK, SUBACK or DISCONNECT
+	Code   byte
+	Reason string // reason string property sent by the broker, if any
+}
+
+func (e ReasonCodeError) Error() string {
+	s, ok := reasonStrings[e.Code]
+	if !ok {
+		s = "Unknown"
+	}
+	if e.Reason != "" {
+		return fmt.Sprintf("%s reason code 0x%02X(%s): %s", e.Packet, e.Code, s, e.Reason)
+	}
+	return fmt.Sprintf("%s reason code 0x%02X(%s)", e.Packet, e.Code, s)
+}
+
+// parseProtocolVersion parses protocol_version of the broker section.
+func parseProtocolVersion(v string) (int, error) {
+	switch v {
+	case "", "4", "3.1.1":
+		return ProtocolVersion311, nil
+	case "5", "5.0":
+		return ProtocolVersion5, nil
+	}
+	return 0, fmt.Errorf("invalid protocol_version: %s", v)
+}
+
+// dial5 connects to the broker by the transport of the broker.
+func dial5(b *Broker) (net.Conn, error) {
+	if b.IsWebsocket() {
+		return dialWebsocket(b)
+	}
+	addr := net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+	if b.Tls {
+		dialer := &net.Dialer{Timeout: dialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", addr, b.TLSConfig)
+	}
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// connect5 connects to the broker by MQTT 5.0 with a new client.
+func (b *Broker) connect5(gwName string) error {
+	log.Infof("broker connecting to: %s:%d (MQTT 5.0)", b.Host, b.Port)
+	conn, err := dial5(b)
+	if err != nil {
+		return err
+	}
+
+	client := paho.NewClient(paho.ClientConfig{
+		Conn:   packets.NewThreadSafeConn(conn),
+		Router: paho.NewSingleHandlerRouter(b.onMessageReceived5),
+		OnClientError: func(err error) {
+			b.onConnectionLost5(err)
+		},
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			e := ReasonCodeError{Packet: "DISCONNECT", Code: d.ReasonCode}
+			if d.Properties != nil {
+				e.Reason = d.Properties.ReasonString
+			}
+			b.onConnectionLost5(e)
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:     gwName,
+		KeepAlive:    mqtt5KeepAlive,
+		CleanStart:   true,
+		Username:     b.Username,
+		UsernameFlag: b.Username != "",
+		Password:     []byte(b.Password),
+		PasswordFlag: b.Password != "",
+	}
+	if !inidef.IsNil(b.WillMessage) {
+		cp.WillMessage = &paho.WillMessage{
+			Topic:   b.willTopic(gwName),
+			QoS:     b.WillQoS,
+			Retain:  b.WillRetain,
+			Payload: b.WillMessage,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer cancel()
+	ca, err := client.Connect(ctx, cp)
+	if ca != nil && ca.ReasonCode != 0 {
+		e := ReasonCodeError{Packet: "CONNACK", Code: ca.ReasonCode}
+		if ca.Properties != nil {
+			e.Reason = ca.Properties.ReasonString
+		}
+		return e
+	}
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.MQTT5Client = client
+	b.mu.Unlock()
+	b.subscribeOnConnect5()
+	return nil
+}
+
+func (b *Broker) onConnectionLost5(reason error) {
+	b.connectionLost(reason)
+}
+
+func (b *Broker) subscribeOnConnect5() {
+	log.Infof("client connected")
+	b.setState(StateConnected, nil, 0)
+	b.publishBirth()
+
+	if b.Subscribed.Length() > 0 {
+		s := &paho.Subscribe{}
+		for topic, qos := range b.Subscribed.List() {
+			s.Subscriptions = append(s.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: qos})
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+		sa, err := b.client5().Subscribe(ctx, s)
+		cancel()
+		if err != nil {
+			log.Error(err)
+		} else {
+			for i, code := range sa.Reasons {
+				if code >= 0x80 && i < len(s.Subscriptions) {
+					log.Errorf("subscribe %s failed, %v", s.Subscriptions[i].Topic, ReasonCodeError{Packet: "SUBACK", Code: code})
+				}
+			}
+		}
+	}
+
+	if b.Queue != nil && b.Queue.Len() > 0 {
+		go b.drain()
+	}
+}
+
+func (b *Broker) onMessageReceived5(p *paho.Publish) {
+	log.Debugf("topic:%s / msg:%s", p.Topic, p.Payload)
+
+	msg := message.Message{
+		Sender:         b.Name,
+		SenderPriority: b.Priority,
+		Type:           message.TypeSubscribed,
+		Body:           p.Payload,
+		Topic:          p.Topic,
+		QoS:            p.QoS,
+		Retained:       p.Retain,
+	}
+	if p.Properties != nil {
+		msg.ContentType = p.Properties.ContentType
+		msg.ResponseTopic = p.Properties.ResponseTopic
+		if p.Properties.MessageExpiry != nil {
+			msg.MessageExpiry = *p.Properties.MessageExpiry
+		}
+		if len(p.Properties.User) > 0 {
+			msg.UserProperties = make(map[string]string)
+			for _, u := range p.Properties.User {
+				msg.UserProperties[u.Key] = u.Value
+			}
+		}
+	}
+	b.GwChan <- msg
+}
+
+// publishProperties5 returns MQTT 5.0 publish properties of the message.
+// device, type and timestamp are always added to user properties.
+// timestamp is when the device read the message.
+func publishProperties5(msg *message.Message) *paho.PublishProperties {
+	props := &paho.PublishProperties{
+		ContentType:   msg.ContentType,
+		ResponseTopic: msg.ResponseTopic,
+	}
+	if msg.MessageExpiry > 0 {
+		expiry := msg.MessageExpiry
+		props.MessageExpiry = &expiry
+	}
+
+	props.User.Add("device", msg.Sender)
+	props.User.Add("type", msg.Type)
+	ts := msg.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	props.User.Add("timestamp", ts.UTC().Format(time.RFC3339Nano))
+	var keys []string
+	for k := range msg.UserProperties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		props.User.Add(k, msg.UserProperties[k])
+	}
+	return props
+}
+
+func (b *Broker) publish5(topic string, msg *message.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer cancel()
+
+	pr, err := b.client5().Publish(ctx, &paho.Publish{
+		Topic:      topic,
+		QoS:        msg.QoS,
+		Retain:     msg.Retained,
+		Payload:    msg.Body,
+		Properties: publishProperties5(msg),
+	})
+	if pr != nil {
+		e := ReasonCodeError{Packet: "PUBACK", Code: pr.ReasonCode}
+		if pr.Properties != nil {
+			e.Reason = pr.Properties.ReasonString
+		}
+		if pr.ReasonCode >= 0x80 {
+			log.Errorf("Failed to publish: %v", e)
+			return e
+		}
+		if pr.ReasonCode != 0 {
+			log.Debugf("published: %v", e)
+		}
+	}
+	if err != nil {
+		log.Errorf("Failed to publish: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewBrokersProtocolVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[broker "sango/1"]
+    host = 192.168.1.22
+    port = 1883
+    protocol_version = 5
+
+[broker "sango/2"]
+    host = 192.168.1.23
+    port = 1883
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(2, len(b))
+	assert.Equal(ProtocolVersion5, b[0].ProtocolVersion)
+	assert.Equal(ProtocolVersion311, b[1].ProtocolVersion)
+	assert.False(b[0].IsConnected())
+
+	iniStr = `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    protocol_version = 3
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	_, err = NewBrokers(conf, make(chan message.Message))
+	assert.NotNil(err)
+}
+
+func TestPublishProperties5(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := &message.Message{
+		Sender:        "dora",
+		Type:          "dummy",
+		ContentType:   "application/json",
+		MessageExpiry: 60,
+		ResponseTopic: "prefix/gw/dora/response",
+		UserProperties: map[string]string{
+			"zone":  "a",
+			"floor": "2",
+		},
+	}
+	p := publishProperties5(msg)
+	assert.Equal("application/json", p.ContentType)
+	assert.Equal("prefix/gw/dora/response", p.ResponseTopic)
+	assert.Equal(uint32(60), *p.MessageExpiry)
+	assert.Equal(5, len(p.User))
+	assert.Equal("dora", p.User.Get("device"))
+	assert.Equal("dummy", p.User.Get("type"))
+	assert.NotEqual("", p.User.Get("timestamp"))
+	// extra user properties are sorted by key
+	assert.Equal("floor", p.User[3].Key)
+	assert.Equal("zone", p.User[4].Key)
+
+	// no expiry
+	p = publishProperties5(&message.Message{Sender: "dora", Type: "dummy"})
+	assert.Nil(p.MessageExpiry)
+
+	// timestamp is the capture time
+	captured := time.Date(2015, 6, 1, 12, 34, 56, 0, time.UTC)
+	p = publishProperties5(&message.Message{Sender: "dora", Type: "dummy", Timestamp: captured})
+	assert.Equal("2015-06-01T12:34:56Z", p.User.Get("timestamp"))
+}
+
+func TestReasonCodeError(t *testing.T) {
+	assert := assert.New(t)
+
+	e := ReasonCodeError{Packet: "PUBACK", Code: 0x87}
+	assert.Equal("PUBACK reason code 0x87(Not authorized)", e.Error())
+	e = ReasonCodeError{Packet: "CONNACK", Code: 0x86, Reason: "invalid token"}
+	assert.Equal("CONNACK reason code 0x86(Bad User Name or Password): invalid token", e.Error())
+	e = ReasonCodeError{Packet: "SUBACK", Code: 0xFF}
+	assert.Equal("SUBACK reason code 0xFF(Unknown)", e.Error())
+}
@@ -0,0 +1,315 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	DefaultQueueMaxSize = 1000
+
+	QueueDropOldest = "oldest"
+	QueueDropNewest = "newest"
+
+	queueFileSuffix = ".msg"
+)
+
+// Queue is a persistent on-disk FIFO queue of messages.
+// Each message is stored as one file in Dir so that the queue survives
+// a gateway restart.
+type Queue struct {
+	sync.Mutex
+
+	Dir     string
+	MaxSize int           // max number of messages
+	MaxAge  time.Duration // 0 means unlimited
+	Drop    string        // QueueDropOldest or QueueDropNewest
+
+	entries   []queueEntry // oldest first
+	next      uint64
+	drainDone chan struct{} // non nil while draining, closed when it ends
+}
+
+// queueEntry is a stored message. The stored time is kept in memory not to
+// read the file on every expire.
+type queueEntry struct {
+	seq    uint64
+	stored time.Time
+}
+
+// queuedMessage is the file format of a queued message.
+type queuedMessage struct {
+	Stored  time.Time
+	Message message.Message
+}
+
+// NewQueue opens the queue directory, creates it if not exists and loads
+// the messages which are already stored.
+func NewQueue(dir string, maxSize int, maxAge time.Duration, drop string) (*Queue, error) {
+	q, err := newQueue(dir, maxSize, maxAge, drop)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.Open(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// newQueue validates the settings and returns the queue which is not
+// opened yet.
+func newQueue(dir string, maxSize int, maxAge time.Duration, drop string) (*Queue, error) {
+	if maxSize < 1 {
+		return nil, fmt.Errorf("invalid queue_max_size: %d", maxSize)
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("invalid queue_max_age: %v", maxAge)
+	}
+	switch drop {
+	case "":
+		drop = QueueDropOldest
+	case QueueDropOldest, QueueDropNewest:
+	default:
+		return nil, fmt.Errorf("invalid queue_drop: %s", drop)
+	}
+	return &Queue{
+		Dir:     dir,
+		MaxSize: maxSize,
+		MaxAge:  maxAge,
+		Drop:    drop,
+	}, nil
+}
+
+// Open creates the queue directory if not exists and loads the messages
+// which are already stored.
+func (q *Queue) Open() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if err := os.MkdirAll(q.Dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(q.Dir)
+	if err != nil {
+		return err
+	}
+	q.entries = nil
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, queueFileSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileSuffix), 10, 64)
+		if err != nil {
+			log.Warnf("unknown file in queue dir, %v", name)
+			continue
+		}
+		qm, err := q.read(seq)
+		if err != nil {
+			log.Errorf("broken queued message dropped, %v", err)
+			os.Remove(q.path(seq))
+			continue
+		}
+		q.entries = append(q.entries, queueEntry{seq: seq, stored: qm.Stored})
+	}
+	sort.Slice(q.entries, func(i, j int) bool {
+		return q.entries[i].seq < q.entries[j].seq
+	})
+	if len(q.entries) > 0 {
+		q.next = q.entries[len(q.entries)-1].seq + 1
+		log.Infof("queue %s loaded, %d messages", q.Dir, len(q.entries))
+	}
+
+	return nil
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.Dir, fmt.Sprintf("%020d%s", seq, queueFileSuffix))
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.entries)
+}
+
+// Push stores the message at the tail of the queue.
+// If the queue is full, the oldest or the pushed message is dropped
+// according to Drop.
+func (q *Queue) Push(msg message.Message) error {
+	q.Lock()
+	defer q.Unlock()
+
+	q.expire()
+	if len(q.entries) >= q.MaxSize {
+		if q.Drop == QueueDropNewest {
+			log.Warnf("queue %s is full, message dropped", q.Dir)
+			return nil
+		}
+		log.Warnf("queue %s is full, oldest message dropped", q.Dir)
+		q.removeFront()
+	}
+
+	stored := time.Now()
+	buf, err := json.Marshal(queuedMessage{
+		Stored:  stored,
+		Message: msg,
+	})
+	if err != nil {
+		return err
+	}
+
+	// write to temporary file then rename, not to leave a broken message
+	path := q.path(q.next)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, queueEntry{seq: q.next, stored: stored})
+	q.next++
+
+	return nil
+}
+
+// Front returns the oldest message in the queue without removing it.
+// If the queue is empty, ok is false.
+func (q *Queue) Front() (msg message.Message, ok bool, err error) {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.front()
+}
+
+func (q *Queue) front() (message.Message, bool, error) {
+	q.expire()
+	if len(q.entries) == 0 {
+		return message.Message{}, false, nil
+	}
+	qm, err := q.read(q.entries[0].seq)
+	if err != nil {
+		return message.Message{}, false, err
+	}
+	return qm.Message, true, nil
+}
+
+// Remove removes the oldest message in the queue.
+func (q *Queue) Remove() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.entries) == 0 {
+		return fmt.Errorf("queue %s is empty", q.Dir)
+	}
+	return q.removeFront()
+}
+
+func (q *Queue) removeFront() error {
+	seq := q.entries[0].seq
+	q.entries = q.entries[1:]
+	return os.Remove(q.path(seq))
+}
+
+func (q *Queue) read(seq uint64) (queuedMessage, error) {
+	var qm queuedMessage
+
+	buf, err := ioutil.ReadFile(q.path(seq))
+	if err != nil {
+		return qm, err
+	}
+	err = json.Unmarshal(buf, &qm)
+	return qm, err
+}
+
+// expire removes messages older than MaxAge.
+func (q *Queue) expire() {
+	if q.MaxAge == 0 {
+		return
+	}
+	for len(q.entries) > 0 && time.Since(q.entries[0].stored) > q.MaxAge {
+		log.Warnf("expired queued message dropped, stored at %v", q.entries[0].stored)
+		q.removeFront()
+	}
+}
+
+// startDrain marks the queue as draining. If already draining, returns false.
+func (q *Queue) startDrain() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.drainDone != nil {
+		return false
+	}
+	q.drainDone = make(chan struct{})
+	return true
+}
+
+// stopDrain clears the draining mark.
+func (q *Queue) stopDrain() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.endDrain()
+}
+
+// endDrain clears the draining mark and wakes up the waiters.
+// q must be locked.
+func (q *Queue) endDrain() {
+	if q.drainDone != nil {
+		close(q.drainDone)
+		q.drainDone = nil
+	}
+}
+
+// drainWait returns a channel which is closed when the running drain ends.
+// Returns nil if not draining.
+func (q *Queue) drainWait() <-chan struct{} {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.drainDone
+}
+
+// nextDrain returns the oldest message for draining. If the queue is empty,
+// the draining mark is cleared at the same time so that a message pushed
+// just after that starts a new drain.
+func (q *Queue) nextDrain() (message.Message, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	msg, ok, err := q.front()
+	if !ok {
+		q.endDrain()
+	}
+	return msg, ok, err
+}
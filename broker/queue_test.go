@@ -0,0 +1,246 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestQueuePushFront(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir, 10, 0, "")
+	assert.Nil(err)
+	assert.Equal(QueueDropOldest, q.Drop)
+
+	_, ok, err := q.Front()
+	assert.Nil(err)
+	assert.False(ok)
+
+	assert.Nil(q.Push(message.Message{Sender: "dora", Body: []byte("1")}))
+	assert.Nil(q.Push(message.Message{Sender: "dora", Body: []byte("2")}))
+	assert.Equal(2, q.Len())
+
+	msg, ok, err := q.Front()
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal("dora", msg.Sender)
+	assert.Equal([]byte("1"), msg.Body)
+
+	assert.Nil(q.Remove())
+	msg, ok, err = q.Front()
+	assert.True(ok)
+	assert.Equal([]byte("2"), msg.Body)
+
+	assert.Nil(q.Remove())
+	assert.Equal(0, q.Len())
+	assert.NotNil(q.Remove())
+}
+
+func TestQueueReload(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir, 10, 0, "")
+	assert.Nil(err)
+	for _, b := range []string{"1", "2", "3"} {
+		assert.Nil(q.Push(message.Message{Body: []byte(b)}))
+	}
+	assert.Nil(q.Remove())
+
+	// broken message is dropped on open
+	broken := q.path(100)
+	assert.Nil(ioutil.WriteFile(broken, []byte("{"), 0644))
+
+	// same as restarting the gateway
+	q, err = NewQueue(dir, 10, 0, "")
+	assert.Nil(err)
+	assert.Equal(2, q.Len())
+	_, err = os.Stat(broken)
+	assert.True(os.IsNotExist(err))
+	assert.Nil(q.Push(message.Message{Body: []byte("4")}))
+
+	for _, b := range []string{"2", "3", "4"} {
+		msg, ok, err := q.Front()
+		assert.Nil(err)
+		assert.True(ok)
+		assert.Equal([]byte(b), msg.Body)
+		assert.Nil(q.Remove())
+	}
+}
+
+func TestQueueDrop(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	{ // oldest
+		q, err := NewQueue(filepath.Join(dir, "oldest"), 2, 0, QueueDropOldest)
+		assert.Nil(err)
+		for _, b := range []string{"1", "2", "3"} {
+			assert.Nil(q.Push(message.Message{Body: []byte(b)}))
+		}
+		assert.Equal(2, q.Len())
+		msg, _, _ := q.Front()
+		assert.Equal([]byte("2"), msg.Body)
+	}
+	{ // newest
+		q, err := NewQueue(filepath.Join(dir, "newest"), 2, 0, QueueDropNewest)
+		assert.Nil(err)
+		for _, b := range []string{"1", "2", "3"} {
+			assert.Nil(q.Push(message.Message{Body: []byte(b)}))
+		}
+		assert.Equal(2, q.Len())
+		msg, _, _ := q.Front()
+		assert.Equal([]byte("1"), msg.Body)
+	}
+	{ // invalid
+		_, err := NewQueue(filepath.Join(dir, "invalid"), 2, 0, "middle")
+		assert.NotNil(err)
+		_, err = NewQueue(filepath.Join(dir, "invalid"), 0, 0, "")
+		assert.NotNil(err)
+	}
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir, 10, 50*time.Millisecond, "")
+	assert.Nil(err)
+	assert.Nil(q.Push(message.Message{Body: []byte("1")}))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(q.Push(message.Message{Body: []byte("2")}))
+
+	msg, ok, err := q.Front()
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal([]byte("2"), msg.Body)
+	assert.Equal(1, q.Len())
+
+	// the stored time is loaded on open
+	time.Sleep(100 * time.Millisecond)
+	q, err = NewQueue(dir, 10, 50*time.Millisecond, "")
+	assert.Nil(err)
+	assert.Equal(1, q.Len())
+	_, ok, err = q.Front()
+	assert.Nil(err)
+	assert.False(ok)
+	assert.Equal(0, q.Len())
+}
+
+func TestNewBrokersQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	iniStr := `
+[broker "sango/2"]
+    host = 192.168.1.22
+    port = 1883
+    queue_dir = ` + dir + `
+    queue_max_size = 100
+    queue_max_age = 3600
+    queue_drop = newest
+[broker "akane"]
+    host = 192.168.1.23
+    port = 1883
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+
+	// not opened
+	b, err := ParseBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	_, err = os.Stat(b[1].Queue.Dir)
+	assert.True(os.IsNotExist(err))
+
+	b, err = NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(2, len(b))
+	assert.Nil(b[0].Queue)
+	q := b[1].Queue
+	assert.NotNil(q)
+	assert.Equal(filepath.Join(dir, "sango_2"), q.Dir)
+	assert.Equal(100, q.MaxSize)
+	assert.Equal(time.Hour, q.MaxAge)
+	assert.Equal(QueueDropNewest, q.Drop)
+
+	// not connected, so queued
+	assert.Nil(b[1].Publish(&message.Message{Sender: "dora", Type: "t"}))
+	assert.Equal(1, q.Len())
+
+	iniStr = `
+[broker "sango/2"]
+    host = 192.168.1.22
+    port = 1883
+    queue_dir = ` + dir + `
+    queue_drop = random
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	_, err = NewBrokers(conf, make(chan message.Message))
+	assert.NotNil(err)
+}
+
+func TestQueueDrainWait(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQueue(dir, 10, 0, "")
+	assert.Nil(err)
+	assert.Nil(q.drainWait())
+
+	assert.True(q.startDrain())
+	assert.False(q.startDrain())
+	done := q.drainWait()
+	assert.NotNil(done)
+
+	// empty queue ends the drain and wakes up the waiters
+	_, ok, err := q.nextDrain()
+	assert.Nil(err)
+	assert.False(ok)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("drain not ended")
+	}
+	assert.Nil(q.drainWait())
+	assert.True(q.startDrain())
+}
@@ -0,0 +1,297 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ConnState is a state of the connection to the broker.
+type ConnState int
+
+const (
+	StateClosed     ConnState = iota // not started, or closed
+	StateConnecting                  // trying to connect
+	StateConnected                   // connected
+	StateBackingOff                  // waiting to reconnect
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateBackingOff:
+		return "backing off"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(s))
+}
+
+// MarshalText encodes the state by its name.
+func (s ConnState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// StateChange is sent to the watchers of the broker on every transition.
+type StateChange struct {
+	Broker *Broker
+	From   ConnState
+	To     ConnState
+	Err    error         // reason of the disconnect or the connect failure, if any
+	Delay  time.Duration // time until the next attempt on StateBackingOff
+}
+
+const (
+	DefaultRetryInitial    = 1 * time.Second
+	DefaultRetryMax        = 60 * time.Second
+	DefaultRetryMultiplier = 2.0
+	DefaultRetryJitter     = 0.2
+
+	stateChanBufferSize = 16
+)
+
+// Backoff calculates the delay before each reconnect attempt. The delay
+// starts from Initial and is multiplied by Multiplier on every failed
+// attempt up to Max. Jitter randomly shortens the delay by up to the
+// fraction, so that gateways do not reconnect at once after the broker
+// comes back.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// Delay returns the delay before the attempt, which counts from 0.
+func (bo Backoff) Delay(attempt int) time.Duration {
+	if bo.Initial <= 0 {
+		bo.Initial = DefaultRetryInitial
+	}
+	if bo.Max < bo.Initial {
+		bo.Max = bo.Initial
+	}
+	if bo.Multiplier < 1 {
+		bo.Multiplier = 1
+	}
+	d := float64(bo.Initial) * math.Pow(bo.Multiplier, float64(attempt))
+	if d > float64(bo.Max) || math.IsInf(d, 1) {
+		d = float64(bo.Max)
+	}
+	if bo.Jitter > 0 {
+		d -= d * bo.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// setBackoffValues reads retry settings of the broker section.
+// retry_interval is the first delay in seconds.
+//
+// example:
+//
+//	retry_interval = 1
+//	retry_max_interval = 60
+//	retry_multiplier = 2
+//	retry_jitter = 0.2
+func setBackoffValues(b *Broker, values map[string]string) error {
+	b.Backoff = Backoff{
+		Initial:    DefaultRetryInitial,
+		Max:        DefaultRetryMax,
+		Multiplier: DefaultRetryMultiplier,
+		Jitter:     DefaultRetryJitter,
+	}
+	if b.RetryInterval > 0 {
+		b.Backoff.Initial = time.Duration(b.RetryInterval) * time.Second
+	}
+	if v := values["retry_max_interval"]; v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil || max <= 0 {
+			return fmt.Errorf("invalid retry_max_interval: %s", v)
+		}
+		b.Backoff.Max = time.Duration(max) * time.Second
+	}
+	if v := values["retry_multiplier"]; v != "" {
+		m, err := strconv.ParseFloat(v, 64)
+		if err != nil || m < 1 {
+			return fmt.Errorf("invalid retry_multiplier: %s", v)
+		}
+		b.Backoff.Multiplier = m
+	}
+	if v := values["retry_jitter"]; v != "" {
+		j, err := strconv.ParseFloat(v, 64)
+		if err != nil || j < 0 || j > 1 {
+			return fmt.Errorf("invalid retry_jitter: %s", v)
+		}
+		b.Backoff.Jitter = j
+	}
+	if b.Backoff.Max < b.Backoff.Initial {
+		return fmt.Errorf("retry_max_interval should not be less than retry_interval")
+	}
+	return nil
+}
+
+// State returns the current state of the connection.
+func (b *Broker) State() ConnState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Watch returns a channel which receives every state transition of the
+// broker. A transition is dropped if the channel is full.
+func (b *Broker) Watch() <-chan StateChange {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan StateChange, stateChanBufferSize)
+	b.watchers = append(b.watchers, ch)
+	return ch
+}
+
+// setState changes the state and notifies the watchers. Once the broker
+// is closed, the state never changes until MQTTClientSetup is called again.
+func (b *Broker) setState(to ConnState, err error, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stopped {
+		return
+	}
+	b.changeState(to, err, delay)
+}
+
+// changeState must be called with mu held.
+func (b *Broker) changeState(to ConnState, err error, delay time.Duration) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	log.Debugf("broker %s: %s -> %s", b.Name, from, to)
+
+	change := StateChange{Broker: b, From: from, To: to, Err: err, Delay: delay}
+	for _, ch := range b.watchers {
+		select {
+		case ch <- change:
+		default:
+			log.Warnf("broker %s: state change dropped, %s -> %s", b.Name, from, to)
+		}
+	}
+}
+
+// start prepares the reconnect loop. Returns the channels of the loop.
+func (b *Broker) start() (closed chan bool, lost chan error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = false
+	b.closed = make(chan bool)
+	b.lost = make(chan error, 1)
+	return b.closed, b.lost
+}
+
+// stop stops the reconnect loop and changes the state to StateClosed.
+func (b *Broker) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	b.changeState(StateClosed, nil, 0)
+	b.stopped = true
+}
+
+func (b *Broker) isStopped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopped
+}
+
+// connectionLost is called when the connection is lost, and wakes up
+// the reconnect loop.
+func (b *Broker) connectionLost(reason error) {
+	log.Errorf("MQTT broker disconnected(%s): %s", b.Name, reason)
+	b.mu.Lock()
+	lost := b.lost
+	b.mu.Unlock()
+	if lost == nil {
+		return
+	}
+	select {
+	case lost <- reason:
+	default: // already notified
+	}
+}
+
+// connect tries to connect to the broker once. The state changes to
+// StateConnected by the on connect handler.
+func (b *Broker) connect(gwName string, lost chan error) error {
+	// discard the notification from the previous connection
+	select {
+	case <-lost:
+	default:
+	}
+	b.setState(StateConnecting, nil, 0)
+
+	var err error
+	if b.ProtocolVersion == ProtocolVersion5 {
+		err = b.connect5(gwName)
+	} else {
+		err = b.connect3(gwName)
+	}
+	if err != nil {
+		log.Errorf("Failed to connect MQTT broker(%s): %v", b.Name, err)
+		return err
+	}
+	if b.isStopped() {
+		// closed while connecting
+		b.disconnect()
+		return fmt.Errorf("broker %s closed", b.Name)
+	}
+	return nil
+}
+
+// keep reconnects to the broker with backoff after the connection is
+// lost or the connect fails, until the broker is closed. err is the
+// result of the first connect.
+func (b *Broker) keep(gwName string, err error, closed chan bool, lost chan error) {
+	attempt := 0
+	for {
+		if err == nil {
+			attempt = 0
+			select {
+			case <-closed:
+				return
+			case err = <-lost:
+			}
+		}
+
+		delay := b.Backoff.Delay(attempt)
+		attempt++
+		b.setState(StateBackingOff, err, delay)
+		select {
+		case <-closed:
+			return
+		case <-time.After(delay):
+		}
+		err = b.connect(gwName, lost)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker/embedded"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	bo := Backoff{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, e := range expected {
+		assert.Equal(e*time.Second, bo.Delay(i))
+	}
+	assert.Equal(10*time.Second, bo.Delay(10000))
+
+	bo.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := bo.Delay(1)
+		assert.True(d >= time.Second && d <= 2*time.Second, d.String())
+	}
+
+	// zero value does not busy loop
+	assert.Equal(DefaultRetryInitial, Backoff{}.Delay(3))
+}
+
+func TestNewBrokersBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(Backoff{
+		Initial:    DefaultRetryInitial,
+		Max:        DefaultRetryMax,
+		Multiplier: DefaultRetryMultiplier,
+		Jitter:     DefaultRetryJitter,
+	}, b[0].Backoff)
+	assert.Equal(StateClosed, b[0].State())
+
+	iniStr = `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    retry_interval = 5
+    retry_max_interval = 300
+    retry_multiplier = 1.5
+    retry_jitter = 0
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	b, err = NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(Backoff{
+		Initial:    5 * time.Second,
+		Max:        300 * time.Second,
+		Multiplier: 1.5,
+		Jitter:     0,
+	}, b[0].Backoff)
+
+	invalids := []string{
+		"retry_max_interval = 0",
+		"retry_multiplier = 0.5",
+		"retry_jitter = 1.5",
+		"retry_jitter = abc",
+		"retry_interval = 10\n    retry_max_interval = 5",
+	}
+	for _, v := range invalids {
+		iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewBrokers(conf, make(chan message.Message))
+		assert.NotNil(err, v)
+	}
+}
+
+// waitState waits the transition to the state, and returns it.
+func waitState(t *testing.T, ch <-chan StateChange, to ConnState) StateChange {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case c := <-ch:
+			if c.To == to {
+				return c
+			}
+		case <-timeout:
+			t.Fatalf("state %s not reached", to)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	// find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	iniStr := fmt.Sprintf(`
+[broker "sango"]
+    host = 127.0.0.1
+    port = %d
+    retry_max_interval = 1
+`, port)
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+	ch := b.Watch()
+
+	// the first connect fails, and is retried
+	assert.Nil(b.MQTTClientSetup("ham"))
+	c := waitState(t, ch, StateBackingOff)
+	assert.NotNil(c.Err)
+	assert.Equal(b, c.Broker)
+	assert.False(b.IsConnected())
+
+	s := embedded.NewServer(addr)
+	assert.Nil(s.Start())
+	waitState(t, ch, StateConnected)
+	assert.True(b.IsConnected())
+
+	// lost, and reconnected
+	s.Close()
+	waitState(t, ch, StateBackingOff)
+	assert.False(b.IsConnected())
+	s = embedded.NewServer(addr)
+	assert.Nil(s.Start())
+	defer s.Close()
+	waitState(t, ch, StateConnected)
+
+	b.Close()
+	waitState(t, ch, StateClosed)
+	assert.Equal(StateClosed, b.State())
+	assert.False(b.IsConnected())
+}
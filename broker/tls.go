@@ -0,0 +1,125 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/inidef"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCipherSuites = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+// setTLSValues reads TLS settings of the broker section.
+// The certificate files are loaded by NewTLSConfig.
+func setTLSValues(b *Broker, values map[string]string) error {
+	b.Tls = true
+	b.CaCert = values["cacert"]
+	if b.CaCert == "" && values["cert"] != "" {
+		log.Warnf("broker %s: 'cert' is deprecated, use 'cacert'", b.Name)
+		b.CaCert = values["cert"]
+	}
+	b.ClientCert = values["client_cert"]
+	b.ClientKey = values["client_key"]
+	if (b.ClientCert == "") != (b.ClientKey == "") {
+		return fmt.Errorf("both client_cert and client_key are required")
+	}
+	b.ServerName = values["server_name"]
+
+	if v := values["tls_min_version"]; v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return fmt.Errorf("invalid tls_min_version: %s", v)
+		}
+		b.TLSMinVersion = version
+	}
+	if v := values["tls_ciphers"]; v != "" {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			suite, ok := tlsCipherSuites[name]
+			if !ok {
+				return fmt.Errorf("unknown cipher suite: %s", name)
+			}
+			b.TLSCiphers = append(b.TLSCiphers, suite)
+		}
+	}
+	return nil
+}
+
+// NewTLSConfig returns TLS config from TLS settings of the broker.
+// The server certificate and hostname are always verified. If CaCert is
+// empty, system root CAs are used.
+func NewTLSConfig(b *Broker) (*tls.Config, error) {
+	serverName := b.ServerName
+	if serverName == "" {
+		serverName = b.Host
+	}
+	config := &tls.Config{
+		ServerName:   serverName,
+		MinVersion:   b.TLSMinVersion,
+		CipherSuites: b.TLSCiphers,
+	}
+
+	if b.CaCert != "" {
+		certPool := x509.NewCertPool()
+		pemCerts, err := ioutil.ReadFile(b.CaCert)
+		if err != nil {
+			return nil, inidef.Error("Cert File could not be read.")
+		}
+		if !certPool.AppendCertsFromPEM(pemCerts) {
+			return nil, inidef.Error("Server Certificate parse failed")
+		}
+		config.RootCAs = certPool
+	}
+
+	if b.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(b.ClientCert, b.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate load failed, %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
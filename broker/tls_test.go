@@ -0,0 +1,174 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fuji-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certPath, keyPath
+}
+
+func TestNewBrokersTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-tls")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCert(t, dir)
+
+	iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 8883
+    tls = true
+    cacert = ` + certPath + `
+    client_cert = ` + certPath + `
+    client_key = ` + keyPath + `
+    server_name = mqtt.example.com
+    tls_min_version = 1.2
+    tls_ciphers = TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(1, len(b))
+	assert.True(b[0].Tls)
+
+	c := b[0].TLSConfig
+	assert.NotNil(c)
+	assert.False(c.InsecureSkipVerify)
+	assert.NotNil(c.RootCAs)
+	assert.Equal(1, len(c.Certificates))
+	assert.Equal("mqtt.example.com", c.ServerName)
+	assert.Equal(uint16(tls.VersionTLS12), c.MinVersion)
+	assert.Equal([]uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	}, c.CipherSuites)
+}
+
+func TestNewBrokersTLSDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-tls")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	certPath, _ := writeTestCert(t, dir)
+
+	// system root CAs, server name is host
+	iniStr := `
+[broker "sango"]
+    host = mqtt.example.com
+    port = 8883
+    tls = true
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	c := b[0].TLSConfig
+	assert.NotNil(c)
+	assert.Nil(c.RootCAs)
+	assert.Equal("mqtt.example.com", c.ServerName)
+	assert.Equal(0, len(c.Certificates))
+
+	// deprecated cert key is read as cacert
+	iniStr = `
+[broker "sango"]
+    host = mqtt.example.com
+    port = 8883
+    tls = true
+    cert = ` + certPath + `
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	b, err = NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(certPath, b[0].CaCert)
+	assert.NotNil(b[0].TLSConfig.RootCAs)
+}
+
+func TestNewBrokersTLSInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-tls")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	certPath, _ := writeTestCert(t, dir)
+
+	invalids := []string{
+		"client_cert = " + certPath, // without client_key
+		"tls_min_version = 0.9",
+		"tls_ciphers = TLS_NO_SUCH_CIPHER",
+		"cacert = " + filepath.Join(dir, "doesNotExist.pem"),
+	}
+	for _, v := range invalids {
+		iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 8883
+    tls = true
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewBrokers(conf, make(chan message.Message))
+		assert.NotNil(err, v)
+	}
+}
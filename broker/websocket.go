@@ -0,0 +1,399 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go.net/websocket"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	TransportTCP = "tcp"
+	TransportWS  = "ws"
+	TransportWSS = "wss"
+
+	DefaultWSPath = "/mqtt"
+
+	wsHeaderPrefix = "ws_header_"
+	dialTimeout    = 30 * time.Second
+)
+
+// IsWebsocket returns true if the broker is connected over WebSocket.
+func (b *Broker) IsWebsocket() bool {
+	return b.Transport == TransportWS || b.Transport == TransportWSS
+}
+
+// setTransportValues reads transport settings of the broker section.
+// Extra HTTP headers are written as ws_header_<Header-Name> = value.
+func setTransportValues(b *Broker, values map[string]string) error {
+	b.Transport = values["transport"]
+	switch b.Transport {
+	case "":
+		b.Transport = TransportTCP
+	case TransportTCP, TransportWS, TransportWSS:
+	default:
+		return fmt.Errorf("invalid transport: %s", b.Transport)
+	}
+	if b.Transport == TransportWS && values["tls"] == "true" {
+		// ws is always plaintext
+		return fmt.Errorf("tls = true can not be used with transport = ws, use wss")
+	}
+
+	b.WSPath = values["ws_path"]
+	if b.WSPath == "" {
+		b.WSPath = DefaultWSPath
+	}
+	if !strings.HasPrefix(b.WSPath, "/") {
+		return fmt.Errorf("ws_path should start with '/': %s", b.WSPath)
+	}
+
+	b.WSHeaders = http.Header{}
+	for k, v := range values {
+		if strings.HasPrefix(k, wsHeaderPrefix) && len(k) > len(wsHeaderPrefix) {
+			b.WSHeaders.Add(k[len(wsHeaderPrefix):], v)
+		}
+	}
+
+	if p := values["proxy"]; p != "" {
+		u, err := url.Parse(p)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			return fmt.Errorf("invalid proxy: %s", p)
+		}
+		b.Proxy = p
+	}
+	return nil
+}
+
+// dialWebsocket connects to the broker over WebSocket, via the HTTP proxy
+// if configured.
+func dialWebsocket(b *Broker) (net.Conn, error) {
+	location := fmt.Sprintf("%s://%s%s", b.Transport, net.JoinHostPort(b.Host, strconv.Itoa(b.Port)), b.WSPath)
+	origin := fmt.Sprintf("http://%s", b.Host)
+	config, err := websocket.NewConfig(location, origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{"mqtt"}
+	for k, v := range b.WSHeaders {
+		config.Header[k] = v
+	}
+
+	addr := net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+	var conn net.Conn
+	if b.Proxy != "" {
+		conn, err = dialProxy(b.Proxy, addr)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Transport == TransportWSS {
+		tlsConn := tls.Client(conn, b.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// dialProxy connects to addr through the HTTP proxy by CONNECT method.
+func dialProxy(proxy string, addr string) (net.Conn, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the broker does not send anything before the client,
+	// so nothing is left in the bufio.Reader.
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT failed: %s", res.Status)
+	}
+	return conn, nil
+}
+
+// wsBridge relays a connection from a local TCP listener to the broker
+// over WebSocket. The MQTT client connects to the local listener, since
+// it can not use HTTP headers and proxy on WebSocket.
+//
+// The bridge is made for each connect with a random token. The MQTT client
+// sends CONNECT with LocalID, the client ID followed by the token, and the
+// bridge relays it with the client ID of the gateway. Connections without
+// the token are refused, and the bridge stops listening after the first
+// relayed one, so that other local processes can not take the bridge or
+// use it as a tunnel to the broker.
+type wsBridge struct {
+	broker   *Broker
+	clientID string
+	localID  string
+	listener net.Listener
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	claimed bool
+}
+
+func newWSBridge(b *Broker, clientID string) (*wsBridge, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	br := &wsBridge{
+		broker:   b,
+		clientID: clientID,
+		localID:  clientID + "#" + hex.EncodeToString(token),
+		listener: l,
+		conns:    make(map[net.Conn]bool),
+	}
+	go br.serve()
+	return br, nil
+}
+
+// URL returns the URL for the MQTT client to connect.
+func (br *wsBridge) URL() string {
+	return "tcp://" + br.listener.Addr().String()
+}
+
+// LocalID returns the client ID for the MQTT client to connect.
+func (br *wsBridge) LocalID() string {
+	return br.localID
+}
+
+func (br *wsBridge) serve() {
+	for {
+		local, err := br.listener.Accept()
+		if err != nil { // closed
+			return
+		}
+		go br.relay(local)
+	}
+}
+
+// claim marks the bridge as used. Returns false if already used.
+func (br *wsBridge) claim() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if br.claimed {
+		return false
+	}
+	br.claimed = true
+	return true
+}
+
+func (br *wsBridge) relay(local net.Conn) {
+	br.track(local, true)
+	defer br.track(local, false)
+
+	local.SetReadDeadline(time.Now().Add(dialTimeout))
+	head, err := readConnect(local, br.localID, br.clientID)
+	if err == nil && !br.claim() {
+		err = fmt.Errorf("already connected")
+	}
+	if err != nil {
+		log.Errorf("websocket bridge refused a connection(%s): %v", br.broker.Name, err)
+		local.Close()
+		return
+	}
+	br.listener.Close()
+	local.SetReadDeadline(time.Time{})
+
+	remote, err := dialWebsocket(br.broker)
+	if err != nil {
+		log.Errorf("websocket connect failed(%s): %v", br.broker.Name, err)
+		local.Close()
+		return
+	}
+	br.track(remote, true)
+	defer br.track(remote, false)
+	if _, err := remote.Write(head); err != nil {
+		local.Close()
+		remote.Close()
+		return
+	}
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- true
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- true
+	}()
+	<-done
+	local.Close()
+	remote.Close()
+	<-done
+}
+
+func (br *wsBridge) track(conn net.Conn, add bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if add {
+		br.conns[conn] = true
+	} else {
+		delete(br.conns, conn)
+	}
+}
+
+// readConnect reads the head of the CONNECT packet up to the client ID
+// and returns it with the client ID replaced by clientID. It returns error
+// if the packet is not CONNECT or the client ID is not localID.
+func readConnect(r io.Reader, localID, clientID string) ([]byte, error) {
+	var head []byte
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		head = append(head, buf...)
+		return buf, nil
+	}
+	readString := func() (string, error) {
+		l, err := read(2)
+		if err != nil {
+			return "", err
+		}
+		s, err := read(int(l[0])<<8 | int(l[1]))
+		return string(s), err
+	}
+
+	// fixed header
+	b, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != 0x10 {
+		return nil, fmt.Errorf("not CONNECT: 0x%02x", b[0])
+	}
+	length := 0
+	for i := 0; ; i++ { // remaining length
+		b, err := read(1)
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b[0]&0x7f) << (7 * uint(i))
+		if b[0]&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, fmt.Errorf("malformed remaining length")
+		}
+	}
+	head = nil // the fixed header is written again with the new length
+
+	// protocol name, level, flags, keep alive and client ID
+	if _, err := readString(); err != nil {
+		return nil, err
+	}
+	if _, err := read(4); err != nil {
+		return nil, err
+	}
+	variable := len(head)
+	id, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	if id != localID {
+		return nil, fmt.Errorf("unknown client ID: %s", id)
+	}
+
+	length += len(clientID) - len(localID)
+	ret := []byte{0x10}
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		ret = append(ret, b)
+		if length == 0 {
+			break
+		}
+	}
+	ret = append(ret, head[:variable]...)
+	ret = append(ret, byte(len(clientID)>>8), byte(len(clientID)))
+	return append(ret, clientID...), nil
+}
+
+// Close stops the listener and closes relaying connections.
+func (br *wsBridge) Close() error {
+	err := br.listener.Close()
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	for conn := range br.conns {
+		conn.Close()
+	}
+	return err
+}
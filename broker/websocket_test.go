@@ -0,0 +1,277 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewBrokersWebsocket(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 8080
+    transport = ws
+    ws_path = /ws/mqtt
+    ws_header_X-Api-Key = secret
+    proxy = http://proxy.example.com:3128
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.True(b[0].IsWebsocket())
+	assert.Equal("/ws/mqtt", b[0].WSPath)
+	assert.Equal("secret", b[0].WSHeaders.Get("X-Api-Key"))
+	assert.Equal("http://proxy.example.com:3128", b[0].Proxy)
+	assert.False(b[0].Tls)
+
+	// default
+	iniStr = `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 443
+    transport = wss
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	b, err = NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(DefaultWSPath, b[0].WSPath)
+	assert.True(b[0].Tls)
+	assert.NotNil(b[0].TLSConfig)
+
+	invalids := []string{
+		"transport = quic",
+		"transport = ws\n    ws_path = mqtt",
+		"transport = ws\n    proxy = socks5://proxy.example.com",
+		"transport = ws\n    tls = true",
+	}
+	for _, v := range invalids {
+		iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 8080
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewBrokers(conf, make(chan message.Message))
+		assert.NotNil(err, v)
+	}
+}
+
+// newEchoServer starts WebSocket echo server on /mqtt and returns the
+// broker which connects to it.
+func newEchoServer(t *testing.T) (*httptest.Server, *Broker) {
+	mux := http.NewServeMux()
+	mux.Handle("/mqtt", websocket.Handler(func(ws *websocket.Conn) {
+		if ws.Request().Header.Get("X-Api-Key") != "secret" {
+			return
+		}
+		io.Copy(ws, ws)
+	}))
+	s := httptest.NewServer(mux)
+
+	u, _ := url.Parse(s.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	b := &Broker{
+		Name:      "sango",
+		Host:      host,
+		Port:      p,
+		Transport: TransportWS,
+		WSPath:    "/mqtt",
+		WSHeaders: http.Header{"X-Api-Key": []string{"secret"}},
+	}
+	return s, b
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	assert := assert.New(t)
+
+	_, err := conn.Write([]byte("ping"))
+	assert.Nil(err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(err)
+	assert.Equal([]byte("ping"), buf)
+}
+
+func TestDialWebsocket(t *testing.T) {
+	s, b := newEchoServer(t)
+	defer s.Close()
+
+	conn, err := dialWebsocket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestDialWebsocketProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	s, b := newEchoServer(t)
+	defer s.Close()
+
+	// minimal CONNECT proxy
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	connected := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req, err := http.ReadRequest(bufio.NewReader(c))
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		connected <- req.Host + " " + req.Header.Get("Proxy-Authorization")
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			return
+		}
+		defer target.Close()
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(target, c)
+		io.Copy(c, target)
+	}()
+
+	b.Proxy = "http://user:pass@" + l.Addr().String()
+	conn, err := dialWebsocket(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+	assert.Equal(net.JoinHostPort(b.Host, strconv.Itoa(b.Port))+" Basic dXNlcjpwYXNz", <-connected)
+}
+
+// connectPacket returns CONNECT packet of MQTT 3.1.1 with the client ID.
+func connectPacket(id string) []byte {
+	body := []byte{0, 4, 'M', 'Q', 'T', 'T', 4, 2, 0, 60, 0, byte(len(id))}
+	body = append(body, id...)
+	if len(body) > 127 {
+		return append([]byte{0x10, byte(len(body)&0x7f | 0x80), byte(len(body) >> 7)}, body...)
+	}
+	return append([]byte{0x10, byte(len(body))}, body...)
+}
+
+func TestReadConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	head, err := readConnect(bytes.NewReader(connectPacket("ham#token")), "ham#token", "ham")
+	assert.Nil(err)
+	assert.Equal(connectPacket("ham"), head)
+
+	// remaining length changes from 2 bytes to 1 byte
+	long := strings.Repeat("x", 200)
+	head, err = readConnect(bytes.NewReader(connectPacket(long)), long, "ham")
+	assert.Nil(err)
+	assert.Equal(connectPacket("ham"), head)
+
+	_, err = readConnect(bytes.NewReader(connectPacket("ham")), "ham#token", "ham")
+	assert.NotNil(err)
+}
+
+func TestWSBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	s, b := newEchoServer(t)
+	defer s.Close()
+
+	br, err := newWSBridge(b, "ham")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+
+	u, _ := url.Parse(br.URL())
+
+	// a connection without the token does not take the bridge
+	spam, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam.Write(connectPacket("ham"))
+	_, err = spam.Read(make([]byte, 1))
+	assert.NotNil(err)
+	spam.Close()
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(connectPacket(br.LocalID()))
+	assert.Nil(err)
+	// relayed with the client ID of the gateway
+	packet := connectPacket("ham")
+	buf := make([]byte, len(packet))
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(err)
+	assert.Equal(packet, buf)
+	assertEcho(t, conn)
+
+	// accepts only one connection
+	_, err = net.Dial("tcp", u.Host)
+	assert.NotNil(err)
+}
+
+func TestWSBridgeRefuse(t *testing.T) {
+	s, b := newEchoServer(t)
+	defer s.Close()
+
+	for _, packet := range [][]byte{
+		connectPacket("spam"),
+		connectPacket("ham"),
+		[]byte("GET / HTTP/1.1\r\n\r\n"),
+	} {
+		br, err := newWSBridge(b, "ham")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(br.URL())
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(packet)
+		// closed without relaying
+		_, err = conn.Read(make([]byte, 1))
+		assert.NotNil(t, err, string(packet))
+		conn.Close()
+		br.Close()
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/eclipse/paho.golang/paho"
+
+	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/utils"
+)
+
+const (
+	DefaultWillTopic = "{prefix}/{gateway}/will"
+
+	offlineTimeout = 5 * time.Second
+)
+
+// setWillValues reads will, birth and offline settings of the broker
+// section. Birth and offline messages are published to the will topic
+// with the same QoS and retain, unless birth_topic is set.
+//
+// example:
+//
+//	will_message = offline
+//	will_topic = {prefix}/{gateway}/status
+//	will_qos = 1
+//	will_retain = true
+//	birth_message = online
+func setWillValues(b *Broker, values map[string]string) error {
+	var err error
+
+	b.WillTopic = DefaultWillTopic
+	if values["will_topic"] != "" {
+		b.WillTopic, err = message.ParseTopicTemplate(values["will_topic"])
+		if err != nil {
+			return err
+		}
+	}
+	if v := values["will_qos"]; v != "" {
+		qos, err := strconv.Atoi(v)
+		if err != nil || qos < 0 || qos > 2 {
+			return fmt.Errorf("invalid will_qos: %s", v)
+		}
+		b.WillQoS = byte(qos)
+	}
+	b.WillRetain = true
+	if v := values["will_retain"]; v != "" {
+		b.WillRetain, err = strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid will_retain: %s", v)
+		}
+	}
+
+	b.BirthTopic = b.WillTopic
+	if values["birth_topic"] != "" {
+		b.BirthTopic, err = message.ParseTopicTemplate(values["birth_topic"])
+		if err != nil {
+			return err
+		}
+	}
+	b.BirthMessage, err = utils.ParsePayload(values["birth_message"])
+	if err != nil {
+		return fmt.Errorf("birth_message, %v", err)
+	}
+
+	// the will is not sent on graceful disconnect, so send it by ourselves
+	b.OfflineMessage = b.WillMessage
+	if _, ok := values["offline_message"]; ok {
+		b.OfflineMessage, err = utils.ParsePayload(values["offline_message"])
+		if err != nil {
+			return fmt.Errorf("offline_message, %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *Broker) renderTopic(tmpl message.TopicTemplate, gwName string) string {
+	return tmpl.Render(message.TopicVars{
+		Prefix:  b.TopicPrefix,
+		Gateway: gwName,
+		Broker:  b.Name,
+	})
+}
+
+// willTopic returns the will topic. Offline messages are published to it too.
+func (b *Broker) willTopic(gwName string) string {
+	tmpl := b.WillTopic
+	if tmpl == "" {
+		tmpl = DefaultWillTopic
+	}
+	return b.renderTopic(tmpl, gwName)
+}
+
+// publishBirth publishes the birth message on every (re)connect.
+func (b *Broker) publishBirth() {
+	if len(b.BirthMessage) == 0 {
+		return
+	}
+	topic := b.renderTopic(b.BirthTopic, b.GatewayName)
+	if err := b.publishRaw(topic, b.WillQoS, b.WillRetain, b.BirthMessage); err != nil {
+		log.Errorf("failed to publish birth message: %v", err)
+		return
+	}
+	log.Infof("birth message published: %s", topic)
+}
+
+// publishOffline publishes the offline message before graceful disconnect.
+func (b *Broker) publishOffline() {
+	if len(b.OfflineMessage) == 0 || !b.IsConnected() {
+		return
+	}
+	topic := b.willTopic(b.GatewayName)
+	if err := b.publishRaw(topic, b.WillQoS, b.WillRetain, b.OfflineMessage); err != nil {
+		log.Errorf("failed to publish offline message: %v", err)
+	}
+}
+
+// publishRaw publishes the payload to the topic as is.
+func (b *Broker) publishRaw(topic string, qos byte, retain bool, payload []byte) error {
+	if b.ProtocolVersion == ProtocolVersion5 {
+		ctx, cancel := context.WithTimeout(context.Background(), offlineTimeout)
+		defer cancel()
+		_, err := b.client5().Publish(ctx, &paho.Publish{
+			Topic:   topic,
+			QoS:     qos,
+			Retain:  retain,
+			Payload: payload,
+		})
+		return err
+	}
+
+	token := b.client().Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(offlineTimeout) {
+		return fmt.Errorf("publish timeout: %s", topic)
+	}
+	return token.Error()
+}
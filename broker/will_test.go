@@ -0,0 +1,260 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package broker
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker/embedded"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewBrokersWill(t *testing.T) {
+	assert := assert.New(t)
+
+	// default
+	iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    will_message = bye
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal(message.TopicTemplate(DefaultWillTopic), b[0].WillTopic)
+	assert.Equal(byte(0), b[0].WillQoS)
+	assert.True(b[0].WillRetain)
+	assert.Equal(0, len(b[0].BirthMessage))
+	assert.Equal([]byte("bye"), b[0].OfflineMessage)
+
+	iniStr = `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    topic_prefix = prefix
+    will_message = lost
+    will_topic = {prefix}/{gateway}/status
+    will_qos = 1
+    will_retain = false
+    birth_message = online
+    offline_message = offline
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	b, err = NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	assert.Equal("prefix/ham/status", b[0].willTopic("ham"))
+	assert.Equal(byte(1), b[0].WillQoS)
+	assert.False(b[0].WillRetain)
+	assert.Equal(b[0].WillTopic, b[0].BirthTopic)
+	assert.Equal([]byte("online"), b[0].BirthMessage)
+	assert.Equal([]byte("offline"), b[0].OfflineMessage)
+
+	invalids := []string{
+		"will_qos = 3",
+		"will_retain = maybe",
+		"will_topic = {prefix}/{unknown}",
+		"birth_topic = {prefix}/+",
+	}
+	for _, v := range invalids {
+		iniStr := `
+[broker "sango"]
+    host = 192.168.1.22
+    port = 1883
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewBrokers(conf, make(chan message.Message))
+		assert.NotNil(err, v)
+	}
+}
+
+func TestBirthAndOffline(t *testing.T) {
+	assert := assert.New(t)
+
+	s := embedded.NewServer("127.0.0.1:0")
+	assert.Nil(s.Start())
+	defer s.Close()
+
+	// subscriber
+	received := make(chan MQTT.Message, 2)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", s.ListenAddr()))
+	opts.SetClientID("subscriber")
+	c := MQTT.NewClient(opts)
+	token := c.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	defer c.Disconnect(250)
+	token = c.Subscribe("prefix/ham/status", 1, func(client *MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	_, port, _ := net.SplitHostPort(s.ListenAddr().String())
+	iniStr := `
+[gateway]
+    name = ham
+[broker "sango"]
+    host = 127.0.0.1
+    port = ` + port + `
+    topic_prefix = prefix
+    will_message = lost
+    will_topic = {prefix}/{gateway}/status
+    will_qos = 1
+    birth_message = online
+    offline_message = offline
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+	assert.Nil(b.MQTTClientSetup("ham"))
+
+	for _, expected := range []string{"online", "offline"} {
+		select {
+		case m := <-received:
+			assert.Equal("prefix/ham/status", m.Topic())
+			assert.Equal([]byte(expected), m.Payload())
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s message not received", expected)
+		}
+		if expected == "online" {
+			b.Close()
+		}
+	}
+}
+
+func TestFourceCloseWill(t *testing.T) {
+	assert := assert.New(t)
+
+	s := embedded.NewServer("127.0.0.1:0")
+	assert.Nil(s.Start())
+	defer s.Close()
+
+	received := make(chan MQTT.Message, 1)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://%s", s.ListenAddr()))
+	opts.SetClientID("subscriber")
+	c := MQTT.NewClient(opts)
+	token := c.Connect()
+	token.Wait()
+	assert.Nil(token.Error())
+	defer c.Disconnect(250)
+	token = c.Subscribe("prefix/ham/will", 1, func(client *MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	_, port, _ := net.SplitHostPort(s.ListenAddr().String())
+	iniStr := `
+[gateway]
+    name = ham
+[broker "sango"]
+    host = 127.0.0.1
+    port = ` + port + `
+    topic_prefix = prefix
+    will_message = lost
+    will_topic = {prefix}/{gateway}/will
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+	assert.Nil(b.MQTTClientSetup("ham"))
+	b.FourceClose()
+
+	select {
+	case m := <-received:
+		assert.Equal("prefix/ham/will", m.Topic())
+		assert.Equal([]byte("lost"), m.Payload())
+	case <-time.After(3 * time.Second):
+		t.Fatal("will message not received")
+	}
+}
+
+func TestFourceCloseWill5(t *testing.T) {
+	assert := assert.New(t)
+
+	// the embedded broker speaks MQTT 3.1.1 only, so checks DISCONNECT
+	// by a fake MQTT 5.0 broker.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	disconnect := make(chan *packets.Disconnect, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := packets.ReadPacket(conn); err != nil { // CONNECT
+			return
+		}
+		if _, err := packets.NewControlPacket(packets.CONNACK).WriteTo(conn); err != nil {
+			return
+		}
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				disconnect <- nil
+				return
+			}
+			if d, ok := p.Content.(*packets.Disconnect); ok {
+				disconnect <- d
+				return
+			}
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	iniStr := `
+[gateway]
+    name = ham
+[broker "sango"]
+    host = 127.0.0.1
+    port = ` + port + `
+    protocol_version = 5
+    will_message = lost
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	brokers, err := NewBrokers(conf, make(chan message.Message))
+	assert.Nil(err)
+	b := brokers[0]
+	assert.Nil(b.MQTTClientSetup("ham"))
+	// paho misses the stop of the pinger started just after CONNACK,
+	// and Disconnect waits for its next tick.
+	time.Sleep(100 * time.Millisecond)
+	b.FourceClose()
+
+	select {
+	case d := <-disconnect:
+		if assert.NotNil(d) {
+			assert.Equal(byte(packets.DisconnectDisconnectWithWillMessage), d.ReasonCode)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("DISCONNECT not received")
+	}
+}
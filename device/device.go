@@ -15,6 +15,10 @@
 package device
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/shiguredo/fuji/broker"
@@ -23,38 +27,28 @@ import (
 )
 
 type Devicer interface {
-	Start(chan message.Message) error
+	Start(context.Context, chan message.Message) error // runs until Stop is called or the context is canceled
 	DeviceType() string
-	Stop() error
+	DeviceName() string
+	Stop() error // stops the goroutines and waits until they exit
 	AddSubscribe() error
+	Match(message.Message) bool // true if the device subscribes the message
+	Inbox() *Inbox              // subscribed messages are delivered to it
 }
 
 // NewDevices is a factory method to create various kind of devices from ini.File
-func NewDevices(conf inidef.Config, brokers []*broker.Broker, devChan chan message.Message) ([]Devicer, error) {
+// Invalid devices are logged and skipped.
+func NewDevices(conf inidef.Config, brokers []*broker.Broker) ([]Devicer, error) {
 	var ret []Devicer
 
-	var err error
 	for _, section := range conf.Sections {
 		if section.Type != "device" {
 			continue
 		}
 
-		var device Devicer
-		switch section.Arg {
-		case "dummy":
-			device, err = NewDummyDevice(section, brokers, devChan)
-			if err != nil {
-				log.Errorf("could not create dummy device, %v", err)
-				continue
-			}
-		case "serial":
-			device, err = NewSerialDevice(section, brokers, devChan)
-			if err != nil {
-				log.Errorf("could not create serial device, %v", err)
-				continue
-			}
-		default:
-			log.Warnf("unknown device type, %v", section.Arg)
+		device, err := NewDevice(section, brokers)
+		if err != nil {
+			log.Errorf("could not create %s device, %v", section.Arg, err)
 			continue
 		}
 		ret = append(ret, device)
@@ -62,3 +56,50 @@ func NewDevices(conf inidef.Config, brokers []*broker.Broker, devChan chan messa
 
 	return ret, nil
 }
+
+// NewDevice creates the device of the type of the device section.
+func NewDevice(section inidef.ConfigSection, brokers []*broker.Broker) (Devicer, error) {
+	switch section.Arg {
+	case "dummy":
+		return NewDummyDevice(section, brokers)
+	case "serial":
+		return NewSerialDevice(section, brokers)
+	case "modbus_rtu":
+		return NewModbusRTUDevice(section, brokers)
+	case "modbus_tcp":
+		return NewModbusTCPDevice(section, brokers)
+	}
+	return nil, fmt.Errorf("unknown device type, %v", section.Arg)
+}
+
+// Properties are MQTT 5.0 publish properties which a device sets to
+// its messages. These are ignored if the broker speaks MQTT 3.1.1.
+type Properties struct {
+	ContentType   string `validate:"max=256"`
+	MessageExpiry uint32 // sec
+	ResponseTopic string `validate:"max=256,validtopic"`
+}
+
+// NewProperties reads content_type, message_expiry and response_topic
+// from the device section.
+func NewProperties(values map[string]string) (Properties, error) {
+	p := Properties{
+		ContentType:   values["content_type"],
+		ResponseTopic: values["response_topic"],
+	}
+	if v, ok := values["message_expiry"]; ok {
+		expiry, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return p, fmt.Errorf("message_expiry parse failed, %v", v)
+		}
+		p.MessageExpiry = uint32(expiry)
+	}
+	return p, nil
+}
+
+// Set sets the properties to the message.
+func (p Properties) Set(msg *message.Message) {
+	msg.ContentType = p.ContentType
+	msg.MessageExpiry = p.MessageExpiry
+	msg.ResponseTopic = p.ResponseTopic
+}
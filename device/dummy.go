@@ -15,9 +15,9 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -31,17 +31,22 @@ import (
 
 // DummyDevice is an dummy device which outputs only specified payload.
 type DummyDevice struct {
-	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
-	Broker     []*broker.Broker
-	BrokerName string
-	QoS        byte `validate:"min=0,max=2"`
-	InputPort  inidef.InputPortType
-	Interval   int    `validate:"min=1"`
-	Payload    []byte `validate:"max=4096"`
-	Type       string `validate:"max=256"`
-	Retain     bool
-	Subscribe  bool
-	DeviceChan chan message.Message // GW -> device
+	Name         string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker       []*broker.Broker
+	BrokerName   string
+	QoS          byte `validate:"min=0,max=2"`
+	InputPort    inidef.InputPortType
+	Interval     int    `validate:"min=1"`
+	Payload      []byte `validate:"max=4096"`
+	Type         string `validate:"max=256"`
+	Retain       bool
+	Subscribe    bool
+	Subscription Subscription          // topic filters routed to the device
+	Topic        message.TopicTemplate // overrides the topic template of the broker
+	Properties   Properties
+	Downlink     *Inbox // GW -> device
+
+	life *lifecycle
 }
 
 // String retruns dummy device information
@@ -50,10 +55,11 @@ func (dummyDevice *DummyDevice) String() string {
 }
 
 // NewDummyDevice creates dummy device which outputs specified string/binary payload.
-func NewDummyDevice(section inidef.ConfigSection, brokers []*broker.Broker, devChan chan message.Message) (DummyDevice, error) {
+func NewDummyDevice(section inidef.ConfigSection, brokers []*broker.Broker) (DummyDevice, error) {
 	ret := DummyDevice{
-		Name:       section.Name,
-		DeviceChan: devChan,
+		Name:     section.Name,
+		Downlink: NewInbox(section.Name, DefaultInboxSize),
+		life:     newLifecycle(section.Name, DefaultStopTimeout),
 	}
 	values := section.Values
 	bname, ok := section.Values["broker"]
@@ -93,9 +99,20 @@ func NewDummyDevice(section inidef.ConfigSection, brokers []*broker.Broker, devC
 		ret.Retain = true
 	}
 
-	sub, ok := values["subscribe"]
-	if ok && sub == "true" {
-		ret.Subscribe = true
+	ret.Subscription, err = NewSubscription(values, ret.Name, bname, ret.QoS, brokers)
+	if err != nil {
+		return ret, err
+	}
+	ret.Subscribe = ret.Subscription.Enabled()
+
+	ret.Topic, err = message.ParseTopicTemplate(values["topic"])
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Properties, err = NewProperties(values)
+	if err != nil {
+		return ret, err
 	}
 
 	// Validation
@@ -114,46 +131,57 @@ func (device *DummyDevice) Validate() error {
 	return nil
 }
 
-// Start starts dummy goroutine
-func (device DummyDevice) Start(channel chan message.Message) error {
+// Start starts dummy goroutine. It runs until Stop is called or ctx is
+// canceled.
+func (device DummyDevice) Start(ctx context.Context, channel chan message.Message) error {
+	ctx, err := device.life.start(ctx)
+	if err != nil {
+		return err
+	}
 	log.Info("start dummy device")
-	go device.MainLoop(channel)
+	device.life.run(func() error {
+		return device.MainLoop(ctx, channel)
+	})
 
 	return nil
 }
 
-// MainLoop is an mainloop of dummy device.
-func (device DummyDevice) MainLoop(channel chan message.Message) error {
-	timeout := make(chan bool, 1)
-	go func() { // timeout goroutine
-		for {
-			time.Sleep(time.Duration(device.Interval) * time.Second)
-			timeout <- true
-		}
-	}()
+// MainLoop is an mainloop of dummy device. It blocks until the next
+// interval or a subscribed message, and returns when ctx is canceled.
+func (device DummyDevice) MainLoop(ctx context.Context, channel chan message.Message) error {
+	ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-timeout:
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
 			msg := message.Message{
-				Sender:     device.Name,
-				Type:       device.Type,
-				QoS:        device.QoS,
-				Retained:   device.Retain,
-				Body:       []byte(device.Payload),
-				BrokerName: device.BrokerName,
+				Sender:        device.Name,
+				SenderType:    device.DeviceType(),
+				Type:          device.Type,
+				QoS:           device.QoS,
+				Retained:      device.Retain,
+				Body:          []byte(device.Payload),
+				Timestamp:     time.Now(),
+				BrokerName:    device.BrokerName,
+				TopicTemplate: device.Topic,
+			}
+			device.Properties.Set(&msg)
+			select {
+			case channel <- msg:
+			case <-ctx.Done():
+				return nil
 			}
-			channel <- msg
-		case msg, _ := <-device.DeviceChan:
-			if !strings.HasSuffix(msg.Topic, device.Name) {
+		case msg := <-device.Downlink.C:
+			if !device.Match(msg) {
 				continue
 			}
 
 			log.Infof("msg reached to device, %v", msg)
-		default:
-			// do nothing
 		}
 	}
-	return nil
 }
 
 // DeviceType retunes device type.
@@ -161,17 +189,31 @@ func (device DummyDevice) DeviceType() string {
 	return "dummy"
 }
 
+// DeviceName returns the name of the device.
+func (device DummyDevice) DeviceName() string {
+	return device.Name
+}
+
+// Stop stops the goroutine and waits until it exits.
 func (device DummyDevice) Stop() error {
 	log.Warnf("closing dummy device: %v", device.Name)
-	return nil
+	return device.life.stop()
 }
 
 func (device DummyDevice) AddSubscribe() error {
 	if !device.Subscribe {
 		return nil
 	}
-	for _, b := range device.Broker {
-		b.AddSubscribed(device.Name, device.QoS)
-	}
+	device.Subscription.AddTo(device.Broker)
 	return nil
 }
+
+// Inbox returns the downlink channel of the device.
+func (device DummyDevice) Inbox() *Inbox {
+	return device.Downlink
+}
+
+// Match returns true if the device subscribes the message.
+func (device DummyDevice) Match(msg message.Message) bool {
+	return device.Subscription.Match(msg)
+}
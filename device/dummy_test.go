@@ -38,7 +38,7 @@ func TestNewDummyDevice(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	b, err := NewDummyDevice(conf.Sections[1], brokers, make(chan message.Message))
+	b, err := NewDummyDevice(conf.Sections[1], brokers)
 	assert.Nil(err)
 	assert.NotNil(b.Broker)
 	assert.Equal("dora", b.Name)
@@ -59,7 +59,7 @@ func TestNewDummyDeviceInvalidInterval(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewDummyDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewDummyDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
@@ -75,7 +75,7 @@ func TestNewDummyDeviceInvalidQoS(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewDummyDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewDummyDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
@@ -91,6 +91,81 @@ func TestNewDummyDeviceInvalidBroker(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewDummyDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewDummyDevice(conf.Sections[1], brokers)
+	assert.NotNil(err)
+}
+
+func TestNewDummyDeviceProperties(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 1
+    interval = 10
+    payload = {"temp": 20}
+    content_type = application/json
+    message_expiry = 300
+    response_topic = sango/dora/response
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal("application/json", b.Properties.ContentType)
+	assert.Equal(uint32(300), b.Properties.MessageExpiry)
+	assert.Equal("sango/dora/response", b.Properties.ResponseTopic)
+
+	msg := message.Message{}
+	b.Properties.Set(&msg)
+	assert.Equal("application/json", msg.ContentType)
+	assert.Equal(uint32(300), msg.MessageExpiry)
+	assert.Equal("sango/dora/response", msg.ResponseTopic)
+
+	invalids := []string{
+		"message_expiry = -1",
+		"response_topic = sango/+/response",
+	}
+	for _, v := range invalids {
+		iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 1
+    interval = 10
+    ` + v + `
+`
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		_, err = NewDummyDevice(conf.Sections[1], brokers)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestNewDummyDeviceTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 1
+    interval = 10
+    topic = {prefix}/sensors/{device}
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewDummyDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(message.TopicTemplate("{prefix}/sensors/{device}"), b.Topic)
+
+	iniStr = `
+[device "dora/dummy"]
+    broker = sango
+    qos = 1
+    interval = 10
+    topic = {prefix}/{sensor}
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	_, err = NewDummyDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
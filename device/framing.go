@@ -0,0 +1,556 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Framing modes of the serial device.
+const (
+	FramingSize         = "size"          // fixed size frames
+	FramingTimeout      = "timeout"       // data arrived before the read timeout
+	FramingDelimiter    = "delimiter"     // terminated by delimiter
+	FramingSTXETX       = "stx_etx"       // between stx and etx
+	FramingLengthPrefix = "length_prefix" // length field in the header
+	FramingSLIP         = "slip"          // RFC 1055
+	FramingCOBS         = "cobs"          // Consistent Overhead Byte Stuffing
+	FramingRegex        = "regex"         // matched by frame_regex
+
+	DefaultMaxFrame = 1024
+)
+
+// Framer splits the byte stream read from the serial port into frames.
+// A framer discards the data which can not be a frame, and finds the next
+// frame from the rest, so it resynchronizes after garbage or lost bytes.
+type Framer interface {
+	// Push appends the data read from the port and returns the frames
+	// completed by it.
+	Push(data []byte) [][]byte
+	// Idle is called when no data arrives within the read timeout, and
+	// returns the frames completed by the silence.
+	Idle() [][]byte
+}
+
+// NewFramer reads framing and the options of the mode from the serial
+// device section. If framing is not set, size is used if size is set,
+// otherwise timeout. max_frame is the maximum length of a frame.
+//
+// example:
+//
+//	framing = delimiter
+//	delimiter = \r\n
+//	max_frame = 256
+func NewFramer(values map[string]string, size int) (Framer, error) {
+	mode := framingMode(values, size)
+
+	max := DefaultMaxFrame
+	if v, ok := values["max_frame"]; ok {
+		m, err := strconv.Atoi(v)
+		if err != nil || m <= 0 {
+			return nil, fmt.Errorf("invalid max_frame: %s", v)
+		}
+		max = m
+	}
+
+	switch mode {
+	case FramingSize:
+		if size <= 0 {
+			return nil, fmt.Errorf("size is required for framing = size")
+		}
+		return &sizeFramer{size: size}, nil
+	case FramingTimeout:
+		return &timeoutFramer{max: max}, nil
+	case FramingDelimiter:
+		delim, err := parseBytes(values, "delimiter", "\\n")
+		if err != nil {
+			return nil, err
+		}
+		return &delimiterFramer{delim: delim, max: max}, nil
+	case FramingSTXETX:
+		stx, err := parseBytes(values, "stx", "\\x02")
+		if err != nil {
+			return nil, err
+		}
+		etx, err := parseBytes(values, "etx", "\\x03")
+		if err != nil {
+			return nil, err
+		}
+		return &stxEtxFramer{stx: stx, etx: etx, max: max}, nil
+	case FramingLengthPrefix:
+		return newLengthFramer(values, max)
+	case FramingSLIP:
+		return &slipFramer{max: max}, nil
+	case FramingCOBS:
+		return &cobsFramer{max: max}, nil
+	case FramingRegex:
+		v := values["frame_regex"]
+		if v == "" {
+			return nil, fmt.Errorf("frame_regex is required for framing = regex")
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame_regex, %v", err)
+		}
+		return &regexFramer{re: re, max: max}, nil
+	}
+	return nil, fmt.Errorf("unknown framing: %s", mode)
+}
+
+func framingMode(values map[string]string, size int) string {
+	if mode := values["framing"]; mode != "" {
+		return mode
+	}
+	if size > 0 {
+		return FramingSize
+	}
+	return FramingTimeout
+}
+
+// parseBytes reads the value which may have escapes \r, \n, \t, \\ and
+// \xHH, ex: \r\n or \x02.
+func parseBytes(values map[string]string, key, def string) ([]byte, error) {
+	v, ok := values[key]
+	if !ok {
+		v = def
+	}
+	var ret []byte
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			ret = append(ret, v[i])
+			continue
+		}
+		if i+1 >= len(v) {
+			return nil, fmt.Errorf("invalid %s: %s", key, v)
+		}
+		i++
+		switch v[i] {
+		case 'r':
+			ret = append(ret, '\r')
+		case 'n':
+			ret = append(ret, '\n')
+		case 't':
+			ret = append(ret, '\t')
+		case '\\':
+			ret = append(ret, '\\')
+		case 'x':
+			if i+2 >= len(v) {
+				return nil, fmt.Errorf("invalid %s: %s", key, v)
+			}
+			b, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, v)
+			}
+			ret = append(ret, byte(b))
+			i += 2
+		default:
+			return nil, fmt.Errorf("invalid %s: %s", key, v)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("%s should not be empty", key)
+	}
+	return ret, nil
+}
+
+// sizeFramer splits the stream into size bytes.
+type sizeFramer struct {
+	size int
+	buf  []byte
+}
+
+func (f *sizeFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) >= f.size {
+		frames = append(frames, copyBytes(f.buf[:f.size]))
+		f.buf = f.buf[f.size:]
+	}
+	return frames
+}
+
+func (f *sizeFramer) Idle() [][]byte { return nil }
+
+// timeoutFramer sends the data arrived before the read timeout as a frame.
+type timeoutFramer struct {
+	max int
+	buf []byte
+}
+
+func (f *timeoutFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for len(f.buf) >= f.max {
+		frames = append(frames, copyBytes(f.buf[:f.max]))
+		f.buf = f.buf[f.max:]
+	}
+	return frames
+}
+
+func (f *timeoutFramer) Idle() [][]byte {
+	if len(f.buf) == 0 {
+		return nil
+	}
+	frame := f.buf
+	f.buf = nil
+	return [][]byte{frame}
+}
+
+// delimiterFramer sends the data before the delimiter. Empty frames are
+// dropped. A frame longer than max is discarded until the next delimiter.
+type delimiterFramer struct {
+	delim   []byte
+	max     int
+	buf     []byte
+	discard bool
+}
+
+func (f *delimiterFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for {
+		i := bytes.Index(f.buf, f.delim)
+		if i < 0 {
+			break
+		}
+		frame := f.buf[:i]
+		f.buf = f.buf[i+len(f.delim):]
+		if f.discard {
+			f.discard = false
+			continue
+		}
+		if len(frame) > 0 && len(frame) <= f.max {
+			frames = append(frames, copyBytes(frame))
+		}
+	}
+	// keep the tail which may be a part of the delimiter
+	if len(f.buf) > f.max+len(f.delim) {
+		log.Warnf("serial frame longer than %d discarded", f.max)
+		f.buf = copyBytes(f.buf[len(f.buf)-len(f.delim)+1:])
+		f.discard = true
+	}
+	return frames
+}
+
+func (f *delimiterFramer) Idle() [][]byte { return nil }
+
+// stxEtxFramer sends the data between stx and etx. The data before stx is
+// discarded. If stx comes again before etx, the frame restarts from it.
+type stxEtxFramer struct {
+	stx, etx []byte
+	max      int
+	buf      []byte
+}
+
+func (f *stxEtxFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	var frames [][]byte
+	for {
+		start := bytes.Index(f.buf, f.stx)
+		if start < 0 {
+			// keep the tail which may be a part of stx
+			if n := len(f.stx) - 1; len(f.buf) > n {
+				f.buf = copyBytes(f.buf[len(f.buf)-n:])
+			}
+			break
+		}
+		f.buf = f.buf[start:]
+		body := f.buf[len(f.stx):]
+		end := bytes.Index(body, f.etx)
+		if restart := bytes.Index(body, f.stx); restart >= 0 && (end < 0 || restart < end) {
+			// etx is lost
+			f.buf = body[restart:]
+			continue
+		}
+		if end < 0 {
+			if len(body) > f.max {
+				log.Warnf("serial frame longer than %d discarded", f.max)
+				f.buf = copyBytes(body[len(body)-len(f.stx)+1:])
+			}
+			break
+		}
+		if end <= f.max {
+			frames = append(frames, copyBytes(body[:end]))
+		}
+		f.buf = body[end+len(f.etx):]
+	}
+	return frames
+}
+
+func (f *stxEtxFramer) Idle() [][]byte { return nil }
+
+// lengthFramer reads the length field at offset in the header, and sends
+// the header, the length field and the data of the length. adjust is
+// added to the length to get the length of the data, ex: -2 if the length
+// includes itself of 2 bytes, or 2 if 2 bytes CRC follows the data.
+type lengthFramer struct {
+	offset int
+	width  int
+	order  binary.ByteOrder
+	adjust int
+	max    int
+	buf    []byte
+}
+
+// newLengthFramer reads length_offset, length_width(1, 2 or 4),
+// length_endian(big or little) and length_adjust.
+func newLengthFramer(values map[string]string, max int) (*lengthFramer, error) {
+	f := &lengthFramer{width: 1, order: binary.BigEndian, max: max}
+	for _, k := range []string{"length_offset", "length_width", "length_adjust"} {
+		v, ok := values[k]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", k, v)
+		}
+		switch k {
+		case "length_offset":
+			f.offset = n
+		case "length_width":
+			f.width = n
+		case "length_adjust":
+			f.adjust = n
+		}
+	}
+	if f.offset < 0 {
+		return nil, fmt.Errorf("invalid length_offset: %d", f.offset)
+	}
+	if f.width != 1 && f.width != 2 && f.width != 4 {
+		return nil, fmt.Errorf("invalid length_width: %d", f.width)
+	}
+	switch strings.ToLower(values["length_endian"]) {
+	case "", "big":
+	case "little":
+		f.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid length_endian: %s", values["length_endian"])
+	}
+	return f, nil
+}
+
+func (f *lengthFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	header := f.offset + f.width
+	var frames [][]byte
+	for len(f.buf) >= header {
+		field := f.buf[f.offset:header]
+		var length int
+		switch f.width {
+		case 1:
+			length = int(field[0])
+		case 2:
+			length = int(f.order.Uint16(field))
+		case 4:
+			length = int(f.order.Uint32(field))
+		}
+		total := header + length + f.adjust
+		if total <= header || total > f.max {
+			// not a header, try from the next byte
+			f.buf = f.buf[1:]
+			continue
+		}
+		if len(f.buf) < total {
+			break
+		}
+		frames = append(frames, copyBytes(f.buf[:total]))
+		f.buf = f.buf[total:]
+	}
+	return frames
+}
+
+// Idle discards the incomplete frame, since the rest never comes.
+func (f *lengthFramer) Idle() [][]byte {
+	f.buf = nil
+	return nil
+}
+
+// SLIP special characters
+const (
+	slipEnd    = 0xc0
+	slipEsc    = 0xdb
+	slipEscEnd = 0xdc
+	slipEscEsc = 0xdd
+)
+
+// slipFramer decodes SLIP frames. Empty frames and frames which have an
+// invalid escape are dropped.
+type slipFramer struct {
+	max int
+	buf []byte
+}
+
+func (f *slipFramer) Push(data []byte) [][]byte {
+	var frames [][]byte
+	for _, c := range data {
+		if c != slipEnd {
+			f.buf = append(f.buf, c)
+			continue
+		}
+		frame, err := slipDecode(f.buf)
+		f.buf = f.buf[:0]
+		if err != nil {
+			log.Warnf("serial frame discarded, %v", err)
+			continue
+		}
+		if len(frame) > 0 && len(frame) <= f.max {
+			frames = append(frames, frame)
+		}
+	}
+	if len(f.buf) > 2*f.max {
+		// an escaped frame may be twice as long
+		log.Warnf("serial frame longer than %d discarded", f.max)
+		f.buf = f.buf[:0]
+	}
+	return frames
+}
+
+func (f *slipFramer) Idle() [][]byte { return nil }
+
+func slipDecode(buf []byte) ([]byte, error) {
+	ret := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); i++ {
+		if buf[i] != slipEsc {
+			ret = append(ret, buf[i])
+			continue
+		}
+		if i+1 >= len(buf) {
+			return nil, fmt.Errorf("slip, invalid escape")
+		}
+		i++
+		switch buf[i] {
+		case slipEscEnd:
+			ret = append(ret, slipEnd)
+		case slipEscEsc:
+			ret = append(ret, slipEsc)
+		default:
+			return nil, fmt.Errorf("slip, invalid escape")
+		}
+	}
+	return ret, nil
+}
+
+// cobsFramer decodes COBS frames terminated by 0. Frames which can not be
+// decoded are dropped.
+type cobsFramer struct {
+	max int
+	buf []byte
+}
+
+func (f *cobsFramer) Push(data []byte) [][]byte {
+	var frames [][]byte
+	for _, c := range data {
+		if c != 0 {
+			f.buf = append(f.buf, c)
+			continue
+		}
+		if len(f.buf) == 0 {
+			continue
+		}
+		frame, err := cobsDecode(f.buf)
+		f.buf = f.buf[:0]
+		if err != nil {
+			log.Warnf("serial frame discarded, %v", err)
+			continue
+		}
+		if len(frame) > 0 && len(frame) <= f.max {
+			frames = append(frames, frame)
+		}
+	}
+	// COBS adds 1 byte every 254 bytes
+	if len(f.buf) > f.max+f.max/254+1 {
+		log.Warnf("serial frame longer than %d discarded", f.max)
+		f.buf = f.buf[:0]
+	}
+	return frames
+}
+
+func (f *cobsFramer) Idle() [][]byte { return nil }
+
+func cobsDecode(buf []byte) ([]byte, error) {
+	ret := make([]byte, 0, len(buf))
+	for i := 0; i < len(buf); {
+		code := int(buf[i])
+		if code == 0 || i+code > len(buf) {
+			return nil, fmt.Errorf("cobs, invalid code")
+		}
+		ret = append(ret, buf[i+1:i+code]...)
+		i += code
+		if code < 0xff && i < len(buf) {
+			ret = append(ret, 0)
+		}
+	}
+	return ret, nil
+}
+
+// regexFramer sends the matches of re. If re has a group, the first group
+// is sent. The data before the match is discarded. A match which reaches
+// the end of the data is sent when the data stops, since more data may
+// match too.
+type regexFramer struct {
+	re  *regexp.Regexp
+	max int
+	buf []byte
+}
+
+func (f *regexFramer) Push(data []byte) [][]byte {
+	f.buf = append(f.buf, data...)
+	frames := f.match(false)
+	if len(f.buf) > f.max {
+		log.Warnf("serial frame longer than %d discarded", f.max)
+		f.buf = copyBytes(f.buf[len(f.buf)-f.max:])
+	}
+	return frames
+}
+
+func (f *regexFramer) Idle() [][]byte {
+	frames := f.match(true)
+	f.buf = nil
+	return frames
+}
+
+func (f *regexFramer) match(idle bool) [][]byte {
+	var frames [][]byte
+	for {
+		loc := f.re.FindSubmatchIndex(f.buf)
+		if loc == nil || loc[1] == 0 {
+			break
+		}
+		if loc[1] == len(f.buf) && !idle {
+			break
+		}
+		frame := f.buf[loc[0]:loc[1]]
+		if len(loc) >= 4 && loc[2] >= 0 {
+			frame = f.buf[loc[2]:loc[3]]
+		}
+		if len(frame) > 0 && len(frame) <= f.max {
+			frames = append(frames, copyBytes(frame))
+		}
+		f.buf = f.buf[loc[1]:]
+	}
+	return frames
+}
+
+func copyBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFramer(t *testing.T, values map[string]string) Framer {
+	f, err := NewFramer(values, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// push pushes the chunks and returns the frames as strings.
+func push(f Framer, chunks ...string) []string {
+	var ret []string
+	for _, c := range chunks {
+		if c == "" {
+			for _, frame := range f.Idle() {
+				ret = append(ret, string(frame))
+			}
+			continue
+		}
+		for _, frame := range f.Push([]byte(c)) {
+			ret = append(ret, string(frame))
+		}
+	}
+	return ret
+}
+
+func TestNewFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := NewFramer(map[string]string{}, 4)
+	assert.Nil(err)
+	assert.IsType(&sizeFramer{}, f)
+	f, err = NewFramer(map[string]string{}, 0)
+	assert.Nil(err)
+	assert.IsType(&timeoutFramer{}, f)
+
+	for _, values := range []map[string]string{
+		{"framing": "unknown"},
+		{"framing": "size"},
+		{"framing": "delimiter", "max_frame": "0"},
+		{"framing": "delimiter", "delimiter": ""},
+		{"framing": "delimiter", "delimiter": `\x0`},
+		{"framing": "delimiter", "delimiter": `\q`},
+		{"framing": "length_prefix", "length_width": "3"},
+		{"framing": "length_prefix", "length_endian": "middle"},
+		{"framing": "length_prefix", "length_offset": "-1"},
+		{"framing": "regex"},
+		{"framing": "regex", "frame_regex": "("},
+	} {
+		_, err := NewFramer(values, 0)
+		assert.NotNil(err, "%v", values)
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := parseBytes(map[string]string{"delimiter": `\r\n`}, "delimiter", "")
+	assert.Nil(err)
+	assert.Equal([]byte("\r\n"), b)
+	b, err = parseBytes(map[string]string{"delimiter": `;\x00\t\\`}, "delimiter", "")
+	assert.Nil(err)
+	assert.Equal([]byte(";\x00\t\\"), b)
+	b, err = parseBytes(map[string]string{}, "stx", `\x02`)
+	assert.Nil(err)
+	assert.Equal([]byte{2}, b)
+}
+
+func TestSizeFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := NewFramer(map[string]string{}, 3)
+	assert.Nil(err)
+	assert.Equal([]string{"abc", "def"}, push(f, "ab", "cdefg", ""))
+	assert.Equal([]string{"ghi"}, push(f, "hi"))
+}
+
+func TestTimeoutFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"max_frame": "4"})
+	assert.Equal([]string{"abc"}, push(f, "ab", "c", ""))
+	assert.Nil(push(f, ""))
+	assert.Equal([]string{"abcd", "ef"}, push(f, "abcdef", ""))
+}
+
+func TestDelimiterFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"framing": "delimiter", "delimiter": `\r\n`, "max_frame": "5"})
+	assert.Equal([]string{"20.5", "21"}, push(f, "20.", "5\r", "\n21\r\n\r\n", ""))
+	// too long frame is discarded until the next delimiter
+	assert.Equal([]string{"22"}, push(f, "toolong", "garbage\r", "\n22\r\n"))
+	assert.Equal([]string{"23"}, push(f, "garbage\r\n23\r\n"))
+
+	f = newTestFramer(t, map[string]string{"framing": "delimiter"})
+	assert.Equal([]string{"a", "b"}, push(f, "a\nb\nc"))
+}
+
+func TestSTXETXFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"framing": "stx_etx", "max_frame": "5"})
+	assert.Equal([]string{"abc", "de"}, push(f, "xx\x02abc\x03yy\x02d", "e\x03"))
+	// etx is lost, restart from the next stx
+	assert.Equal([]string{"fg"}, push(f, "\x02lost\x02fg\x03"))
+	// too long
+	assert.Equal([]string{"h"}, push(f, "\x02toolong", "toolong\x03\x02h\x03"))
+
+	f = newTestFramer(t, map[string]string{"framing": "stx_etx", "stx": "<<", "etx": ">>"})
+	assert.Equal([]string{"ab"}, push(f, "<", "<ab>", ">"))
+}
+
+func TestLengthFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	// 1 byte length
+	f := newTestFramer(t, map[string]string{"framing": "length_prefix"})
+	assert.Equal([]string{"\x03abc", "\x01d"}, push(f, "\x03a", "bc\x01d"))
+
+	// header 0xaa, 2 bytes little endian length, 1 byte checksum
+	f = newTestFramer(t, map[string]string{
+		"framing":       "length_prefix",
+		"length_offset": "1",
+		"length_width":  "2",
+		"length_endian": "little",
+		"length_adjust": "1",
+		"max_frame":     "16",
+	})
+	assert.Equal([]string{"\xaa\x02\x00ab\xff"}, push(f, "\xaa\x02\x00ab\xff"))
+	// garbage makes a too long length, skipped byte by byte
+	assert.Equal([]string{"\xaa\x01\x00c\xff"}, push(f, "\xff\xff\xff\xaa\x01\x00c\xff"))
+	// incomplete frame is discarded on idle
+	assert.Nil(push(f, "\xaa\x05\x00ab", ""))
+	assert.Equal([]string{"\xaa\x01\x00d\xff"}, push(f, "\xaa\x01\x00d\xff"))
+
+	f = newTestFramer(t, map[string]string{"framing": "length_prefix", "length_width": "4"})
+	assert.Equal([]string{"\x00\x00\x00\x02ab"}, push(f, "\x00\x00\x00\x02ab"))
+}
+
+func TestSLIPFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"framing": "slip", "max_frame": "4"})
+	assert.Equal([]string{"ab", "\xc0\xdb"}, push(f, "\xc0ab\xc0", "\xdb\xdc\xdb\xdd\xc0"))
+	// invalid escape and too long frames are dropped
+	assert.Equal([]string{"c"}, push(f, "\xdb\x01\xc0toolong\xc0c\xc0"))
+}
+
+func TestCOBSFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"framing": "cobs"})
+	// examples of the COBS paper
+	assert.Equal([]string{"\x00", "\x11\x22\x00\x33", "\x11\x00\x00\x00"},
+		push(f, "\x01\x01\x00", "\x03\x11\x22\x02\x33\x00", "\x02\x11\x01\x01\x01\x00"))
+	// invalid code is dropped
+	assert.Equal([]string{"a"}, push(f, "\x05ab\x00\x02a\x00"))
+
+	data := make([]byte, 254)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	encoded := append(append([]byte{0xff}, data...), 0x01, 0x00)
+	assert.Equal([]string{string(data)}, push(f, string(encoded)))
+}
+
+func TestRegexFramer(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newTestFramer(t, map[string]string{"framing": "regex", "frame_regex": `T=(\d+\.\d)`, "max_frame": "16"})
+	assert.Equal([]string{"20.5"}, push(f, "xxT=20.5", "yyT=2", "1."))
+	// a match at the end is sent when the data stops
+	assert.Equal([]string{"21.0"}, push(f, "0", ""))
+	// too long garbage is discarded
+	assert.Nil(push(f, "garbagegarbagegarbage"))
+	assert.Equal([]string{"22.5"}, push(f, "T=22.5;"))
+}
+
+// chunkReader returns the chunks one by one, and io.EOF for an empty chunk
+// like the read timeout of the serial port.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return 0, io.EOF
+	}
+	c := r.chunks[0]
+	r.chunks = r.chunks[1:]
+	if c == "" {
+		return 0, io.EOF
+	}
+	return copy(p, c), nil
+}
+
+func TestReadSerialPortLoop(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := newTestFramer(t, map[string]string{"framing": "delimiter"})
+	port := &chunkReader{chunks: []string{"a\nb", "", "c\n"}}
+	pipe := make(chan []byte)
+	done := make(chan error)
+	go func() { done <- readSerialPortLoop(ctx, port, f, pipe) }()
+
+	assert.Equal([]byte("a"), <-pipe)
+	assert.Equal([]byte("bc"), <-pipe)
+	cancel()
+	assert.Nil(<-done)
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package device
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// cpuTime returns user and system CPU time of the process.
+func cpuTime(t *testing.T) time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		t.Fatal(err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+func TestDummyDeviceIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 0
+    interval = 1
+    payload = Hello world.
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewDummyDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan message.Message, 10)
+	done := make(chan error)
+	go func() { done <- d.MainLoop(ctx, ch) }()
+
+	before := cpuTime(t)
+	time.Sleep(1500 * time.Millisecond)
+	used := cpuTime(t) - before
+	// a busy loop uses the whole period
+	assert.True(used < 150*time.Millisecond, "cpu time while idle: %v", used)
+
+	// sent by the ticker
+	assert.Equal(1, len(ch))
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Error("MainLoop does not return after cancel")
+	}
+}
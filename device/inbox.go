@@ -0,0 +1,58 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"sync/atomic"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// DefaultInboxSize is the number of messages which an inbox buffers.
+const DefaultInboxSize = 20
+
+// Inbox is the downlink channel of a device. The gateway delivers the
+// subscribed messages to it, and the device reads them from C.
+type Inbox struct {
+	Name string // device name
+	C    chan message.Message
+
+	dropped uint64
+}
+
+// NewInbox returns an inbox which buffers size messages.
+func NewInbox(name string, size int) *Inbox {
+	return &Inbox{
+		Name: name,
+		C:    make(chan message.Message, size),
+	}
+}
+
+// Deliver puts the message to the inbox without blocking. If the inbox
+// is full, the message is dropped and returns false.
+func (in *Inbox) Deliver(msg message.Message) bool {
+	select {
+	case in.C <- msg:
+		return true
+	default:
+		atomic.AddUint64(&in.dropped, 1)
+		return false
+	}
+}
+
+// Dropped returns the number of messages dropped since the inbox is full.
+func (in *Inbox) Dropped() uint64 {
+	return atomic.LoadUint64(&in.dropped)
+}
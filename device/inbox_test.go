@@ -0,0 +1,41 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestInboxDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	in := NewInbox("dora", 2)
+	assert.True(in.Deliver(message.Message{Topic: "a"}))
+	assert.True(in.Deliver(message.Message{Topic: "b"}))
+
+	// full, never blocks
+	assert.False(in.Deliver(message.Message{Topic: "c"}))
+	assert.Equal(uint64(1), in.Dropped())
+
+	assert.Equal("a", (<-in.C).Topic)
+	assert.True(in.Deliver(message.Message{Topic: "d"}))
+	assert.Equal("b", (<-in.C).Topic)
+	assert.Equal("d", (<-in.C).Topic)
+	assert.Equal(uint64(1), in.Dropped())
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultStopTimeout is how long Stop waits for the goroutines of the
+// device to exit.
+const DefaultStopTimeout = 5 * time.Second
+
+// lifecycle runs the goroutines of a device and stops them. Devices are
+// passed by value, so the copies of a device share it by the pointer.
+// A nil lifecycle runs the goroutines without waiting for them.
+type lifecycle struct {
+	name    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cancel context.CancelFunc // nil if not started
+	wg     sync.WaitGroup
+	err    error // first error of the goroutines
+}
+
+func newLifecycle(name string, timeout time.Duration) *lifecycle {
+	return &lifecycle{name: name, timeout: timeout}
+}
+
+// start returns the context of the device, which is canceled by stop
+// or by the parent ctx.
+func (l *lifecycle) start(ctx context.Context) (context.Context, error) {
+	if l == nil {
+		return ctx, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cancel != nil {
+		return nil, fmt.Errorf("device %s already started", l.name)
+	}
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.err = nil
+	return ctx, nil
+}
+
+// run runs f in a goroutine which stop waits for. The error of f is
+// returned by stop.
+func (l *lifecycle) run(f func() error) {
+	if l == nil {
+		go f()
+		return
+	}
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		if err := f(); err != nil {
+			l.mu.Lock()
+			if l.err == nil {
+				l.err = err
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// stop cancels the goroutines and waits until they exit within the
+// timeout. Returns nil if the device is not started.
+func (l *lifecycle) stop() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	cancel := l.cancel
+	l.cancel = nil
+	l.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	done := make(chan bool)
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(l.timeout):
+		return fmt.Errorf("device %s did not stop in %v", l.name, l.timeout)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// checkGoroutines fails if the goroutines do not decrease to before.
+func checkGoroutines(t *testing.T, before int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			n := runtime.Stack(buf, true)
+			t.Errorf("goroutines leaked, %d -> %d\n%s", before, runtime.NumGoroutine(), buf[:n])
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newLifecycle("dora", time.Second)
+	assert.Nil(l.stop()) // not started
+
+	ctx, err := l.start(context.Background())
+	assert.Nil(err)
+	_, err = l.start(context.Background())
+	assert.NotNil(err) // already started
+
+	l.run(func() error {
+		<-ctx.Done()
+		return errors.New("port close failed")
+	})
+	l.run(func() error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.EqualError(l.stop(), "port close failed")
+
+	// start again
+	ctx, err = l.start(context.Background())
+	assert.Nil(err)
+	l.run(func() error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.Nil(l.stop())
+}
+
+func TestLifecycleTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newLifecycle("dora", 10*time.Millisecond)
+	_, err := l.start(context.Background())
+	assert.Nil(err)
+	release := make(chan bool)
+	l.run(func() error {
+		<-release // ignores the context
+		return nil
+	})
+	assert.NotNil(l.stop())
+	close(release)
+}
+
+func TestDummyDeviceStop(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 0
+    interval = 1
+    payload = Hello world.
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewDummyDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+
+	before := runtime.NumGoroutine()
+	ch := make(chan message.Message)
+	for i := 0; i < 2; i++ {
+		// the device can be started again after stopped
+		assert.Nil(d.Start(context.Background(), ch))
+		assert.Nil(d.Stop())
+		checkGoroutines(t, before)
+	}
+	assert.Nil(d.Stop())
+}
+
+func TestStatusStop(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[broker "sango"]
+  host = 192.168.1.20
+  port = 1033
+[status "memory"]
+  virtual_memory = total
+[status]
+  broker = sango
+  interval = 10
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	st, err := NewStatus(conf)
+	assert.Nil(err)
+
+	before := runtime.NumGoroutine()
+	// nobody receives the status
+	ch := make(chan message.Message)
+	assert.Nil(st.Start(context.Background(), ch))
+	assert.Nil(st.Stop())
+	checkGoroutines(t, before)
+}
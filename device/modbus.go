@@ -0,0 +1,518 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// Modbus tables of the points.
+const (
+	TableCoil     = "coil"
+	TableDiscrete = "discrete"
+	TableInput    = "input"
+	TableHolding  = "holding"
+)
+
+// Modbus types of the points.
+const (
+	TypeBool    = "bool"
+	TypeInt16   = "int16"
+	TypeUint16  = "uint16"
+	TypeInt32   = "int32"
+	TypeUint32  = "uint32"
+	TypeFloat32 = "float32"
+)
+
+// Modbus function codes.
+const (
+	fcReadCoils          = 0x01
+	fcReadDiscreteInputs = 0x02
+	fcReadHolding        = 0x03
+	fcReadInput          = 0x04
+	fcWriteCoil          = 0x05
+	fcWriteRegister      = 0x06
+	fcWriteRegisters     = 0x10
+)
+
+// ModbusError is an error of a Modbus request which does not break the
+// connection, ex: exception response or timeout.
+type ModbusError struct {
+	Exception byte // exception code, 0 if not an exception response
+	Reason    string
+}
+
+func (e *ModbusError) Error() string {
+	if e.Exception != 0 {
+		return fmt.Sprintf("modbus exception %d", e.Exception)
+	}
+	return "modbus " + e.Reason
+}
+
+// modbusTransport sends a request PDU and returns the response PDU.
+type modbusTransport interface {
+	Do(pdu []byte) ([]byte, error)
+}
+
+// ModbusPoint is a value on a Modbus device, which is published as a
+// message of its Name type.
+type ModbusPoint struct {
+	Name      string `validate:"max=256,validtopic"`
+	Table     string
+	Address   uint16
+	Type      string
+	BigEndian bool    // word order of 32 bit types, true if the high word comes first
+	Scale     float64 // the value is multiplied by Scale on read, divided on write
+}
+
+// NewModbusPoints reads the points of the device section. A point is
+// point_<name> = table, address[, type][, options]. table is coil,
+// discrete, input or holding. type is bool for coil and discrete, and
+// int16, uint16 (default), int32, uint32 or float32 for the registers.
+// options are scale=<number> and word_order=big (default) or little.
+//
+// example:
+//
+//	point_temp = input, 0, int16, scale=0.1
+//	point_total = holding, 10, uint32, word_order=little
+//	point_run = coil, 0
+func NewModbusPoints(values map[string]string) ([]ModbusPoint, error) {
+	var ret []ModbusPoint
+	for key, v := range values {
+		if !strings.HasPrefix(key, "point_") {
+			continue
+		}
+		p, err := parseModbusPoint(strings.TrimPrefix(key, "point_"), v)
+		if err != nil {
+			return nil, fmt.Errorf("%s, %v", key, err)
+		}
+		ret = append(ret, p)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no point")
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func parseModbusPoint(name, spec string) (ModbusPoint, error) {
+	p := ModbusPoint{Name: name, BigEndian: true, Scale: 1}
+	if name == "" {
+		return p, fmt.Errorf("empty point name")
+	}
+	fields := strings.Split(spec, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) < 2 {
+		return p, fmt.Errorf("table and address are required: %s", spec)
+	}
+
+	p.Table = fields[0]
+	switch p.Table {
+	case TableCoil, TableDiscrete:
+		p.Type = TypeBool
+	case TableInput, TableHolding:
+		p.Type = TypeUint16
+	default:
+		return p, fmt.Errorf("invalid table: %s", p.Table)
+	}
+	addr, err := strconv.ParseUint(fields[1], 0, 16)
+	if err != nil {
+		return p, fmt.Errorf("invalid address: %s", fields[1])
+	}
+	p.Address = uint16(addr)
+
+	for _, f := range fields[2:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) == 1 {
+			p.Type = f
+			continue
+		}
+		switch kv[0] {
+		case "scale":
+			p.Scale, err = strconv.ParseFloat(kv[1], 64)
+			if err != nil || p.Scale == 0 {
+				return p, fmt.Errorf("invalid scale: %s", kv[1])
+			}
+		case "word_order":
+			switch kv[1] {
+			case "big":
+				p.BigEndian = true
+			case "little":
+				p.BigEndian = false
+			default:
+				return p, fmt.Errorf("invalid word_order: %s", kv[1])
+			}
+		default:
+			return p, fmt.Errorf("unknown option: %s", f)
+		}
+	}
+
+	switch p.Type {
+	case TypeBool:
+		if p.Table != TableCoil && p.Table != TableDiscrete {
+			return p, fmt.Errorf("bool is only for coil and discrete")
+		}
+	case TypeInt16, TypeUint16, TypeInt32, TypeUint32, TypeFloat32:
+		if p.Table != TableInput && p.Table != TableHolding {
+			return p, fmt.Errorf("%s is only for input and holding", p.Type)
+		}
+	default:
+		return p, fmt.Errorf("invalid type: %s", p.Type)
+	}
+	return p, nil
+}
+
+// count returns the number of the coils or the registers of the point.
+func (p ModbusPoint) count() uint16 {
+	switch p.Type {
+	case TypeInt32, TypeUint32, TypeFloat32:
+		return 2
+	}
+	return 1
+}
+
+// Writable returns true if the point can be written.
+func (p ModbusPoint) Writable() bool {
+	return p.Table == TableCoil || p.Table == TableHolding
+}
+
+// readRequest returns the request PDU to read the point.
+func (p ModbusPoint) readRequest() []byte {
+	var fc byte
+	switch p.Table {
+	case TableCoil:
+		fc = fcReadCoils
+	case TableDiscrete:
+		fc = fcReadDiscreteInputs
+	case TableInput:
+		fc = fcReadInput
+	case TableHolding:
+		fc = fcReadHolding
+	}
+	pdu := []byte{fc, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], p.Address)
+	binary.BigEndian.PutUint16(pdu[3:], p.count())
+	return pdu
+}
+
+// Read reads the point and returns the value as a decimal string.
+func (p ModbusPoint) Read(t modbusTransport) (string, error) {
+	req := p.readRequest()
+	res, err := t.Do(req)
+	if err != nil {
+		return "", err
+	}
+	size := int(p.count()) * 2
+	if p.Type == TypeBool {
+		size = 1
+	}
+	if len(res) != 2+size || res[0] != req[0] || int(res[1]) != size {
+		return "", &ModbusError{Reason: fmt.Sprintf("invalid response: %x", res)}
+	}
+	return p.decode(res[2:]), nil
+}
+
+// decode returns the value of the data read from the point.
+func (p ModbusPoint) decode(data []byte) string {
+	var v float64
+	switch p.Type {
+	case TypeBool:
+		if data[0]&1 == 1 {
+			return "1"
+		}
+		return "0"
+	case TypeInt16:
+		v = float64(int16(binary.BigEndian.Uint16(data)))
+	case TypeUint16:
+		v = float64(binary.BigEndian.Uint16(data))
+	case TypeInt32:
+		v = float64(int32(p.uint32(data)))
+	case TypeUint32:
+		v = float64(p.uint32(data))
+	case TypeFloat32:
+		f := math.Float32frombits(p.uint32(data))
+		if p.Scale == 1 {
+			return strconv.FormatFloat(float64(f), 'f', -1, 32)
+		}
+		v = float64(f)
+	}
+	return strconv.FormatFloat(v*p.Scale, 'f', -1, 64)
+}
+
+// uint32 joins two registers by the word order.
+func (p ModbusPoint) uint32(data []byte) uint32 {
+	hi, lo := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:])
+	if !p.BigEndian {
+		hi, lo = lo, hi
+	}
+	return uint32(hi)<<16 | uint32(lo)
+}
+
+// writeRequest returns the request PDU to write the value to the point.
+// The value is a number, or true, false, on and off for bool.
+func (p ModbusPoint) writeRequest(value string) ([]byte, error) {
+	if !p.Writable() {
+		return nil, fmt.Errorf("point %s is read only", p.Name)
+	}
+	value = strings.TrimSpace(value)
+	if p.Type == TypeBool {
+		pdu := []byte{fcWriteCoil, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], p.Address)
+		switch strings.ToLower(value) {
+		case "1", "true", "on":
+			pdu[3] = 0xff
+		case "0", "false", "off":
+		default:
+			return nil, fmt.Errorf("invalid value for %s: %s", p.Name, value)
+		}
+		return pdu, nil
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %s", p.Name, value)
+	}
+	f /= p.Scale
+	var bits uint32
+	switch p.Type {
+	case TypeInt16:
+		bits, err = intBits(f, math.MinInt16, math.MaxInt16)
+	case TypeUint16:
+		bits, err = intBits(f, 0, math.MaxUint16)
+	case TypeInt32:
+		bits, err = intBits(f, math.MinInt32, math.MaxInt32)
+	case TypeUint32:
+		bits, err = intBits(f, 0, math.MaxUint32)
+	case TypeFloat32:
+		bits = math.Float32bits(float32(f))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %s, %v", p.Name, value, err)
+	}
+
+	if p.count() == 1 {
+		pdu := []byte{fcWriteRegister, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], p.Address)
+		binary.BigEndian.PutUint16(pdu[3:], uint16(bits))
+		return pdu, nil
+	}
+	hi, lo := uint16(bits>>16), uint16(bits)
+	if !p.BigEndian {
+		hi, lo = lo, hi
+	}
+	pdu := []byte{fcWriteRegisters, 0, 0, 0, 2, 4, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], p.Address)
+	binary.BigEndian.PutUint16(pdu[6:], hi)
+	binary.BigEndian.PutUint16(pdu[8:], lo)
+	return pdu, nil
+}
+
+// intBits rounds f and returns its two's complement bits.
+func intBits(f float64, min, max float64) (uint32, error) {
+	f = math.Floor(f + 0.5)
+	if f < min || f > max {
+		return 0, fmt.Errorf("out of range")
+	}
+	return uint32(int64(f)), nil
+}
+
+// Write writes the value to the point.
+func (p ModbusPoint) Write(t modbusTransport, value string) error {
+	req, err := p.writeRequest(value)
+	if err != nil {
+		return err
+	}
+	return p.write(t, req)
+}
+
+func (p ModbusPoint) write(t modbusTransport, req []byte) error {
+	res, err := t.Do(req)
+	if err != nil {
+		return err
+	}
+	// the response echoes the address and the value, or the quantity
+	if len(res) != 5 || !bytes.Equal(res, req[:5]) {
+		return &ModbusError{Reason: fmt.Sprintf("invalid response: %x", res)}
+	}
+	return nil
+}
+
+// checkException returns the error if the response PDU is an exception.
+func checkException(req, res []byte) error {
+	if len(res) == 0 {
+		return &ModbusError{Reason: "empty response"}
+	}
+	if res[0] == req[0]|0x80 {
+		if len(res) < 2 {
+			return &ModbusError{Reason: "short exception response"}
+		}
+		return &ModbusError{Exception: res[1]}
+	}
+	if res[0] != req[0] {
+		return &ModbusError{Reason: fmt.Sprintf("unexpected function code %d", res[0])}
+	}
+	return nil
+}
+
+// Default settings of the Modbus devices.
+const (
+	DefaultModbusSlaveID  = 1
+	DefaultModbusInterval = time.Second
+	DefaultModbusTimeout  = time.Second
+)
+
+// Modbus is the settings to poll a Modbus device, shared by RTU and TCP.
+type Modbus struct {
+	SlaveID  byte
+	Interval time.Duration // polling interval
+	Timeout  time.Duration // response timeout
+	Points   []ModbusPoint
+}
+
+// NewModbus reads the Modbus settings of the device section. interval
+// is in sec and may have a fraction.
+//
+// example:
+//
+//	slave_id = 1
+//	interval = 0.5
+//	response_timeout_ms = 500
+//	point_temp = input, 0, int16, scale=0.1
+func NewModbus(values map[string]string) (Modbus, error) {
+	ret := Modbus{
+		SlaveID:  DefaultModbusSlaveID,
+		Interval: DefaultModbusInterval,
+		Timeout:  DefaultModbusTimeout,
+	}
+	if v := values["slave_id"]; v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 || id > 247 {
+			return ret, fmt.Errorf("invalid slave_id: %s", v)
+		}
+		ret.SlaveID = byte(id)
+	}
+	if v := values["interval"]; v != "" {
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil || sec <= 0 {
+			return ret, fmt.Errorf("invalid interval: %s", v)
+		}
+		ret.Interval = time.Duration(sec * float64(time.Second))
+	}
+	if v := values["response_timeout_ms"]; v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			return ret, fmt.Errorf("invalid response_timeout_ms: %s", v)
+		}
+		ret.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	var err error
+	ret.Points, err = NewModbusPoints(values)
+	if err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// findPoint returns the point of the name.
+func (m Modbus) findPoint(name string) (ModbusPoint, bool) {
+	for _, p := range m.Points {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ModbusPoint{}, false
+}
+
+// serve polls the points every Interval and publishes each value as a
+// copy of tmpl whose Type is the point name. The subscribed messages
+// from the inbox are written to the point of the last level of their
+// topic. Returns when the transport fails or ctx is canceled. Errors of
+// the requests are logged and do not stop the loop.
+func (m Modbus) serve(ctx context.Context, channel chan message.Message, t modbusTransport, tmpl message.Message, inbox *Inbox, match func(message.Message) bool) error {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, p := range m.Points {
+			if ctx.Err() != nil {
+				return nil
+			}
+			value, err := p.Read(t)
+			if err != nil {
+				if _, ok := err.(*ModbusError); !ok {
+					return err
+				}
+				log.Warnf("device %s: point %s read failed, %v", tmpl.Sender, p.Name, err)
+				continue
+			}
+			msg := tmpl
+			msg.Type = p.Name
+			msg.Body = []byte(value)
+			msg.Timestamp = time.Now()
+			select {
+			case channel <- msg:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+	WAIT:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				break WAIT
+			case msg := <-inbox.C:
+				if !match(msg) {
+					continue
+				}
+				name := msg.Topic[strings.LastIndex(msg.Topic, "/")+1:]
+				p, ok := m.findPoint(name)
+				if !ok {
+					log.Warnf("device %s: unknown point, %s", tmpl.Sender, msg.Topic)
+					continue
+				}
+				req, err := p.writeRequest(string(msg.Body))
+				if err != nil {
+					log.Warnf("device %s: %v", tmpl.Sender, err)
+					continue
+				}
+				if err := p.write(t, req); err != nil {
+					if _, ok := err.(*ModbusError); !ok {
+						return err
+					}
+					log.Warnf("device %s: point %s write failed, %v", tmpl.Sender, p.Name, err)
+					continue
+				}
+				log.Infof("device %s: point %s written, %s", tmpl.Sender, p.Name, msg.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// ModbusRTUDevice polls a Modbus RTU slave on the serial port, and
+// publishes each point as a message.
+type ModbusRTUDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte `validate:"min=0,max=2"`
+	SerialPort
+	Modbus
+	Retain       bool
+	Subscribe    bool
+	Subscription Subscription          // topic filters routed to the device
+	Topic        message.TopicTemplate // overrides the topic template of the broker
+	Properties   Properties
+	Downlink     *Inbox // GW -> device
+
+	life *lifecycle
+}
+
+func (device ModbusRTUDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// NewModbusRTUDevice reads inidef.ConfigSection and returns
+// ModbusRTUDevice. The serial port is set by the same keys as the serial
+// device, and the points by NewModbus.
+func NewModbusRTUDevice(section inidef.ConfigSection, brokers []*broker.Broker) (ModbusRTUDevice, error) {
+	ret := ModbusRTUDevice{
+		Name:     section.Name,
+		Downlink: NewInbox(section.Name, DefaultInboxSize),
+	}
+	values := section.Values
+	bname, ok := section.Values["broker"]
+	if !ok {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == bname {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", bname)
+	}
+	ret.BrokerName = bname
+
+	qos, err := strconv.Atoi(values["qos"])
+	if err != nil {
+		return ret, fmt.Errorf("qos parse failed, %v", err)
+	}
+	ret.QoS = byte(qos)
+
+	ret.SerialPort, err = NewSerialPort(values)
+	if err != nil {
+		return ret, err
+	}
+	ret.Modbus, err = NewModbus(values)
+	if err != nil {
+		return ret, err
+	}
+	// a request blocks for Timeout at most
+	ret.life = newLifecycle(ret.Name, DefaultStopTimeout+ret.Timeout+ret.ReadTimeout)
+
+	ret.Retain = false
+	if values["retain"] == "true" {
+		ret.Retain = true
+	}
+
+	ret.Subscription, err = NewSubscription(values, ret.Name, bname, ret.QoS, brokers)
+	if err != nil {
+		return ret, err
+	}
+	ret.Subscribe = ret.Subscription.Enabled()
+
+	ret.Topic, err = message.ParseTopicTemplate(values["topic"])
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Properties, err = NewProperties(values)
+	if err != nil {
+		return ret, err
+	}
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+func (device *ModbusRTUDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Start starts to poll the slave until Stop is called or ctx is canceled.
+// The serial port is opened again if it fails.
+func (device ModbusRTUDevice) Start(ctx context.Context, channel chan message.Message) error {
+	ctx, err := device.life.start(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("start modbus rtu device")
+
+	tmpl := message.Message{
+		Sender:        device.Name,
+		SenderType:    device.DeviceType(),
+		QoS:           device.QoS,
+		Retained:      device.Retain,
+		BrokerName:    device.BrokerName,
+		TopicTemplate: device.Topic,
+	}
+	device.Properties.Set(&tmpl)
+	k := portKeeper{
+		Name:       device.Name,
+		Type:       device.DeviceType(),
+		BrokerName: device.BrokerName,
+		QoS:        device.QoS,
+		Reopen:     device.Reopen,
+		Open:       device.openPort,
+		Serve: func(port io.ReadWriteCloser) error {
+			t := &rtuTransport{
+				port:    port,
+				slaveID: device.SlaveID,
+				timeout: device.Timeout,
+				gap:     rtuFrameGap(device.Baud),
+			}
+			return device.serve(ctx, channel, t, tmpl, device.Downlink, device.Match)
+		},
+	}
+	device.life.run(func() error {
+		return k.run(ctx, channel)
+	})
+	return nil
+}
+
+// Stop stops polling, closes the serial port and waits until the
+// goroutine exits.
+func (device ModbusRTUDevice) Stop() error {
+	log.Infof("closing modbus rtu device: %v", device.Name)
+	return device.life.stop()
+}
+
+func (device ModbusRTUDevice) DeviceType() string {
+	return "modbus_rtu"
+}
+
+// DeviceName returns the name of the device.
+func (device ModbusRTUDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device ModbusRTUDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	device.Subscription.AddTo(device.Broker)
+	return nil
+}
+
+// Inbox returns the downlink channel of the device.
+func (device ModbusRTUDevice) Inbox() *Inbox {
+	return device.Downlink
+}
+
+// Match returns true if the device subscribes the message.
+func (device ModbusRTUDevice) Match(msg message.Message) bool {
+	return device.Subscription.Match(msg)
+}
+
+// rtuTransport sends the requests in RTU frames, which are the slave id,
+// PDU and CRC.
+type rtuTransport struct {
+	port    io.ReadWriter
+	slaveID byte
+	timeout time.Duration
+	gap     time.Duration // silence between frames
+
+	last  time.Time // when the last frame ended
+	dirty bool      // a late or broken response may be left in the port
+}
+
+// rtuFrameGap returns the silence of 3.5 characters between frames. It is
+// fixed to 1.75ms above 19200 baud.
+func rtuFrameGap(baud int) time.Duration {
+	if baud <= 0 || baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// 11 bits per character
+	return time.Duration(3.5 * 11 * float64(time.Second) / float64(baud))
+}
+
+func (t *rtuTransport) Do(pdu []byte) ([]byte, error) {
+	if t.dirty {
+		if err := t.drain(); err != nil {
+			return nil, err
+		}
+	}
+	if d := t.gap - time.Since(t.last); d > 0 {
+		time.Sleep(d)
+	}
+
+	frame := append([]byte{t.slaveID}, pdu...)
+	if _, err := t.port.Write(appendCRC(frame)); err != nil {
+		return nil, err
+	}
+	res, err := readRTUFrame(t.port, t.timeout)
+	t.last = time.Now()
+	if err != nil {
+		if _, ok := err.(*ModbusError); ok {
+			// the response may come after the timeout
+			t.dirty = true
+		}
+		return nil, err
+	}
+	if res[0] != t.slaveID {
+		return nil, &ModbusError{Reason: fmt.Sprintf("response from slave %d", res[0])}
+	}
+	res = res[1 : len(res)-2]
+	if err := checkException(pdu, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// drain discards the input until the port is silent for a read timeout,
+// so that a late response is not taken as the response of the next
+// request.
+func (t *rtuTransport) drain() error {
+	deadline := time.Now().Add(t.timeout)
+	buf := make([]byte, 256)
+	for {
+		n, err := t.port.Read(buf)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		log.Debugf("modbus rtu: discard %x", buf[:n])
+		if time.Now().After(deadline) {
+			return &ModbusError{Reason: "line is not silent"}
+		}
+	}
+	t.dirty = false
+	t.last = time.Now()
+	return nil
+}
+
+// readRTUFrame reads a frame within the timeout and checks its CRC. The
+// length of the frame is known from the function code.
+func readRTUFrame(r io.Reader, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	var buf []byte
+	readBuf := make([]byte, 256)
+	for {
+		n := rtuFrameLen(buf)
+		if n < 0 {
+			return nil, &ModbusError{Reason: fmt.Sprintf("invalid frame: %x", buf)}
+		}
+		if n > 0 && len(buf) >= n {
+			buf = buf[:n]
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, &ModbusError{Reason: "timeout"}
+		}
+		num, err := r.Read(readBuf)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = append(buf, readBuf[:num]...)
+	}
+	crc := crc16(buf[:len(buf)-2])
+	if buf[len(buf)-2] != byte(crc) || buf[len(buf)-1] != byte(crc>>8) {
+		return nil, &ModbusError{Reason: "crc error"}
+	}
+	return buf, nil
+}
+
+// rtuFrameLen returns the length of the frame, 0 if it is not known yet,
+// or -1 if the function code is not supported.
+func rtuFrameLen(buf []byte) int {
+	if len(buf) < 2 {
+		return 0
+	}
+	fc := buf[1]
+	if fc&0x80 != 0 {
+		return 5 // exception
+	}
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHolding, fcReadInput:
+		if len(buf) < 3 {
+			return 0
+		}
+		return 5 + int(buf[2])
+	case fcWriteCoil, fcWriteRegister, fcWriteRegisters:
+		return 8
+	}
+	return -1
+}
+
+// crc16 returns CRC-16/MODBUS of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// appendCRC appends CRC of the frame in little endian.
+func appendCRC(frame []byte) []byte {
+	crc := crc16(frame)
+	return append(frame, byte(crc), byte(crc>>8))
+}
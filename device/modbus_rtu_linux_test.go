@@ -0,0 +1,205 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// serveRTU answers the RTU requests on the master of the pty as the
+// slave, until the master is closed. The first response is delayed by
+// late.
+func serveRTU(master *os.File, slaveID byte, s *testSlave, late time.Duration) {
+	for {
+		frame, err := readRTURequest(master)
+		if err != nil {
+			return
+		}
+		if frame[0] != slaveID {
+			continue
+		}
+		time.Sleep(late)
+		late = 0
+		res := append([]byte{slaveID}, s.handle(frame[1:len(frame)-2])...)
+		if _, err := master.Write(appendCRC(res)); err != nil {
+			return
+		}
+	}
+}
+
+// readRTURequest reads a request frame. The length of the requests of
+// fuji is 8 except write multiple registers.
+func readRTURequest(master *os.File) ([]byte, error) {
+	buf := make([]byte, 8)
+	if _, err := readFull(master, buf); err != nil {
+		return nil, err
+	}
+	if buf[1] == fcWriteRegisters {
+		rest := make([]byte, int(buf[6])+1)
+		if _, err := readFull(master, rest); err != nil {
+			return nil, err
+		}
+		buf = append(buf, rest...)
+	}
+	return buf, nil
+}
+
+func readFull(f *os.File, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := f.Read(buf[n:])
+		if err != nil {
+			return n, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+func TestModbusRTUDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	master, slave := openPty(t)
+	defer master.Close()
+	s := newTestSlave()
+	go serveRTU(master, 3, s, 0)
+
+	iniStr := `
+[device "plc1/modbus_rtu"]
+    broker = sango
+    qos = 0
+    serial = ` + slave + `
+    baud = 19200
+    parity = even
+    slave_id = 3
+    interval = 0.1
+    response_timeout_ms = 500
+    subscribe_topic = {device}/set/+
+    point_temp = input, 0, int16, scale=0.1
+    point_total = holding, 10, uint32
+    point_run = coil, 0
+    point_missing = holding, 100
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal("modbus_rtu", d.DeviceType())
+
+	before := runtime.NumGoroutine()
+	ch := make(chan message.Message, 10)
+	assert.Nil(d.Start(context.Background(), ch))
+
+	receive := func() message.Message {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message from the device")
+		}
+		return message.Message{}
+	}
+	assert.Equal(EventOnline, string(receive().Body))
+
+	// each point is a message, the missing point is skipped
+	values := map[string]string{}
+	for i := 0; i < 3; i++ {
+		msg := receive()
+		assert.Equal("plc1", msg.Sender)
+		values[msg.Type] = string(msg.Body)
+	}
+	assert.Equal(map[string]string{"run": "1", "temp": "-20", "total": "65538"}, values)
+
+	// write by the subscribed message
+	assert.True(d.Inbox().Deliver(message.Message{
+		Type:   message.TypeSubscribed,
+		Sender: "sango",
+		Topic:  "plc1/set/total",
+		Body:   []byte("70000"),
+	}))
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if msg := receive(); msg.Type == "total" && string(msg.Body) == "70000" {
+			break
+		}
+	}
+	assert.Equal(uint16(0x0001), s.holding(10))
+	assert.Equal(uint16(0x1170), s.holding(11))
+
+	assert.Nil(d.Stop())
+	checkGoroutines(t, before)
+}
+
+func TestModbusRTUDeviceLateResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	master, slave := openPty(t)
+	defer master.Close()
+	// the first response comes after the response timeout
+	go serveRTU(master, 1, newTestSlave(), 300*time.Millisecond)
+
+	iniStr := `
+[device "plc1/modbus_rtu"]
+    broker = sango
+    qos = 0
+    serial = ` + slave + `
+    baud = 19200
+    interval = 0.05
+    response_timeout_ms = 200
+    read_timeout_ms = 100
+    point_a = holding, 10
+    point_b = holding, 11
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewModbusRTUDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+
+	ch := make(chan message.Message, 10)
+	assert.Nil(d.Start(context.Background(), ch))
+	defer d.Stop()
+
+	// the late response of a is never published as b
+	expected := map[string]string{"a": "1", "b": "2"}
+	received := map[string]int{}
+	for deadline := time.After(3 * time.Second); received["a"] < 2 || received["b"] < 2; {
+		select {
+		case msg := <-ch:
+			if msg.Type == message.TypeEvent {
+				continue
+			}
+			assert.Equal(expected[msg.Type], string(msg.Body), msg.Type)
+			received[msg.Type]++
+		case <-deadline:
+			t.Fatalf("points are not published, %v", received)
+		}
+	}
+}
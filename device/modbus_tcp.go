@@ -0,0 +1,287 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	validator "gopkg.in/validator.v2"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// DefaultModbusTCPPort is the port of Modbus TCP.
+const DefaultModbusTCPPort = 502
+
+// ModbusTCPDevice polls a Modbus TCP slave, and publishes each point as
+// a message.
+type ModbusTCPDevice struct {
+	Name       string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Broker     []*broker.Broker
+	BrokerName string
+	QoS        byte           `validate:"min=0,max=2"`
+	Host       string         `validate:"nonzero,max=256"`
+	Port       int            `validate:"min=1,max=65535"`
+	Reopen     broker.Backoff // delay before reconnecting
+	Modbus
+	Retain       bool
+	Subscribe    bool
+	Subscription Subscription          // topic filters routed to the device
+	Topic        message.TopicTemplate // overrides the topic template of the broker
+	Properties   Properties
+	Downlink     *Inbox // GW -> device
+
+	life *lifecycle
+}
+
+func (device ModbusTCPDevice) String() string {
+	return fmt.Sprintf("%#v", device)
+}
+
+// NewModbusTCPDevice reads inidef.ConfigSection and returns
+// ModbusTCPDevice. unit_id is the slave address, which is used for the
+// slaves behind a gateway. The points are set by NewModbus.
+//
+// example:
+//
+//	host = 192.168.1.50
+//	port = 502
+//	unit_id = 1
+func NewModbusTCPDevice(section inidef.ConfigSection, brokers []*broker.Broker) (ModbusTCPDevice, error) {
+	ret := ModbusTCPDevice{
+		Name:     section.Name,
+		Downlink: NewInbox(section.Name, DefaultInboxSize),
+		Port:     DefaultModbusTCPPort,
+	}
+	values := section.Values
+	bname, ok := section.Values["broker"]
+	if !ok {
+		return ret, fmt.Errorf("broker does not set")
+	}
+
+	for _, b := range brokers {
+		if b.Name == bname {
+			ret.Broker = brokers
+		}
+	}
+	if ret.Broker == nil {
+		return ret, fmt.Errorf("broker does not exists: %s", bname)
+	}
+	ret.BrokerName = bname
+
+	qos, err := strconv.Atoi(values["qos"])
+	if err != nil {
+		return ret, fmt.Errorf("qos parse failed, %v", err)
+	}
+	ret.QoS = byte(qos)
+
+	ret.Host = values["host"]
+	if v := values["port"]; v != "" {
+		ret.Port, err = strconv.Atoi(v)
+		if err != nil {
+			return ret, fmt.Errorf("port parse failed, %v", err)
+		}
+	}
+	ret.Reopen, err = newReopenBackoff(values)
+	if err != nil {
+		return ret, err
+	}
+	ret.Modbus, err = NewModbus(values)
+	if err != nil {
+		return ret, err
+	}
+	if v := values["unit_id"]; v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 || id > 255 {
+			return ret, fmt.Errorf("invalid unit_id: %s", v)
+		}
+		ret.SlaveID = byte(id)
+	}
+	// a request blocks for Timeout at most
+	ret.life = newLifecycle(ret.Name, DefaultStopTimeout+ret.Timeout)
+
+	ret.Retain = false
+	if values["retain"] == "true" {
+		ret.Retain = true
+	}
+
+	ret.Subscription, err = NewSubscription(values, ret.Name, bname, ret.QoS, brokers)
+	if err != nil {
+		return ret, err
+	}
+	ret.Subscribe = ret.Subscription.Enabled()
+
+	ret.Topic, err = message.ParseTopicTemplate(values["topic"])
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Properties, err = NewProperties(values)
+	if err != nil {
+		return ret, err
+	}
+
+	if err := ret.Validate(); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+func (device *ModbusTCPDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Start starts to poll the slave until Stop is called or ctx is canceled.
+// If the connection fails, the device publishes the offline event and
+// connects again with backoff.
+func (device ModbusTCPDevice) Start(ctx context.Context, channel chan message.Message) error {
+	ctx, err := device.life.start(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("start modbus tcp device")
+
+	tmpl := message.Message{
+		Sender:        device.Name,
+		SenderType:    device.DeviceType(),
+		QoS:           device.QoS,
+		Retained:      device.Retain,
+		BrokerName:    device.BrokerName,
+		TopicTemplate: device.Topic,
+	}
+	device.Properties.Set(&tmpl)
+	addr := net.JoinHostPort(device.Host, strconv.Itoa(device.Port))
+	k := portKeeper{
+		Name:       device.Name,
+		Type:       device.DeviceType(),
+		BrokerName: device.BrokerName,
+		QoS:        device.QoS,
+		Reopen:     device.Reopen,
+		Open: func() (io.ReadWriteCloser, error) {
+			d := net.Dialer{Timeout: device.Timeout}
+			return d.DialContext(ctx, "tcp", addr)
+		},
+		Serve: func(conn io.ReadWriteCloser) error {
+			t := &tcpTransport{conn: conn.(net.Conn), unitID: device.SlaveID, timeout: device.Timeout}
+			return device.serve(ctx, channel, t, tmpl, device.Downlink, device.Match)
+		},
+	}
+	device.life.run(func() error {
+		return k.run(ctx, channel)
+	})
+	return nil
+}
+
+// Stop stops polling, closes the connection and waits until the
+// goroutine exits.
+func (device ModbusTCPDevice) Stop() error {
+	log.Infof("closing modbus tcp device: %v", device.Name)
+	return device.life.stop()
+}
+
+func (device ModbusTCPDevice) DeviceType() string {
+	return "modbus_tcp"
+}
+
+// DeviceName returns the name of the device.
+func (device ModbusTCPDevice) DeviceName() string {
+	return device.Name
+}
+
+func (device ModbusTCPDevice) AddSubscribe() error {
+	if !device.Subscribe {
+		return nil
+	}
+	device.Subscription.AddTo(device.Broker)
+	return nil
+}
+
+// Inbox returns the downlink channel of the device.
+func (device ModbusTCPDevice) Inbox() *Inbox {
+	return device.Downlink
+}
+
+// Match returns true if the device subscribes the message.
+func (device ModbusTCPDevice) Match(msg message.Message) bool {
+	return device.Subscription.Match(msg)
+}
+
+// tcpTransport sends the requests with the MBAP header, which is the
+// transaction id, the protocol id 0, the length and the unit id.
+type tcpTransport struct {
+	conn    net.Conn
+	unitID  byte
+	timeout time.Duration
+	tid     uint16
+}
+
+func (t *tcpTransport) Do(pdu []byte) ([]byte, error) {
+	t.tid++
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], t.tid)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = t.unitID
+	frame = append(frame, pdu...)
+
+	if err := t.conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := t.conn.Write(frame); err != nil {
+		return nil, err
+	}
+	for {
+		header := make([]byte, 7)
+		n, err := io.ReadFull(t.conn, header)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 {
+				// nothing is read, so the connection is still in sync
+				return nil, &ModbusError{Reason: "timeout"}
+			}
+			return nil, err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			return nil, fmt.Errorf("invalid modbus tcp header: %x", header)
+		}
+		res := make([]byte, length-1)
+		if _, err := io.ReadFull(t.conn, res); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint16(header[0:]) != t.tid {
+			continue // response of the request timed out before
+		}
+		if header[6] != t.unitID {
+			return nil, &ModbusError{Reason: fmt.Sprintf("response from unit %d", header[6])}
+		}
+		if err := checkException(pdu, res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+}
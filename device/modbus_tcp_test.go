@@ -0,0 +1,274 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// testServer is an in-process Modbus TCP server of a testSlave.
+type testServer struct {
+	l      net.Listener
+	slave  *testSlave
+	unitID byte
+	silent bool // does not respond
+
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+}
+
+func newTestServer(t *testing.T, addr string, s *testSlave) *testServer {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{l: l, slave: s, unitID: 1}
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			srv.wg.Add(1)
+			go func() {
+				defer srv.wg.Done()
+				srv.serve(conn)
+			}()
+		}
+	}()
+	return srv
+}
+
+func (srv *testServer) serve(conn net.Conn) {
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		if srv.silent || header[6] != srv.unitID {
+			continue
+		}
+		res := srv.slave.handle(req)
+		binary.BigEndian.PutUint16(header[4:], uint16(len(res)+1))
+		if _, err := conn.Write(append(header, res...)); err != nil {
+			return
+		}
+	}
+}
+
+func (srv *testServer) Addr() string {
+	return srv.l.Addr().String()
+}
+
+// Close stops the server and closes the connections.
+func (srv *testServer) Close() {
+	srv.l.Close()
+	srv.mu.Lock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+}
+
+func TestNewModbusTCPDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "plc2/modbus_tcp"]
+    broker = sango
+    qos = 0
+    point_run = coil, 0
+`
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+
+	conf, err := inidef.LoadConfigByte([]byte(iniStr + "    host = 192.168.1.50\n"))
+	assert.Nil(err)
+	d, err := NewModbusTCPDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal("192.168.1.50", d.Host)
+	assert.Equal(DefaultModbusTCPPort, d.Port)
+	assert.Equal(byte(1), d.SlaveID)
+	assert.Equal(DefaultReopenInterval, d.Reopen.Initial)
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + `
+    host = plc2.local
+    port = 5020
+    unit_id = 255
+`))
+	d, err = NewModbusTCPDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(5020, d.Port)
+	assert.Equal(byte(255), d.SlaveID)
+
+	for _, v := range []string{
+		"port = 5020", // no host
+		"host = a\n    port = 0",
+		"host = a\n    unit_id = 256",
+		"host = a\n    reopen_interval = x",
+	} {
+		conf, err = inidef.LoadConfigByte([]byte(iniStr + "    " + v + "\n"))
+		_, err = NewModbusTCPDevice(conf.Sections[1], brokers)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	srv := newTestServer(t, "127.0.0.1:0", newTestSlave())
+	defer srv.Close()
+	conn, err := net.Dial("tcp", srv.Addr())
+	assert.Nil(err)
+	defer conn.Close()
+
+	tr := &tcpTransport{conn: conn, unitID: 1, timeout: 100 * time.Millisecond}
+	p, err := parseModbusPoint("x", "input, 0, int16")
+	assert.Nil(err)
+	v, err := p.Read(tr)
+	assert.Nil(err)
+	assert.Equal("-200", v)
+
+	// exception
+	p, err = parseModbusPoint("x", "input, 100")
+	assert.Nil(err)
+	_, err = p.Read(tr)
+	assert.Equal(&ModbusError{Exception: 2}, err)
+
+	// no response from the unit
+	tr.unitID = 2
+	_, err = p.Read(tr)
+	assert.Equal(&ModbusError{Reason: "timeout"}, err)
+}
+
+func TestModbusTCPDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	// reserve a port, nothing listens on it until the server starts
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	iniStr := `
+[device "plc2/modbus_tcp"]
+    broker = sango
+    qos = 0
+    host = 127.0.0.1
+    port = ` + strconv.Itoa(addr.Port) + `
+    unit_id = 1
+    interval = 0.1
+    response_timeout_ms = 500
+    reopen_interval = 1
+    subscribe_topic = {device}/set/+
+    point_temp = input, 0, int16, scale=0.1
+    point_run = coil, 0
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal("modbus_tcp", d.DeviceType())
+
+	before := runtime.NumGoroutine()
+	ch := make(chan message.Message, 10)
+	assert.Nil(d.Start(context.Background(), ch))
+
+	receive := func() message.Message {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(3 * time.Second):
+			t.Fatal("no message from the device")
+		}
+		return message.Message{}
+	}
+	receiveValues := func() map[string]string {
+		values := map[string]string{}
+		for len(values) < 2 {
+			msg := receive()
+			assert.NotEqual(message.TypeEvent, msg.Type)
+			values[msg.Type] = string(msg.Body)
+		}
+		return values
+	}
+
+	// the connect error is an event
+	msg := receive()
+	assert.Equal(message.TypeEvent, msg.Type)
+	assert.Equal(EventOffline, string(msg.Body))
+
+	s := newTestSlave()
+	srv := newTestServer(t, addr.String(), s)
+	assert.Equal(EventOnline, string(receive().Body))
+	assert.Equal(map[string]string{"run": "1", "temp": "-20"}, receiveValues())
+
+	// write by the subscribed message
+	assert.True(d.Inbox().Deliver(message.Message{
+		Type:   message.TypeSubscribed,
+		Sender: "sango",
+		Topic:  "plc2/set/run",
+		Body:   []byte("off"),
+	}))
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if msg := receive(); msg.Type == "run" && string(msg.Body) == "0" {
+			break
+		}
+	}
+
+	// the server goes down and comes back
+	srv.Close()
+	for {
+		msg := receive()
+		if msg.Type == message.TypeEvent {
+			assert.Equal(EventOffline, string(msg.Body))
+			break
+		}
+	}
+	srv = newTestServer(t, addr.String(), s)
+	assert.Equal(EventOnline, string(receive().Body))
+	assert.Equal(map[string]string{"run": "0", "temp": "-20"}, receiveValues())
+
+	assert.Nil(d.Stop())
+	srv.Close()
+	checkGoroutines(t, before)
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testSlave is a Modbus slave for tests. Addresses not in the maps
+// return the exception 2 (illegal data address).
+type testSlave struct {
+	mu        sync.Mutex
+	coils     map[uint16]bool
+	discretes map[uint16]bool
+	inputs    map[uint16]uint16
+	holdings  map[uint16]uint16
+}
+
+func newTestSlave() *testSlave {
+	return &testSlave{
+		coils:     map[uint16]bool{0: true, 1: false},
+		discretes: map[uint16]bool{0: false},
+		inputs: map[uint16]uint16{
+			0: 0xff38, // -200
+			1: 0x3fc0, // 1.5 in float32
+			2: 0x0000,
+		},
+		holdings: map[uint16]uint16{
+			10: 0x0001,
+			11: 0x0002,
+			20: 0,
+		},
+	}
+}
+
+// handle returns the response PDU of the request PDU.
+func (s *testSlave) handle(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exception := func(code byte) []byte {
+		return []byte{req[0] | 0x80, code}
+	}
+	if len(req) < 5 {
+		return exception(3)
+	}
+	addr := binary.BigEndian.Uint16(req[1:])
+	v := binary.BigEndian.Uint16(req[3:])
+	switch req[0] {
+	case fcReadCoils, fcReadDiscreteInputs:
+		bits := s.coils
+		if req[0] == fcReadDiscreteInputs {
+			bits = s.discretes
+		}
+		data := make([]byte, (v+7)/8)
+		for i := uint16(0); i < v; i++ {
+			b, ok := bits[addr+i]
+			if !ok {
+				return exception(2)
+			}
+			if b {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{req[0], byte(len(data))}, data...)
+	case fcReadHolding, fcReadInput:
+		regs := s.holdings
+		if req[0] == fcReadInput {
+			regs = s.inputs
+		}
+		res := []byte{req[0], byte(v * 2)}
+		for i := uint16(0); i < v; i++ {
+			r, ok := regs[addr+i]
+			if !ok {
+				return exception(2)
+			}
+			res = append(res, byte(r>>8), byte(r))
+		}
+		return res
+	case fcWriteCoil:
+		if _, ok := s.coils[addr]; !ok {
+			return exception(2)
+		}
+		s.coils[addr] = v == 0xff00
+		return req
+	case fcWriteRegister:
+		if _, ok := s.holdings[addr]; !ok {
+			return exception(2)
+		}
+		s.holdings[addr] = v
+		return req
+	case fcWriteRegisters:
+		for i := uint16(0); i < v; i++ {
+			s.holdings[addr+i] = binary.BigEndian.Uint16(req[6+2*i:])
+		}
+		return req[:5]
+	}
+	return exception(1)
+}
+
+func (s *testSlave) holding(addr uint16) uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holdings[addr]
+}
+
+// Do makes testSlave a transport.
+func (s *testSlave) Do(pdu []byte) ([]byte, error) {
+	res := s.handle(pdu)
+	if err := checkException(pdu, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func TestNewModbusPoints(t *testing.T) {
+	assert := assert.New(t)
+
+	points, err := NewModbusPoints(map[string]string{
+		"broker":      "sango",
+		"point_temp":  "input, 0, int16, scale=0.1",
+		"point_total": "holding, 0x10, uint32, word_order=little",
+		"point_run":   "coil, 3",
+		"point_level": "holding, 20",
+	})
+	assert.Nil(err)
+	assert.Equal([]ModbusPoint{
+		{Name: "level", Table: TableHolding, Address: 20, Type: TypeUint16, BigEndian: true, Scale: 1},
+		{Name: "run", Table: TableCoil, Address: 3, Type: TypeBool, BigEndian: true, Scale: 1},
+		{Name: "temp", Table: TableInput, Address: 0, Type: TypeInt16, BigEndian: true, Scale: 0.1},
+		{Name: "total", Table: TableHolding, Address: 16, Type: TypeUint32, BigEndian: false, Scale: 1},
+	}, points)
+
+	_, err = NewModbusPoints(map[string]string{"broker": "sango"})
+	assert.NotNil(err)
+
+	for _, v := range []string{
+		"input",
+		"register, 0",
+		"input, 65536",
+		"input, 0, int64",
+		"coil, 0, int16",
+		"input, 0, bool",
+		"input, 0, int16, scale=0",
+		"input, 0, uint32, word_order=middle",
+		"input, 0, int16, offset=1",
+	} {
+		_, err = NewModbusPoints(map[string]string{"point_x": v})
+		assert.NotNil(err, v)
+	}
+}
+
+func TestNewModbus(t *testing.T) {
+	assert := assert.New(t)
+
+	m, err := NewModbus(map[string]string{"point_x": "coil, 0"})
+	assert.Nil(err)
+	assert.Equal(byte(DefaultModbusSlaveID), m.SlaveID)
+	assert.Equal(DefaultModbusInterval, m.Interval)
+	assert.Equal(DefaultModbusTimeout, m.Timeout)
+
+	m, err = NewModbus(map[string]string{
+		"point_x":             "coil, 0",
+		"slave_id":            "17",
+		"interval":            "0.5",
+		"response_timeout_ms": "200",
+	})
+	assert.Nil(err)
+	assert.Equal(byte(17), m.SlaveID)
+	assert.Equal(500*time.Millisecond, m.Interval)
+	assert.Equal(200*time.Millisecond, m.Timeout)
+
+	for k, v := range map[string]string{
+		"slave_id":            "248",
+		"interval":            "0",
+		"response_timeout_ms": "x",
+	} {
+		_, err = NewModbus(map[string]string{"point_x": "coil, 0", k: v})
+		assert.NotNil(err, k)
+	}
+}
+
+func TestModbusPointRead(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestSlave()
+	for spec, expected := range map[string]string{
+		"coil, 0":                                "1",
+		"coil, 1":                                "0",
+		"discrete, 0":                            "0",
+		"input, 0, int16":                        "-200",
+		"input, 0, uint16":                       "65336",
+		"input, 0, int16, scale=0.1":             "-20",
+		"input, 1, float32":                      "1.5",
+		"input, 1, float32, scale=2":             "3",
+		"holding, 10, uint32":                    "65538",
+		"holding, 10, uint32, word_order=little": "131073",
+		"holding, 10, int32, scale=0.01":         "655.38",
+	} {
+		p, err := parseModbusPoint("x", spec)
+		assert.Nil(err)
+		v, err := p.Read(s)
+		assert.Nil(err, spec)
+		assert.Equal(expected, v, spec)
+	}
+
+	p, err := parseModbusPoint("x", "holding, 100")
+	assert.Nil(err)
+	_, err = p.Read(s)
+	assert.Equal(&ModbusError{Exception: 2}, err)
+}
+
+func TestModbusPointWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newTestSlave()
+	write := func(spec, value string) error {
+		p, err := parseModbusPoint("x", spec)
+		assert.Nil(err)
+		return p.Write(s, value)
+	}
+
+	assert.Nil(write("coil, 1", "on"))
+	assert.True(s.coils[1])
+	assert.Nil(write("coil, 1", "0"))
+	assert.False(s.coils[1])
+
+	assert.Nil(write("holding, 20, int16, scale=0.1", "-20"))
+	assert.Equal(uint16(0xff38), s.holding(20))
+	assert.Nil(write("holding, 10, uint32, word_order=little", "131073"))
+	assert.Equal(uint16(0x0001), s.holding(10))
+	assert.Equal(uint16(0x0002), s.holding(11))
+	assert.Nil(write("holding, 10, float32", "1.5"))
+	assert.Equal(uint16(0x3fc0), s.holding(10))
+	assert.Equal(uint16(0x0000), s.holding(11))
+
+	assert.NotNil(write("input, 0", "1"))             // read only
+	assert.NotNil(write("holding, 20, uint16", "-1")) // out of range
+	assert.NotNil(write("holding, 20, int16", "hot")) // not a number
+	assert.NotNil(write("coil, 0", "2"))              // not a bool
+	assert.NotNil(write("holding, 100, uint16", "1")) // exception
+}
+
+func TestCRC16(t *testing.T) {
+	assert := assert.New(t)
+
+	// read 10 holding registers from slave 1
+	frame := appendCRC([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a})
+	assert.Equal([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0xc5, 0xcd}, frame)
+}
+
+func TestReadRTUFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	frame := string(appendCRC([]byte{0x01, 0x03, 0x02, 0x00, 0x2a}))
+	r := &chunkReader{chunks: []string{frame[:2], "", frame[2:]}}
+	buf, err := readRTUFrame(r, time.Second)
+	assert.Nil(err)
+	assert.Equal(frame, string(buf))
+
+	// exception
+	frame = string(appendCRC([]byte{0x01, 0x83, 0x02}))
+	buf, err = readRTUFrame(&chunkReader{chunks: []string{frame}}, time.Second)
+	assert.Nil(err)
+	assert.Equal(frame, string(buf))
+
+	// broken
+	_, err = readRTUFrame(&chunkReader{chunks: []string{frame[:4] + "\x00"}}, time.Second)
+	assert.Equal(&ModbusError{Reason: "crc error"}, err)
+
+	// no response
+	_, err = readRTUFrame(&chunkReader{}, 50*time.Millisecond)
+	assert.Equal(&ModbusError{Reason: "timeout"}, err)
+}
@@ -15,8 +15,10 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -36,14 +38,20 @@ type SerialDevice struct {
 	BrokerName string
 	QoS        byte `validate:"min=0,max=2"`
 	InputPort  inidef.InputPortType
-	Serial     string `validate:"max=256"`
-	Baud       int    `validate:"min=0"`
-	Size       int    `validate:"min=0,max=256"`
-	Type       string `validate:"max=256"`
-	Interval   int    `validate:"min=0"`
-	Retain     bool
-	Subscribe  bool
-	DeviceChan chan message.Message // GW -> device
+	SerialPort
+	Size         int    `validate:"min=0,max=256"`
+	Type         string `validate:"max=256"`
+	Framing      string // framing mode, see NewFramer
+	Interval     int    `validate:"min=0"`
+	Retain       bool
+	Subscribe    bool
+	Subscription Subscription          // topic filters routed to the device
+	Topic        message.TopicTemplate // overrides the topic template of the broker
+	Properties   Properties
+	Downlink     *Inbox // GW -> device
+
+	values map[string]string // device section, to make the framer on start
+	life   *lifecycle
 }
 
 func (device SerialDevice) String() string {
@@ -56,11 +64,12 @@ func (device SerialDevice) String() string {
 
 // NewSerialDevice read inidef.ConfigSection and returnes SerialDevice.
 // If config validation failed, return error
-func NewSerialDevice(section inidef.ConfigSection, brokers []*broker.Broker, devChan chan message.Message) (SerialDevice, error) {
+func NewSerialDevice(section inidef.ConfigSection, brokers []*broker.Broker) (SerialDevice, error) {
 	ret := SerialDevice{
-		Name:       section.Name,
-		DeviceChan: devChan,
-		Interval:   1,
+		Name:     section.Name,
+		Downlink: NewInbox(section.Name, DefaultInboxSize),
+		Interval: 1,
+		values:   section.Values,
 	}
 	values := section.Values
 	bname, ok := section.Values["broker"]
@@ -87,12 +96,9 @@ func NewSerialDevice(section inidef.ConfigSection, brokers []*broker.Broker, dev
 	// TODO: check it is true or not
 	// ret.InputPort = inidef.InputPortType(inidef.INPUT_PORT_SERIAL)
 	ret.InputPort = inidef.InputPortType(inidef.INPUT_PORT_DUMMY)
-	ret.Serial = values["serial"]
-	baud, err := strconv.Atoi(values["baud"])
+	ret.SerialPort, err = NewSerialPort(values)
 	if err != nil {
 		return ret, err
-	} else {
-		ret.Baud = int(baud)
 	}
 	if values["size"] == "" {
 		ret.Size = 0
@@ -105,14 +111,31 @@ func NewSerialDevice(section inidef.ConfigSection, brokers []*broker.Broker, dev
 		}
 	}
 	ret.Type = values["type"]
+	// a read blocks for ReadTimeout at most after the port is closed
+	ret.life = newLifecycle(ret.Name, DefaultStopTimeout+ret.ReadTimeout)
+	if _, err := NewFramer(values, ret.Size); err != nil {
+		return ret, err
+	}
+	ret.Framing = framingMode(values, ret.Size)
 	ret.Retain = false
 	if values["retain"] == "true" {
 		ret.Retain = true
 	}
 
-	sub, ok := values["subscribe"]
-	if ok && sub == "true" {
-		ret.Subscribe = true
+	ret.Subscription, err = NewSubscription(values, ret.Name, bname, ret.QoS, brokers)
+	if err != nil {
+		return ret, err
+	}
+	ret.Subscribe = ret.Subscription.Enabled()
+
+	ret.Topic, err = message.ParseTopicTemplate(values["topic"])
+	if err != nil {
+		return ret, err
+	}
+
+	ret.Properties, err = NewProperties(values)
+	if err != nil {
+		return ret, err
 	}
 
 	if err := ret.Validate(); err != nil {
@@ -122,156 +145,215 @@ func NewSerialDevice(section inidef.ConfigSection, brokers []*broker.Broker, dev
 	return ret, nil
 }
 
-func (device *SerialDevice) Validate() error {
-	validator := validator.NewValidator()
-	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
-	if err := validator.Validate(device); err != nil {
-		return err
+// Flow control of the serial port.
+const (
+	FlowNone    = "none"
+	FlowRTSCTS  = "rtscts"
+	FlowXONXOFF = "xonxoff"
+
+	DefaultReadTimeout = 50 * time.Millisecond
+)
+
+// SerialPort is the settings of the serial port, shared by the device
+// types which read a serial port.
+type SerialPort struct {
+	Serial      string `validate:"max=256"`
+	Baud        int    `validate:"min=0"`
+	DataBits    byte
+	Parity      serial.Parity
+	StopBits    serial.StopBits
+	FlowControl string
+	ReadTimeout time.Duration
+	USBID       string         // VID:PID to find the port, see setReopenValues
+	Reopen      broker.Backoff // delay before reopening the port
+}
+
+// NewSerialPort reads the settings of the serial port from the device
+// section.
+func NewSerialPort(values map[string]string) (SerialPort, error) {
+	ret := SerialPort{
+		Serial: values["serial"],
 	}
-	return nil
+	baud, err := strconv.Atoi(values["baud"])
+	if err != nil {
+		return ret, err
+	}
+	ret.Baud = baud
+	if err := setPortValues(&ret, values); err != nil {
+		return ret, err
+	}
+	if err := setReopenValues(&ret, values); err != nil {
+		return ret, err
+	}
+	return ret, nil
 }
 
-func readSizedSerialPortLoop(bufSize int, port *serial.Port, readpipe chan []byte) error {
-	readBuf := make([]byte, 512)
-	var sumBuf = []byte{}
-	var renewBuf = []byte{}
-	sendBuf := make([]byte, 256)
+// setPortValues reads the settings of the serial port. Default is 8N1
+// without flow control.
+//
+// example:
+//
+//	data_bits = 7
+//	parity = even
+//	stop_bits = 1
+//	flow_control = rtscts
+//	read_timeout_ms = 100
+func setPortValues(device *SerialPort, values map[string]string) error {
+	device.DataBits = 8
+	device.Parity = serial.ParityNone
+	device.StopBits = serial.Stop1
+	device.FlowControl = FlowNone
+	device.ReadTimeout = DefaultReadTimeout
 
-	for {
-		num, err := port.Read(readBuf)
-		if err == io.EOF {
-			continue
+	if v, ok := values["data_bits"]; ok {
+		bits, err := strconv.Atoi(v)
+		if err != nil || bits < 5 || bits > 8 {
+			return fmt.Errorf("invalid data_bits: %s", v)
 		}
-		if err != nil {
-			return fmt.Errorf("cannnot open serial port: serialPort: %v, Error: %v", port, err)
+		device.DataBits = byte(bits)
+	}
+	if v, ok := values["parity"]; ok {
+		switch strings.ToLower(v) {
+		case "none", "n":
+			device.Parity = serial.ParityNone
+		case "odd", "o":
+			device.Parity = serial.ParityOdd
+		case "even", "e":
+			device.Parity = serial.ParityEven
+		case "mark", "m":
+			device.Parity = serial.ParityMark
+		case "space", "s":
+			device.Parity = serial.ParitySpace
+		default:
+			return fmt.Errorf("invalid parity: %s", v)
 		}
-		if num > 0 {
-			log.Debugf("readBuf: %v, len: %v", readBuf, len(readBuf))
-			for index := range readBuf[:num] {
-				sumBuf = append(sumBuf, readBuf[index])
-			}
-			for len(sumBuf) >= bufSize {
-				sendBuf = sumBuf[:bufSize]
-				readpipe <- sendBuf
-
-				// Truncate sumBuf by Size
-				log.Debugf("sumBuf: %v, len: %v", sumBuf, len(sumBuf))
-				renewBuf = []byte{}
-				for index := bufSize; index < len(sumBuf); index++ {
-					renewBuf = append(renewBuf, sumBuf[index])
-				}
-				sumBuf = renewBuf
-				log.Debugf("renewed sumBuf: %v, len: %v / Size: %v", sumBuf, len(sumBuf), bufSize)
+	}
+	if v, ok := values["stop_bits"]; ok {
+		switch v {
+		case "1":
+			device.StopBits = serial.Stop1
+		case "1.5":
+			// tarm/serial supports 1.5 stop bits only on Windows
+			if runtime.GOOS != "windows" {
+				return fmt.Errorf("stop_bits 1.5 is not supported on %s", runtime.GOOS)
 			}
+			device.StopBits = serial.Stop1Half
+		case "2":
+			device.StopBits = serial.Stop2
+		default:
+			return fmt.Errorf("invalid stop_bits: %s", v)
+		}
+	}
+	if v, ok := values["flow_control"]; ok {
+		switch strings.ToLower(v) {
+		case FlowNone, FlowRTSCTS, FlowXONXOFF:
+			device.FlowControl = strings.ToLower(v)
+		default:
+			return fmt.Errorf("invalid flow_control: %s", v)
+		}
+		if err := checkFlowControl(device.FlowControl); err != nil {
+			return err
 		}
 	}
+	if v, ok := values["read_timeout_ms"]; ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 || ms > 25500 {
+			return fmt.Errorf("invalid read_timeout_ms: %s", v)
+		}
+		device.ReadTimeout = time.Duration(ms) * time.Millisecond
+	}
+	return nil
 }
 
-func readFreesizedSerialPortLoop(port *serial.Port, readpipe chan []byte) error {
-	readBuf := make([]byte, 256)
-	var sumBuf = []byte{}
-
-	readPointer := 0
+func (device *SerialDevice) Validate() error {
+	validator := validator.NewValidator()
+	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
+	if err := validator.Validate(device); err != nil {
+		return err
+	}
+	return nil
+}
 
-	defer port.Close()
+// readSerialPortLoop reads the port and sends the frames split by the
+// framer until ctx is canceled. Read blocks for ReadTimeout at most, so
+// it never spins.
+func readSerialPortLoop(ctx context.Context, port io.Reader, framer Framer, readpipe chan []byte) error {
+	readBuf := make([]byte, 512)
 
 	for {
+		if ctx.Err() != nil {
+			return nil
+		}
 		num, err := port.Read(readBuf)
-		if err == io.EOF {
+		var frames [][]byte
+		switch {
+		case err == io.EOF || (err == nil && num == 0):
 			// No more data comes
-			if readPointer > 0 {
-				log.Debugf("read data to send: %v", sumBuf)
-				readpipe <- sumBuf
-				readPointer = 0
-				sumBuf = []byte{}
-				log.Debugf("sumBuf cleared: %v", sumBuf)
-			}
-			continue
-		}
-		if err != nil {
+			frames = framer.Idle()
+		case err != nil:
 			return fmt.Errorf("cannnot open serial port: serialPort: %v, Error: %v", port, err)
+		default:
+			log.Debugf("readBuf: %v, len: %v", readBuf[:num], num)
+			frames = framer.Push(readBuf[:num])
 		}
-		if num > 0 {
-			readPointer += num
-			for index := range readBuf[:num] {
-				sumBuf = append(sumBuf, readBuf[index])
+		for _, frame := range frames {
+			select {
+			case readpipe <- frame:
+			case <-ctx.Done():
+				return nil
 			}
-			log.Debugf("read partial data: %v to sumBuf: %v", readBuf, sumBuf)
-			continue
 		}
 	}
 }
 
-func (device SerialDevice) Start(channel chan message.Message) error {
-	serialConfig := &serial.Config{Name: device.Serial, Baud: device.Baud, ReadTimeout: time.Millisecond * 50}
-	serialPort, err := serial.OpenPort(serialConfig)
-	if err != nil {
-		return fmt.Errorf("serial device start failed, serialConfig: %v, serialPort: %v, Error: %v", serialConfig, serialPort, err)
+// Start starts to read the serial port until Stop is called or ctx is
+// canceled. If the port can not be opened or is unplugged, it is opened
+// again with backoff.
+func (device SerialDevice) Start(ctx context.Context, channel chan message.Message) error {
+	if _, err := NewFramer(device.values, device.Size); err != nil {
+		return err
 	}
-
-	readPipe := make(chan []byte)
-
-	if device.Size > 0 {
-		go readSizedSerialPortLoop(device.Size, serialPort, readPipe)
-	} else {
-		go readFreesizedSerialPortLoop(serialPort, readPipe)
+	ctx, err := device.life.start(ctx)
+	if err != nil {
+		return err
 	}
-
 	log.Info("start serial device")
-
-	writeBuf := make([]byte, 256)
-	msgBuf := make([]byte, 256)
-
-	go func() error {
-		for {
-			select {
-			case msgBuf = <-readPipe:
-				log.Debugf("msgBuf to send: %v", msgBuf)
-				msg := message.Message{
-					Sender:     device.Name,
-					Type:       device.Type,
-					QoS:        device.QoS,
-					Retained:   device.Retain,
-					BrokerName: device.BrokerName,
-					Body:       msgBuf,
-				}
-				channel <- msg
-			case msg, _ := <-device.DeviceChan:
-				log.Infof("msg topic:, %v / %v", msg.Topic, device.Name)
-				if !strings.HasSuffix(msg.Topic, device.Name) {
-					continue
-				}
-				log.Infof("msg reached to device, %v", msg)
-				writeBuf = msg.Body
-				num, err := serialPort.Write(writeBuf)
-				if err != nil {
-					log.Error(err)
-					return err
-				}
-				log.Infof("written length: %d", num)
-			default:
-				// do nothing
-			}
-		}
-	}()
+	device.life.run(func() error {
+		return device.run(ctx, channel, device.openPort)
+	})
 	return nil
 }
 
+// Stop stops the goroutines, closes the serial port and waits until
+// they exit.
 func (device SerialDevice) Stop() error {
 	log.Infof("closing serial: %v", device.Name)
-	return nil
+	return device.life.stop()
 }
 
 func (device SerialDevice) DeviceType() string {
 	return "serial"
 }
 
+// DeviceName returns the name of the device.
+func (device SerialDevice) DeviceName() string {
+	return device.Name
+}
+
 func (device SerialDevice) AddSubscribe() error {
 	if !device.Subscribe {
 		return nil
 	}
-	for _, b := range device.Broker {
-		b.AddSubscribed(device.Name, device.QoS)
-	}
+	device.Subscription.AddTo(device.Broker)
 	return nil
 }
+
+// Inbox returns the downlink channel of the device.
+func (device SerialDevice) Inbox() *Inbox {
+	return device.Downlink
+}
+
+// Match returns true if the device subscribes the message.
+func (device SerialDevice) Match(msg message.Message) bool {
+	return device.Subscription.Match(msg)
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkFlowControl returns error if the flow control is not supported on
+// the platform.
+func checkFlowControl(flow string) error {
+	return nil
+}
+
+// setFlowControl sets the flow control to the termios of the serial port.
+// tarm/serial does not support flow control, so the termios is changed
+// after the port is opened. termios belongs to the tty, so it is shared
+// with the opened port.
+func setFlowControl(name string, flow string) error {
+	if flow == FlowNone || flow == "" {
+		return nil
+	}
+	f, err := os.OpenFile(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fd := int(f.Fd())
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	switch flow {
+	case FlowRTSCTS:
+		t.Cflag |= unix.CRTSCTS
+	case FlowXONXOFF:
+		t.Iflag |= unix.IXON | unix.IXOFF
+	}
+	return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty opens a pseudo terminal for tests. The slave is used as a
+// serial port, and the master is the other end of the line.
+func openPty(t *testing.T) (master *os.File, slave string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pty is not available, %v", err)
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestSetFlowControl(t *testing.T) {
+	master, slave := openPty(t)
+	defer master.Close()
+
+	// keep the slave open, termios is reset when the last fd is closed
+	f, err := os.OpenFile(slave, os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, c := range []struct {
+		flow  string
+		check func(*unix.Termios) bool
+	}{
+		{FlowRTSCTS, func(tio *unix.Termios) bool { return tio.Cflag&unix.CRTSCTS != 0 }},
+		{FlowXONXOFF, func(tio *unix.Termios) bool { return tio.Iflag&(unix.IXON|unix.IXOFF) == unix.IXON|unix.IXOFF }},
+	} {
+		if err := setFlowControl(slave, c.flow); err != nil {
+			t.Fatal(err)
+		}
+		tio, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.check(tio) {
+			t.Errorf("%s is not set, %#v", c.flow, tio)
+		}
+	}
+
+	if err := setFlowControl("/dev/not-exists", FlowRTSCTS); err == nil {
+		t.Error("no error for the port which does not exist")
+	}
+}
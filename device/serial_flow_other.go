@@ -0,0 +1,36 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package device
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// checkFlowControl returns error if the flow control is not supported on
+// the platform.
+func checkFlowControl(flow string) error {
+	if flow == FlowNone || flow == "" {
+		return nil
+	}
+	return fmt.Errorf("flow_control is not supported on %s", runtime.GOOS)
+}
+
+func setFlowControl(name string, flow string) error {
+	return checkFlowControl(flow)
+}
@@ -0,0 +1,350 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	serial "github.com/tarm/serial"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/message"
+)
+
+// Events of the serial port, published with the type "event" when the
+// port is opened or lost.
+const (
+	EventOnline  = "online"
+	EventOffline = "offline"
+)
+
+const (
+	DefaultReopenInterval    = 1 * time.Second
+	DefaultReopenMaxInterval = 30 * time.Second
+
+	// how often a silent port is checked whether it is unplugged
+	liveCheckInterval = time.Second
+	// number of empty reads in a row, each returned before half of the
+	// read timeout, which means the port is hung up
+	hungupReads = 3
+)
+
+var usbIDRegexp = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{4}$`)
+
+// setReopenValues reads usb_id and the reopen settings of the serial
+// device section. usb_id is VID:PID of the USB serial adapter in hex,
+// which is used to find the port instead of serial.
+//
+// example:
+//
+//	usb_id = 0403:6001
+//	reopen_interval = 1
+//	reopen_max_interval = 30
+func setReopenValues(device *SerialPort, values map[string]string) error {
+	if v := values["usb_id"]; v != "" {
+		id := strings.ToLower(v)
+		if !usbIDRegexp.MatchString(id) {
+			return fmt.Errorf("invalid usb_id: %s", v)
+		}
+		if err := checkUSBID(); err != nil {
+			return err
+		}
+		device.USBID = id
+	}
+	if device.Serial == "" && device.USBID == "" {
+		return fmt.Errorf("serial or usb_id is required")
+	}
+
+	var err error
+	device.Reopen, err = newReopenBackoff(values)
+	return err
+}
+
+// newReopenBackoff reads reopen_interval and reopen_max_interval in sec.
+func newReopenBackoff(values map[string]string) (broker.Backoff, error) {
+	ret := broker.Backoff{
+		Initial:    DefaultReopenInterval,
+		Max:        DefaultReopenMaxInterval,
+		Multiplier: broker.DefaultRetryMultiplier,
+		Jitter:     broker.DefaultRetryJitter,
+	}
+	if v := values["reopen_interval"]; v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			return ret, fmt.Errorf("invalid reopen_interval: %s", v)
+		}
+		ret.Initial = time.Duration(sec) * time.Second
+	}
+	if v := values["reopen_max_interval"]; v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 {
+			return ret, fmt.Errorf("invalid reopen_max_interval: %s", v)
+		}
+		ret.Max = time.Duration(sec) * time.Second
+	}
+	if ret.Max < ret.Initial {
+		return ret, fmt.Errorf("reopen_max_interval should not be less than reopen_interval")
+	}
+	return ret, nil
+}
+
+// portPath returns the path of the serial port. It is looked up on
+// every open, since the tty of the USB adapter may change after it is
+// plugged again.
+func (device SerialPort) portPath() (string, error) {
+	if device.USBID != "" {
+		return findUSBPort(device.USBID)
+	}
+	return device.Serial, nil
+}
+
+// openPort opens the serial port with the settings.
+func (device SerialPort) openPort() (io.ReadWriteCloser, error) {
+	path, err := device.portPath()
+	if err != nil {
+		return nil, err
+	}
+	serialConfig := &serial.Config{
+		Name:        path,
+		Baud:        device.Baud,
+		ReadTimeout: device.ReadTimeout,
+		Size:        device.DataBits,
+		Parity:      device.Parity,
+		StopBits:    device.StopBits,
+	}
+	port, err := serial.OpenPort(serialConfig)
+	if err != nil {
+		return nil, fmt.Errorf("serial port open failed, serialConfig: %v, Error: %v", serialConfig, err)
+	}
+	if err := setFlowControl(path, device.FlowControl); err != nil {
+		port.Close()
+		return nil, fmt.Errorf("serial port open failed, flow_control: %s, Error: %v", device.FlowControl, err)
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil && real != path {
+		log.Infof("serial port opened: %s (%s)", path, real)
+	} else {
+		log.Infof("serial port opened: %s", path)
+	}
+	return newLivePort(port, path, device.ReadTimeout), nil
+}
+
+// livePort detects that the port is unplugged. The read of an unplugged
+// tty returns no data like the read timeout, but without waiting for the
+// timeout. So empty reads returned too early are taken as unplugged, and
+// the device file is checked while the port is silent.
+type livePort struct {
+	io.ReadWriteCloser
+	path    string
+	info    os.FileInfo   // nil if the port is not a file, ex: COM1
+	timeout time.Duration // read timeout of the port, 0 if unknown
+	checked time.Time
+	early   int // empty reads returned early in a row
+}
+
+func newLivePort(port io.ReadWriteCloser, path string, timeout time.Duration) *livePort {
+	info, _ := os.Stat(path)
+	return &livePort{
+		ReadWriteCloser: port,
+		path:            path,
+		info:            info,
+		timeout:         timeout,
+		checked:         time.Now(),
+	}
+}
+
+func (p *livePort) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := p.ReadWriteCloser.Read(b)
+	if n > 0 || (err != nil && err != io.EOF) {
+		p.early = 0
+		return n, err
+	}
+	if p.timeout > 0 && time.Since(start) < p.timeout/2 {
+		p.early++
+		if p.early >= hungupReads {
+			return 0, fmt.Errorf("serial port %s is hung up", p.path)
+		}
+	} else {
+		p.early = 0
+	}
+	if p.info == nil {
+		return n, err
+	}
+	if time.Since(p.checked) < liveCheckInterval {
+		return n, err
+	}
+	p.checked = time.Now()
+	info, serr := os.Stat(p.path)
+	if serr != nil || !os.SameFile(p.info, info) {
+		return 0, fmt.Errorf("serial port %s is gone", p.path)
+	}
+	return n, err
+}
+
+// portKeeper keeps the port of a device open. If the port fails or can
+// not be opened, it is opened again with backoff. An event is published
+// when the port becomes online or offline.
+type portKeeper struct {
+	Name       string // device name
+	Type       string // device type
+	BrokerName string
+	QoS        byte
+	Reopen     broker.Backoff
+	Open       func() (io.ReadWriteCloser, error)
+	Serve      func(io.ReadWriteCloser) error // returns when the port fails or ctx is canceled
+}
+
+// run opens the port and serves it until ctx is canceled. Returns the
+// error of closing the port on cancel.
+func (k portKeeper) run(ctx context.Context, channel chan message.Message) error {
+	state := ""
+	attempt := 0
+	for {
+		port, err := k.Open()
+		if err == nil {
+			attempt = 0
+			if state != EventOnline {
+				state = EventOnline
+				k.sendEvent(ctx, channel, state)
+			}
+			err = k.Serve(port)
+			cerr := port.Close()
+			if ctx.Err() != nil {
+				return cerr
+			}
+			log.Errorf("device %s lost the port, %v", k.Name, err)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if state != EventOffline {
+			state = EventOffline
+			k.sendEvent(ctx, channel, state)
+		}
+
+		delay := k.Reopen.Delay(attempt)
+		attempt++
+		if err != nil && attempt > 1 {
+			log.Warnf("device %s: reopen failed, %v, retry in %v", k.Name, err, delay)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// sendEvent publishes the event of the port. It is retained, so that
+// the subscribers know whether the port is online.
+func (k portKeeper) sendEvent(ctx context.Context, channel chan message.Message, event string) {
+	log.Infof("device %s is %s", k.Name, event)
+	msg := message.Message{
+		Sender:     k.Name,
+		SenderType: k.Type,
+		Type:       message.TypeEvent,
+		QoS:        k.QoS,
+		Retained:   true,
+		BrokerName: k.BrokerName,
+		Body:       []byte(event),
+		Timestamp:  time.Now(),
+	}
+	select {
+	case channel <- msg:
+	case <-ctx.Done():
+	}
+}
+
+// run reads the serial port until ctx is canceled, and reopens it if it
+// fails.
+func (device SerialDevice) run(ctx context.Context, channel chan message.Message, open func() (io.ReadWriteCloser, error)) error {
+	k := portKeeper{
+		Name:       device.Name,
+		Type:       device.DeviceType(),
+		BrokerName: device.BrokerName,
+		QoS:        device.QoS,
+		Reopen:     device.Reopen,
+		Open:       open,
+		Serve: func(port io.ReadWriteCloser) error {
+			return device.serve(ctx, channel, port)
+		},
+	}
+	return k.run(ctx, channel)
+}
+
+// serve publishes the frames read from the port and writes the
+// subscribed messages to it, until the port fails or ctx is canceled.
+func (device SerialDevice) serve(ctx context.Context, channel chan message.Message, port io.ReadWriter) error {
+	framer, err := NewFramer(device.values, device.Size)
+	if err != nil {
+		return err
+	}
+	readCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	readPipe := make(chan []byte)
+	readErr := make(chan error, 1)
+	device.life.run(func() error {
+		readErr <- readSerialPortLoop(readCtx, port, framer, readPipe)
+		return nil
+	})
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			return err
+		case body := <-readPipe:
+			log.Debugf("msgBuf to send: %v", body)
+			msg := message.Message{
+				Sender:        device.Name,
+				SenderType:    device.DeviceType(),
+				Type:          device.Type,
+				QoS:           device.QoS,
+				Retained:      device.Retain,
+				BrokerName:    device.BrokerName,
+				TopicTemplate: device.Topic,
+				Body:          body,
+				Timestamp:     time.Now(),
+			}
+			device.Properties.Set(&msg)
+			select {
+			case channel <- msg:
+			case <-ctx.Done():
+				return nil
+			}
+		case msg := <-device.Downlink.C:
+			log.Infof("msg topic:, %v / %v", msg.Topic, device.Name)
+			if !device.Match(msg) {
+				continue
+			}
+			log.Infof("msg reached to device, %v", msg)
+			num, err := port.Write(msg.Body)
+			if err != nil {
+				return err
+			}
+			log.Infof("written length: %d", num)
+		}
+	}
+}
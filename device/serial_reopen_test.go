@@ -0,0 +1,279 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewSerialDeviceReopen(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/serial"]
+    broker = sango
+    qos = 1
+    baud = 9600
+`
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+
+	conf, err := inidef.LoadConfigByte([]byte(iniStr + "    serial = /dev/serial/by-id/usb-FTDI-if00-port0\n"))
+	b, err := NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(DefaultReopenInterval, b.Reopen.Initial)
+	assert.Equal(DefaultReopenMaxInterval, b.Reopen.Max)
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + `
+    serial = /dev/ttyUSB0
+    reopen_interval = 2
+    reopen_max_interval = 10
+`))
+	b, err = NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(2*time.Second, b.Reopen.Initial)
+	assert.Equal(10*time.Second, b.Reopen.Max)
+
+	// serial or usb_id is required
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
+	assert.NotNil(err)
+
+	for _, v := range []string{
+		"usb_id = 0403",
+		"usb_id = 0403:60011",
+		"reopen_interval = 0",
+		"reopen_max_interval = x",
+		"reopen_interval = 60",
+	} {
+		conf, err = inidef.LoadConfigByte([]byte(iniStr + "    serial = /dev/ttyUSB0\n    " + v + "\n"))
+		_, err = NewSerialDevice(conf.Sections[1], brokers)
+		assert.NotNil(err, v)
+	}
+}
+
+// fakePort is a serial port which can be unplugged.
+type fakePort struct {
+	data    chan string
+	gone    chan bool
+	written chan string
+}
+
+func newFakePort() *fakePort {
+	return &fakePort{
+		data:    make(chan string),
+		gone:    make(chan bool),
+		written: make(chan string, 1),
+	}
+}
+
+func (p *fakePort) Read(b []byte) (int, error) {
+	select {
+	case d := <-p.data:
+		return copy(b, d), nil
+	case <-p.gone:
+		return 0, errors.New("unplugged")
+	case <-time.After(10 * time.Millisecond):
+		return 0, io.EOF
+	}
+}
+
+func (p *fakePort) Write(b []byte) (int, error) {
+	p.written <- string(b)
+	return len(b), nil
+}
+
+func (p *fakePort) Close() error {
+	return nil
+}
+
+func TestSerialDeviceRun(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/serial"]
+    broker = sango
+    qos = 0
+    serial = /dev/ttyUSB0
+    baud = 9600
+    type = BLE
+    framing = delimiter
+    subscribe_topic = {device}/cmd
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	d.Reopen = broker.Backoff{Initial: 10 * time.Millisecond}
+
+	// fails, opens port1, fails, opens port2
+	port1 := newFakePort()
+	port2 := newFakePort()
+	opened := make(chan int, 4)
+	open := func() (io.ReadWriteCloser, error) {
+		n := len(opened)
+		opened <- n
+		switch n {
+		case 1:
+			return port1, nil
+		case 3:
+			return port2, nil
+		}
+		return nil, errors.New("no such file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan message.Message)
+	done := make(chan bool)
+	go func() {
+		d.run(ctx, ch, open)
+		close(done)
+	}()
+
+	receive := func() message.Message {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message from the device")
+		}
+		return message.Message{}
+	}
+	assertEvent := func(event string) {
+		msg := receive()
+		assert.Equal(message.TypeEvent, msg.Type)
+		assert.Equal(event, string(msg.Body))
+		assert.True(msg.Retained)
+	}
+
+	assertEvent(EventOffline)
+	assertEvent(EventOnline)
+	port1.data <- "hello\n"
+	msg := receive()
+	assert.Equal("BLE", msg.Type)
+	assert.Equal("hello", string(msg.Body))
+
+	close(port1.gone)
+	assertEvent(EventOffline)
+	assertEvent(EventOnline)
+	port2.data <- "again\n"
+	assert.Equal("again", string(receive().Body))
+
+	// writes to the reopened port
+	d.Downlink.Deliver(message.Message{
+		Type:   message.TypeSubscribed,
+		Sender: "sango",
+		Topic:  "dora/cmd",
+		Body:   []byte("on"),
+	})
+	select {
+	case w := <-port2.written:
+		assert.Equal("on", w)
+	case <-time.After(time.Second):
+		t.Error("not written to the port")
+	}
+	assert.Equal(4, len(opened))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("run does not return after cancel")
+	}
+}
+
+// hungupPort is a serial port which returns no data at once, as an
+// unplugged tty does.
+type hungupPort struct {
+	fakePort
+}
+
+func (p *hungupPort) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func TestLivePortHungup(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := make([]byte, 8)
+
+	// empty reads which wait for the timeout
+	p := newLivePort(newFakePort(), "COM1", 10*time.Millisecond)
+	for i := 0; i < hungupReads*2; i++ {
+		_, err := p.Read(buf)
+		assert.Equal(io.EOF, err)
+	}
+
+	// empty reads without waiting
+	p = newLivePort(&hungupPort{}, "COM1", time.Second)
+	for i := 0; i < hungupReads-1; i++ {
+		_, err := p.Read(buf)
+		assert.Equal(io.EOF, err)
+	}
+	_, err := p.Read(buf)
+	assert.NotNil(err)
+	assert.NotEqual(io.EOF, err)
+}
+
+func TestLivePort(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-serial")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ttyUSB0")
+	assert.Nil(ioutil.WriteFile(path, nil, 0644))
+	// another device file, created while the first one exists
+	assert.Nil(ioutil.WriteFile(path+".new", nil, 0644))
+
+	p := newLivePort(newFakePort(), path, 0)
+	buf := make([]byte, 8)
+
+	// silent but plugged
+	p.checked = time.Time{}
+	_, err = p.Read(buf)
+	assert.Equal(io.EOF, err)
+
+	// not checked until liveCheckInterval passes
+	assert.Nil(os.Remove(path))
+	_, err = p.Read(buf)
+	assert.Equal(io.EOF, err)
+
+	p.checked = time.Time{}
+	_, err = p.Read(buf)
+	assert.NotNil(err)
+	assert.NotEqual(io.EOF, err)
+
+	// plugged again, but the port is not the same
+	assert.Nil(os.Rename(path+".new", path))
+	p.checked = time.Time{}
+	_, err = p.Read(buf)
+	assert.NotNil(err)
+	assert.NotEqual(io.EOF, err)
+}
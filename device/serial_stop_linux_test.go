@@ -0,0 +1,86 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"context"
+	"io/ioutil"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+// openFiles returns the number of the open files of the process.
+func openFiles(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("/proc is not available, %v", err)
+	}
+	return len(fds)
+}
+
+func TestSerialDeviceStop(t *testing.T) {
+	assert := assert.New(t)
+
+	master, slave := openPty(t)
+	defer master.Close()
+
+	iniStr := `
+[device "dora/serial"]
+    broker = sango
+    qos = 0
+    serial = ` + slave + `
+    baud = 9600
+    framing = delimiter
+    read_timeout_ms = 100
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	d, err := NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+
+	files := openFiles(t)
+	before := runtime.NumGoroutine()
+	ch := make(chan message.Message, 10)
+	assert.Nil(d.Start(context.Background(), ch))
+
+	receive := func() message.Message {
+		select {
+		case msg := <-ch:
+			return msg
+		case <-time.After(2 * time.Second):
+			t.Fatal("no message from the device")
+		}
+		return message.Message{}
+	}
+	assert.Equal(EventOnline, string(receive().Body))
+	_, err = master.Write([]byte("hello\n"))
+	assert.Nil(err)
+	assert.Equal("hello", string(receive().Body))
+
+	assert.Nil(d.Stop())
+	checkGoroutines(t, before)
+	assert.Equal(files, openFiles(t), "serial port is not closed")
+}
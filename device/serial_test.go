@@ -15,13 +15,15 @@
 package device
 
 import (
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	serial "github.com/tarm/serial"
 
 	"github.com/shiguredo/fuji/broker"
 	"github.com/shiguredo/fuji/inidef"
-	"github.com/shiguredo/fuji/message"
 )
 
 func TestNewSerialDevice(t *testing.T) {
@@ -39,7 +41,7 @@ func TestNewSerialDevice(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	b, err := NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	b, err := NewSerialDevice(conf.Sections[1], brokers)
 	assert.Nil(err)
 	assert.NotNil(b.Broker)
 	assert.Equal("dora", b.Name)
@@ -62,7 +64,7 @@ func TestNewSerialDeviceNotSetSize(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	b, err := NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	b, err := NewSerialDevice(conf.Sections[1], brokers)
 	assert.Nil(err)
 	assert.NotNil(b.Broker)
 	assert.Equal("dora", b.Name)
@@ -82,7 +84,7 @@ func TestNewSerialDeviceInvalidInterval(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
@@ -97,7 +99,7 @@ func TestNewSerialDeviceInvalidQoS(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
@@ -112,7 +114,7 @@ func TestNewSerialDeviceInvalidBroker(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
@@ -128,8 +130,91 @@ func TestNewSerialDeviceInvalidBaud(t *testing.T) {
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	b1 := &broker.Broker{Name: "sango"}
 	brokers := []*broker.Broker{b1}
-	_, err = NewSerialDevice(conf.Sections[1], brokers, make(chan message.Message))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
 	assert.NotNil(err)
 }
 
 // TODO: TestIniBadDeviceWithUnknownInterface
+
+func TestNewSerialDeviceFraming(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/serial"]
+    broker = sango
+    qos = 1
+    serial = /dev/tty.ble
+    baud = 9600
+    type = BLE
+    framing = delimiter
+    delimiter = \r\n
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(FramingDelimiter, b.Framing)
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + "    max_frame = -1\n"))
+	_, err = NewSerialDevice(conf.Sections[1], brokers)
+	assert.NotNil(err)
+}
+
+func TestNewSerialDevicePortSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/serial"]
+    broker = sango
+    qos = 1
+    serial = /dev/tty.ble
+    baud = 9600
+    type = BLE
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	b1 := &broker.Broker{Name: "sango"}
+	brokers := []*broker.Broker{b1}
+	b, err := NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(byte(8), b.DataBits)
+	assert.Equal(serial.ParityNone, b.Parity)
+	assert.Equal(serial.Stop1, b.StopBits)
+	assert.Equal(FlowNone, b.FlowControl)
+	assert.Equal(DefaultReadTimeout, b.ReadTimeout)
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + `
+    data_bits = 7
+    parity = even
+    stop_bits = 2
+    read_timeout_ms = 200
+`))
+	b, err = NewSerialDevice(conf.Sections[1], brokers)
+	assert.Nil(err)
+	assert.Equal(byte(7), b.DataBits)
+	assert.Equal(serial.ParityEven, b.Parity)
+	assert.Equal(serial.Stop2, b.StopBits)
+	assert.Equal(200*time.Millisecond, b.ReadTimeout)
+
+	for _, v := range []string{
+		"data_bits = 9",
+		"parity = x",
+		"stop_bits = 3",
+		"flow_control = dtrdsr",
+		"read_timeout_ms = 0",
+		"read_timeout_ms = 30000",
+	} {
+		conf, err = inidef.LoadConfigByte([]byte(iniStr + "    " + v + "\n"))
+		_, err = NewSerialDevice(conf.Sections[1], brokers)
+		assert.NotNil(err, v)
+	}
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + "    stop_bits = 1.5\n"))
+	b, err = NewSerialDevice(conf.Sections[1], brokers)
+	if runtime.GOOS == "windows" {
+		assert.Nil(err)
+		assert.Equal(serial.Stop1Half, b.StopBits)
+	} else {
+		assert.NotNil(err)
+	}
+}
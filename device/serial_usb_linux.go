@@ -0,0 +1,73 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// sysfs and /dev, replaced in tests.
+var (
+	sysTTYDir = "/sys/class/tty"
+	devDir    = "/dev"
+)
+
+// checkUSBID returns error if usb_id is not supported on the platform.
+func checkUSBID() error {
+	return nil
+}
+
+// findUSBPort returns the tty of the USB adapter of id (VID:PID). The
+// tty is searched in sysfs, and the first one is used if several
+// adapters match.
+func findUSBPort(id string) (string, error) {
+	ttys, err := ioutil.ReadDir(sysTTYDir)
+	if err != nil {
+		return "", err
+	}
+	for _, tty := range ttys {
+		dev, err := filepath.EvalSymlinks(filepath.Join(sysTTYDir, tty.Name(), "device"))
+		if err != nil {
+			continue // not a hardware tty
+		}
+		if usbID(dev) == id {
+			return filepath.Join(devDir, tty.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("usb serial port %s is not found", id)
+}
+
+// usbID returns VID:PID of the USB device which the interface dir
+// belongs to. idVendor and idProduct are in one of the parent dirs.
+func usbID(dir string) string {
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		vid, err := ioutil.ReadFile(filepath.Join(dir, "idVendor"))
+		if err != nil {
+			continue
+		}
+		pid, err := ioutil.ReadFile(filepath.Join(dir, "idProduct"))
+		if err != nil {
+			return ""
+		}
+		return string(bytes.TrimSpace(vid)) + ":" + string(bytes.TrimSpace(pid))
+	}
+	return ""
+}
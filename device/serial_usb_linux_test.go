@@ -0,0 +1,72 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package device
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindUSBPort(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-sysfs")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// sysfs of two USB adapters and a builtin port
+	mkdev := func(usb, vid, pid string) string {
+		d := filepath.Join(dir, "devices", usb)
+		assert.Nil(os.MkdirAll(filepath.Join(d, "1-1:1.0"), 0755))
+		assert.Nil(ioutil.WriteFile(filepath.Join(d, "idVendor"), []byte(vid+"\n"), 0644))
+		assert.Nil(ioutil.WriteFile(filepath.Join(d, "idProduct"), []byte(pid+"\n"), 0644))
+		return filepath.Join(d, "1-1:1.0")
+	}
+	link := func(tty, dev string) {
+		d := filepath.Join(dir, "class", "tty", tty)
+		assert.Nil(os.MkdirAll(d, 0755))
+		if dev != "" {
+			assert.Nil(os.Symlink(dev, filepath.Join(d, "device")))
+		}
+	}
+	link("tty0", "")
+	link("ttyACM0", mkdev("usb1/1-1", "2341", "0043"))
+	link("ttyUSB0", mkdev("usb2/2-1", "0403", "6001"))
+
+	defer func(sys, dev string) {
+		sysTTYDir = sys
+		devDir = dev
+	}(sysTTYDir, devDir)
+	sysTTYDir = filepath.Join(dir, "class", "tty")
+	devDir = "/dev"
+
+	path, err := findUSBPort("0403:6001")
+	assert.Nil(err)
+	assert.Equal("/dev/ttyUSB0", path)
+
+	path, err = findUSBPort("2341:0043")
+	assert.Nil(err)
+	assert.Equal("/dev/ttyACM0", path)
+
+	_, err = findUSBPort("10c4:ea60")
+	assert.NotNil(err)
+}
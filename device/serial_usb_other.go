@@ -0,0 +1,32 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package device
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// checkUSBID returns error if usb_id is not supported on the platform.
+func checkUSBID() error {
+	return fmt.Errorf("usb_id is not supported on %s", runtime.GOOS)
+}
+
+func findUSBPort(id string) (string, error) {
+	return "", checkUSBID()
+}
@@ -15,6 +15,7 @@
 package device
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -46,6 +47,8 @@ type Status struct {
 	Interval    int
 	CPU         CPUStatus
 	Memory      MemoryStatus
+
+	life *lifecycle
 }
 
 func (device Status) String() string {
@@ -62,8 +65,10 @@ func (c CPUStatus) Get() []message.Message {
 		for _, t := range c.CpuTimes {
 			msg := message.Message{
 				Sender:     "status",
+				SenderType: "status",
 				Type:       "status",
 				BrokerName: c.BrokerName,
+				Timestamp:  time.Now(),
 			}
 			var body string
 			switch t {
@@ -110,8 +115,10 @@ func (m MemoryStatus) Get() []message.Message {
 		for _, t := range m.VirtualMemory {
 			msg := message.Message{
 				Sender:     "status",
+				SenderType: "status",
 				Type:       "status",
 				BrokerName: m.BrokerName,
+				Timestamp:  time.Now(),
 			}
 			var body string
 			switch t {
@@ -147,6 +154,7 @@ func NewStatus(conf inidef.Config) (Devicer, error) {
 	ret := Status{
 		Name:        "status",
 		GatewayName: conf.GatewayName,
+		life:        newLifecycle("status", DefaultStopTimeout),
 	}
 
 	// first, search "status" section
@@ -234,35 +242,61 @@ func (device *Status) Validate() error {
 	return nil
 }
 
-func (device Status) Start(channel chan message.Message) error {
+// Start sends the status every Interval until Stop is called or ctx is
+// canceled.
+func (device Status) Start(ctx context.Context, channel chan message.Message) error {
+	ctx, err := device.life.start(ctx)
+	if err != nil {
+		return err
+	}
 	log.Infof("start status")
-	go func() {
-		for {
-			msgs := make([]message.Message, 0, 10)
+	device.life.run(func() error {
+		ticker := time.NewTicker(time.Duration(device.Interval) * time.Second)
+		defer ticker.Stop()
 
-			msgs = append(msgs, device.CPU.Get()...)
-			msgs = append(msgs, device.Memory.Get()...)
-			if len(msgs) > 0 {
-				for _, msg := range msgs {
-					channel <- msg
+		for {
+			for _, msg := range device.Report() {
+				select {
+				case channel <- msg:
+				case <-ctx.Done():
+					return nil
 				}
 			}
 
-			time.Sleep(time.Duration(device.Interval) * time.Second)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
 		}
-	}()
+	})
 	return nil
 }
 
+// Report returns the current status by Messages.
+func (device Status) Report() []message.Message {
+	msgs := make([]message.Message, 0, 10)
+
+	msgs = append(msgs, device.CPU.Get()...)
+	msgs = append(msgs, device.Memory.Get()...)
+	return msgs
+}
+
+// Stop stops the goroutine and waits until it exits.
 func (device Status) Stop() error {
 	log.Infof("closing status: %v", device.Name)
-	return nil
+	return device.life.stop()
 }
 
 func (device Status) DeviceType() string {
 	return "status"
 }
 
+// DeviceName returns the name of the device.
+func (device Status) DeviceName() string {
+	return device.Name
+}
+
 // parseStatus parse fields in the status childs
 // ex: user, system, idle, nice, => []string{"user", "system", "idle", "nice"}
 func parseStatus(buf string) []string {
@@ -287,3 +321,13 @@ func (device Status) AddSubscribe() error {
 	// Status does not subscibe
 	return nil
 }
+
+// Inbox returns nil since Status does not subscribe.
+func (device Status) Inbox() *Inbox {
+	return nil
+}
+
+// Match always returns false since Status does not subscribe.
+func (device Status) Match(msg message.Message) bool {
+	return false
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/message"
+)
+
+// DefaultSubscribeTopic is subscribed if only subscribe = true is set.
+const DefaultSubscribeTopic = "{prefix}/{gateway}/{device}"
+
+// Subscription is the topic filters which a device subscribes on its
+// broker. Filters are rendered for each broker of the failover group.
+type Subscription struct {
+	DeviceName string
+	BrokerName string
+	QoS        byte
+	Topics     []message.TopicTemplate
+	Filters    []string // rendered for all brokers of the group
+}
+
+// NewSubscription reads subscribe and subscribe_topic of the device
+// section. subscribe_topic is comma separated topic filters which may
+// include wildcards and {prefix}, {gateway}, {device} and {broker}.
+// Quote it by backquotes if it includes '#'.
+//
+// example:
+//
+//	subscribe_topic = `{prefix}/{gateway}/{device}/cmd,alerts/#`
+func NewSubscription(values map[string]string, deviceName, brokerName string, qos byte, brokers []*broker.Broker) (Subscription, error) {
+	s := Subscription{
+		DeviceName: deviceName,
+		BrokerName: brokerName,
+		QoS:        qos,
+	}
+
+	var topics []string
+	if v := values["subscribe_topic"]; v != "" {
+		for _, t := range strings.Split(v, ",") {
+			topics = append(topics, strings.TrimSpace(t))
+		}
+	} else if values["subscribe"] == "true" {
+		topics = []string{DefaultSubscribeTopic}
+	}
+
+	for _, t := range topics {
+		tmpl, err := message.ParseTopicFilterTemplate(t)
+		if err != nil {
+			return s, fmt.Errorf("subscribe_topic, %v", err)
+		}
+		s.Topics = append(s.Topics, tmpl)
+	}
+
+	for _, b := range brokers {
+		if b.Name != brokerName {
+			continue
+		}
+		for _, filter := range s.render(b) {
+			if !message.ValidTopicFilter(filter) {
+				return s, fmt.Errorf("invalid subscribe_topic: %s", filter)
+			}
+			if !contains(s.Filters, filter) {
+				s.Filters = append(s.Filters, filter)
+			}
+		}
+	}
+	return s, nil
+}
+
+// render returns the filters for the broker.
+func (s Subscription) render(b *broker.Broker) []string {
+	var filters []string
+	for _, tmpl := range s.Topics {
+		filters = append(filters, tmpl.Render(message.TopicVars{
+			Prefix:  b.TopicPrefix,
+			Gateway: b.GatewayName,
+			Device:  s.DeviceName,
+			Broker:  b.Name,
+		}))
+	}
+	return filters
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled returns true if the device subscribes any topic.
+func (s Subscription) Enabled() bool {
+	return len(s.Filters) > 0
+}
+
+// AddTo adds the filters to Subscribed of the brokers of BrokerName.
+func (s Subscription) AddTo(brokers []*broker.Broker) {
+	for _, b := range brokers {
+		if b.Name != s.BrokerName {
+			continue
+		}
+		for _, f := range s.render(b) {
+			log.Infof("subscribe: %#v", f)
+			b.Subscribed.Add(f, s.QoS)
+		}
+	}
+}
+
+// Match returns true if the message is received from the broker and
+// matches one of the filters.
+func (s Subscription) Match(msg message.Message) bool {
+	if msg.Type != message.TypeSubscribed || msg.Sender != s.BrokerName {
+		return false
+	}
+	for _, f := range s.Filters {
+		if message.MatchTopic(f, msg.Topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package device
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func testSubscriptionBrokers() []*broker.Broker {
+	return []*broker.Broker{
+		{Name: "sango", Priority: 1, GatewayName: "ham", TopicPrefix: "prefix", Subscribed: broker.NewSubscribed()},
+		{Name: "sango", Priority: 2, GatewayName: "ham", TopicPrefix: "backup", Subscribed: broker.NewSubscribed()},
+		{Name: "akane", Priority: 1, GatewayName: "ham", TopicPrefix: "prefix", Subscribed: broker.NewSubscribed()},
+	}
+}
+
+func TestNewSubscription(t *testing.T) {
+	assert := assert.New(t)
+	brokers := testSubscriptionBrokers()
+
+	// not subscribe
+	s, err := NewSubscription(map[string]string{}, "dora", "sango", 0, brokers)
+	assert.Nil(err)
+	assert.False(s.Enabled())
+
+	// subscribe = true subscribes the default topic on each broker of the group
+	s, err = NewSubscription(map[string]string{"subscribe": "true"}, "dora", "sango", 1, brokers)
+	assert.Nil(err)
+	assert.Equal([]string{"prefix/ham/dora", "backup/ham/dora"}, s.Filters)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 1
+    subscribe_topic = ` + "`{prefix}/{gateway}/{device}/+, alerts/#`" + `
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	s, err = NewSubscription(conf.Sections[1].Values, "dora", "sango", 1, brokers)
+	assert.Nil(err)
+	assert.Equal([]string{"prefix/ham/dora/+", "alerts/#", "backup/ham/dora/+"}, s.Filters)
+
+	s.AddTo(brokers)
+	assert.Equal(2, brokers[0].Subscribed.Length())
+	assert.Equal(byte(1), brokers[0].Subscribed.List()["alerts/#"])
+	assert.Equal(2, brokers[1].Subscribed.Length())
+	assert.Equal(0, brokers[2].Subscribed.Length())
+
+	invalids := []string{
+		"alerts/#/more",
+		"{prefix}/{unknown}",
+		"alerts/,",
+	}
+	for _, v := range invalids {
+		_, err := NewSubscription(map[string]string{"subscribe_topic": v}, "dora", "sango", 0, brokers)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestSubscriptionMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewSubscription(map[string]string{"subscribe": "true"}, "am", "sango", 0, testSubscriptionBrokers())
+	assert.Nil(err)
+
+	msg := message.Message{Sender: "sango", Type: message.TypeSubscribed, Topic: "prefix/ham/am"}
+	assert.True(s.Match(msg))
+
+	// does not match by suffix
+	msg.Topic = "prefix/ham/ham"
+	assert.False(s.Match(msg))
+
+	// from another broker
+	msg.Topic = "prefix/ham/am"
+	msg.Sender = "akane"
+	assert.False(s.Match(msg))
+
+	// not subscribed
+	msg.Sender = "sango"
+	msg.Type = "dummy"
+	assert.False(s.Match(msg))
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+)
+
+func TestCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-command")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	gw := newReloadGateway(t, reloadIni+`
+[broker "kuro"]
+host = 127.0.0.1
+port = 1883
+queue_dir = `+dir+`
+`)
+	gw.StartDevices()
+	done := make(chan error)
+	go func() { done <- gw.Start() }()
+	ctx := context.Background()
+
+	ret := Do(ctx, gw.CmdChan, Command{Type: CmdListDevices})
+	assert.Nil(ret.Err)
+	assert.Equal([]DeviceInfo{
+		{Name: "dora", Type: "dummy"},
+		{Name: "tama", Type: "dummy"},
+	}, ret.Devices)
+
+	// pause and resume
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdPause, Device: "dora"})
+	assert.Nil(ret.Err)
+	assert.Equal([]DeviceInfo{{Name: "dora", Type: "dummy", Paused: true}}, ret.Devices)
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: CmdPause, Device: "dora/dummy"}).Err)
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdListDevices})
+	assert.True(ret.Devices[0].Paused)
+	assert.False(ret.Devices[1].Paused)
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdResume, Device: "dora/dummy"})
+	assert.Nil(ret.Err)
+	assert.False(ret.Devices[0].Paused)
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: CmdResume, Device: "dora"}).Err)
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: CmdPause, Device: "mike"}).Err)
+
+	// brokers are not started
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdBrokerStatus})
+	assert.Nil(ret.Err)
+	assert.Equal(3, len(ret.Brokers))
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdBrokerStatus, Broker: "kuro"})
+	assert.Nil(ret.Err)
+	assert.Equal([]BrokerInfo{{Name: "kuro", Priority: 1, State: broker.StateClosed, Queued: 0}}, ret.Brokers)
+	assert.Equal(-1, Do(ctx, gw.CmdChan, Command{Type: CmdBrokerStatus, Broker: "sango"}).Brokers[0].Queued)
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: CmdBrokerStatus, Broker: "mike"}).Err)
+
+	// kuro is not connected
+	ret = Do(ctx, gw.CmdChan, Command{Type: CmdFlushQueue})
+	assert.NotNil(ret.Err)
+	assert.Equal(1, len(ret.Brokers))
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: CmdFlushQueue, Broker: "mike"}).Err)
+
+	assert.NotNil(Do(ctx, gw.CmdChan, Command{Type: "unknown"}).Err)
+
+	// reply is optional
+	gw.CmdChan <- Command{Type: CmdListDevices}
+
+	assert.Nil(gw.Stop())
+	assert.Nil(<-done)
+
+	// the gateway is stopped
+	<-gw.Done()
+	assert.NotNil(gw.Stop())
+	assert.NotNil(Do(gw.ctx, gw.CmdChan, Command{Type: CmdListDevices}).Err)
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(Do(timeout, gw.CmdChan, Command{Type: CmdListDevices}).Err)
+}
+
+func TestCommandBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	gw.StartDevices()
+	defer gw.Shutdown()
+
+	replies := make(chan Result, 1)
+	reply := func(ret Result) { replies <- ret }
+
+	// device is being stopped by another command
+	gw.setBusy("dora/dummy", true)
+	gw.dispatchCommand(Command{Type: CmdPause, Device: "dora"}, reply)
+	assert.NotNil((<-replies).Err)
+	gw.dispatchCommand(Command{Type: CmdRestartDevice, Device: "dora"}, reply)
+	assert.NotNil((<-replies).Err)
+	gw.setBusy("dora/dummy", false)
+
+	gw.dispatchCommand(Command{Type: CmdPause, Device: "dora"}, reply)
+	ret := <-replies
+	assert.Nil(ret.Err)
+	assert.Equal([]DeviceInfo{{Name: "dora", Type: "dummy", Paused: true}}, ret.Devices)
+	assert.False(gw.isBusy("dora/dummy"))
+
+	gw.dispatchCommand(Command{Type: CmdRestartDevice, Device: "dora"}, reply)
+	ret = <-replies
+	assert.Nil(ret.Err)
+	assert.Equal([]DeviceInfo{{Name: "dora", Type: "dummy"}}, ret.Devices)
+	gw.deviceOps.Wait()
+}
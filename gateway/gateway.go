@@ -16,10 +16,12 @@
 package gateway
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
@@ -30,36 +32,58 @@ import (
 	"github.com/shiguredo/fuji/device"
 	"github.com/shiguredo/fuji/inidef"
 	"github.com/shiguredo/fuji/message"
+	"github.com/shiguredo/fuji/pipeline"
 )
 
 type Gateway struct {
-	Name string `validate:"max=256,regexp=[^/]+,validtopic"`
+	Name   string        `validate:"max=256,regexp=[^/]+,validtopic"`
+	Config inidef.Config // running config
 
 	Devices []device.Devicer
 	Brokers broker.Brokers
+	Bridges []*broker.Bridge
+	Remote  *Remote // nil if remote control is disabled
 
-	MsgChan    chan message.Message // Broker -> GW
-	BrokerChan chan message.Message // GW -> Broker
-	CmdChan    chan string          // somewhere -> GW
-	DeviceChan chan message.Message // GW -> device
+	Pipelines map[string]pipeline.Pipeline // device key -> pipeline of its messages
 
-	MaxRetryCount int `validate:"min=1"`
-	RetryInterval int `validate:"min=1"`
+	MsgChan    chan message.Message    // Broker -> GW
+	BrokerChan chan message.Message    // GW -> Broker
+	CmdChan    chan Command            // somewhere -> GW
+	StateChan  chan broker.StateChange // Broker -> GW, connection state
+
+	MaxRetryCount   int `validate:"min=1"`
+	RetryInterval   int `validate:"min=1"`
+	ShutdownTimeout int `validate:"min=0"` // sec to wait for in-flight messages on shutdown
+
+	activeLock sync.Mutex
+	active     map[string]*broker.Broker // failover group name -> broker in use
+
+	lock      sync.RWMutex    // protects Brokers and retry settings on reload
+	paused    map[string]bool // device key -> paused by command
+	busyLock  sync.Mutex
+	busy      map[string]bool // device key -> being paused or restarted by command
+	deviceOps sync.WaitGroup  // pause and restart_device in progress
+	inflight  sync.WaitGroup  // messages being published
+	inflightN int64
+
+	ctx    context.Context // done when MainLoop returns
+	cancel context.CancelFunc
 }
 
 const (
 	DefaultMaxRetryCount    = 3
 	DefaultRetryInterval    = 3 // sec
+	DefaultShutdownTimeout  = 5 // sec
 	MaxMsgChanBufferSize    = 20
 	MaxBrokerChanBufferSize = 20
-	MaxDevicChanBufferSize  = 20
+	MaxStateChanBufferSize  = 20
 )
 
 func init() {
 	validator.SetValidationFunc("validtopic", inidef.ValidMqttPublishTopic)
 }
 
-func (gateway Gateway) String() string {
+func (gateway *Gateway) String() string {
 	return fmt.Sprintf("Name: %s\n", gateway.Name)
 }
 
@@ -76,14 +100,17 @@ func NewGateway(conf inidef.Config) (*Gateway, error) {
 	}
 
 	gw := Gateway{
-		Name:          section.Values["name"],
-		MsgChan:       make(chan message.Message, MaxMsgChanBufferSize),
-		BrokerChan:    make(chan message.Message, MaxBrokerChanBufferSize),
-		DeviceChan:    make(chan message.Message, MaxDevicChanBufferSize),
-		CmdChan:       make(chan string),
-		MaxRetryCount: DefaultMaxRetryCount,
-		RetryInterval: DefaultRetryInterval,
+		Name:            section.Values["name"],
+		Config:          conf,
+		MsgChan:         make(chan message.Message, MaxMsgChanBufferSize),
+		BrokerChan:      make(chan message.Message, MaxBrokerChanBufferSize),
+		StateChan:       make(chan broker.StateChange, MaxStateChanBufferSize),
+		CmdChan:         make(chan Command),
+		MaxRetryCount:   DefaultMaxRetryCount,
+		RetryInterval:   DefaultRetryInterval,
+		ShutdownTimeout: DefaultShutdownTimeout,
 	}
+	gw.ctx, gw.cancel = context.WithCancel(context.Background())
 
 	if m, ok := section.Values["max_retry_count"]; ok {
 		max, err := strconv.Atoi(m)
@@ -101,6 +128,41 @@ func NewGateway(conf inidef.Config) (*Gateway, error) {
 			return nil, fmt.Errorf("invalid retry_interval: %s", m)
 		}
 	}
+	if m, ok := section.Values["shutdown_timeout"]; ok {
+		timeout, err := strconv.Atoi(m)
+		if err == nil {
+			gw.ShutdownTimeout = timeout
+		} else {
+			return nil, fmt.Errorf("invalid shutdown_timeout: %s", m)
+		}
+	}
+
+	remote, err := NewRemote(section.Values, conf)
+	if err != nil {
+		return nil, err
+	}
+	gw.Remote = remote
+
+	gw.Pipelines = make(map[string]pipeline.Pipeline)
+	for _, s := range conf.Sections {
+		if s.Type != "device" {
+			continue
+		}
+		p, err := pipeline.New(s.Values)
+		if err != nil {
+			return nil, fmt.Errorf("device %s, %v", s.Name, err)
+		}
+		env, err := pipeline.NewEnvelope(gw.Name, s.Values)
+		if err != nil {
+			return nil, fmt.Errorf("device %s, %v", s.Name, err)
+		}
+		if env != nil {
+			p = append(p, env)
+		}
+		if len(p) > 0 {
+			gw.Pipelines[s.Name+"/"+s.Arg] = p
+		}
+	}
 
 	// Validation
 	if err := gw.Validate(); err != nil {
@@ -117,33 +179,197 @@ func (gw *Gateway) Start() error {
 	return gw.MainLoop()
 }
 
-func (gw *Gateway) Stop() {
-	gw.CmdChan <- "close"
+// Stop shuts down the gateway and waits until it completes. Returns error
+// if the gateway is already stopped.
+func (gw *Gateway) Stop() error {
+	return Do(gw.ctx, gw.CmdChan, Command{Type: CmdStop}).Err
 }
 
-// Publish pass the message to a Broker which is connected
-func (gw *Gateway) Publish(msg message.Message) {
-	// Brokers are orderd by Priority
+// Done returns a channel which is closed when the gateway is stopped.
+func (gw *Gateway) Done() <-chan struct{} {
+	return gw.ctx.Done()
+}
+
+// StartDevices starts the devices. Each device runs until it is stopped.
+func (gw *Gateway) StartDevices() {
+	for _, d := range gw.Devices {
+		gw.startDevice(d)
+	}
+}
+
+// deviceKey identifies the device in the config, ex: dora/dummy.
+func deviceKey(d device.Devicer) string {
+	return d.DeviceName() + "/" + d.DeviceType()
+}
+
+func (gw *Gateway) startDevice(d device.Devicer) {
+	if err := d.Start(context.Background(), gw.MsgChan); err != nil {
+		log.Errorf("device start error, %v", err)
+	}
+}
+
+// stopDevice stops the device and waits until its goroutines exit.
+func (gw *Gateway) stopDevice(d device.Devicer) {
+	if err := d.Stop(); err != nil {
+		log.Errorf("device stop error, %v", err)
+	}
+}
+
+// WatchBrokers passes state transitions of the brokers to StateChan.
+// Call it before the brokers start not to miss the first transitions.
+func (gw *Gateway) WatchBrokers() {
 	for _, b := range gw.Brokers {
-		if msg.BrokerName != b.Name {
-			continue
+		gw.watchBroker(b)
+	}
+}
+
+// watchBroker passes the transitions of b until b is closed or the gateway
+// stops. The gateway never starts a closed broker again, ex: removed by reload.
+func (gw *Gateway) watchBroker(b *broker.Broker) {
+	go func(ch <-chan broker.StateChange) {
+		for {
+			select {
+			case change := <-ch:
+				select {
+				case gw.StateChan <- change:
+				case <-gw.ctx.Done():
+					return
+				}
+				if change.To == broker.StateClosed {
+					return
+				}
+			case <-gw.ctx.Done():
+				return
+			}
 		}
+	}(b.Watch())
+}
+
+// onStateChange logs the connection state of the broker.
+func (gw *Gateway) onStateChange(change broker.StateChange) {
+	b := change.Broker
+	switch change.To {
+	case broker.StateConnected:
+		log.Infof("broker %s(priority %d) connected", b.Name, b.Priority)
+	case broker.StateBackingOff:
+		log.Warnf("broker %s(priority %d) reconnect in %v, %v", b.Name, b.Priority, change.Delay, change.Err)
+	case broker.StateClosed:
+		log.Infof("broker %s(priority %d) closed", b.Name, b.Priority)
+	}
+}
 
-		for i := 0; i < gw.MaxRetryCount; i++ {
-			if b.IsConnected() {
-				go b.Publish(&msg)
+// Publish pass the message to the highest priority Broker which is connected
+// in the failover group of msg.BrokerName. If no broker in the group is
+// connected, the message is stored to the queue of the group. If the group
+// has no queue, retry MaxRetryCount times and discard the message.
+func (gw *Gateway) Publish(msg message.Message) {
+	gw.lock.RLock()
+	group := gw.Brokers.Group(msg.BrokerName)
+	maxRetryCount, retryInterval := gw.MaxRetryCount, gw.RetryInterval
+	gw.lock.RUnlock()
+	if len(group) == 0 {
+		log.Errorf("broker does not exists: %s. msg discarded", msg.BrokerName)
+		return
+	}
+
+	for i := 0; i < maxRetryCount; i++ {
+		if b := group.Active(msg.BrokerName); b != nil {
+			gw.setActive(msg.BrokerName, b)
+			b.Publish(&msg)
+			return
+		}
+		for _, b := range group {
+			if b.Queue != nil {
+				b.Publish(&msg) // stored until b reconnects
 				return
 			}
-			time.Sleep(time.Duration(gw.RetryInterval) * time.Second)
 		}
+		time.Sleep(time.Duration(retryInterval) * time.Second)
 	}
-	log.Errorf("retry failed. msg discarded: %v, topic: %s", msg.BrokerName)
+	log.Errorf("retry failed. msg discarded, broker: %s, sender: %s", msg.BrokerName, msg.Sender)
+}
+
+// setActive records the broker which the failover group currently uses
+// and logs when the group fails over or fails back.
+func (gw *Gateway) setActive(name string, b *broker.Broker) {
+	gw.activeLock.Lock()
+	defer gw.activeLock.Unlock()
+
+	if gw.active == nil {
+		gw.active = make(map[string]*broker.Broker)
+	}
+	prev, ok := gw.active[name]
+	if ok && prev != b {
+		if b.Priority < prev.Priority {
+			log.Infof("broker %s fail back, priority %d -> %d", name, prev.Priority, b.Priority)
+		} else {
+			log.Warnf("broker %s fail over, priority %d -> %d", name, prev.Priority, b.Priority)
+		}
+	}
+	gw.active[name] = b
+}
+
+// relay publishes the subscribed message by the bridges which match it.
+// The topic filters of the bridges are subscribed on every broker of the
+// failover group, so only the message from the active broker is relayed
+// not to relay the same message twice.
+func (gw *Gateway) relay(msg message.Message) {
+	for _, bridge := range gw.Bridges {
+		if !bridge.Match(msg) {
+			continue
+		}
+		gw.lock.RLock()
+		active := gw.Brokers.Active(msg.Sender)
+		gw.lock.RUnlock()
+		if active == nil || active.Priority != msg.SenderPriority {
+			log.Debugf("bridged message skipped, not from the active broker: %s(priority %d)", msg.Sender, msg.SenderPriority)
+			return
+		}
+		m, err := bridge.Rewrite(msg)
+		if err != nil {
+			log.Warnf("bridged message dropped, %v", err)
+			continue
+		}
+		gw.publishAsync(m)
+	}
+}
+
+// deliver passes the subscribed message to the inbox of each device
+// which subscribes it. A device which does not read its inbox never
+// blocks MainLoop, the message is dropped instead.
+func (gw *Gateway) deliver(msg message.Message) {
+	for _, d := range gw.Devices {
+		if !d.Match(msg) {
+			continue
+		}
+		inbox := d.Inbox()
+		if !inbox.Deliver(msg) {
+			log.Warnf("device inbox full, msg dropped, device: %s, dropped: %d", inbox.Name, inbox.Dropped())
+		}
+	}
+}
+
+// process passes the message from the device through its pipeline.
+// Events of the device bypass the pipeline.
+func (gw *Gateway) process(msg message.Message) []message.Message {
+	p, ok := gw.Pipelines[msg.Sender+"/"+msg.SenderType]
+	if !ok || msg.Type == message.TypeEvent {
+		return []message.Message{msg}
+	}
+	msgs, err := p.Process(msg)
+	if err != nil {
+		log.Warnf("msg dropped by pipeline, device: %s, %v", msg.Sender, err)
+		return nil
+	}
+	return msgs
 }
 
 // MainLoop loops forever.
 func (gw *Gateway) MainLoop() error {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	defer gw.cancel()
 
 MAINLOOP:
 	for {
@@ -155,7 +381,9 @@ MAINLOOP:
 				break MAINLOOP
 			}
 			// use goroutine to avoid blocking
-			go gw.Publish(msg)
+			for _, m := range gw.process(msg) {
+				gw.publishAsync(m)
+			}
 
 		case msg, ok := <-gw.BrokerChan:
 			// brokerChan: messages from brokers
@@ -166,34 +394,36 @@ MAINLOOP:
 			if msg.Type != message.TypeSubscribed {
 				continue
 			}
-			// send to all device
-			gw.DeviceChan <- msg
+			if gw.handleRemote(msg) {
+				continue
+			}
+			gw.relay(msg)
+			gw.deliver(msg)
+		case change := <-gw.StateChan:
+			gw.onStateChange(change)
 		case signal, _ := <-sigChan:
 			// sigChan: signals
 			switch signal {
-			case syscall.SIGINT:
-				log.Warn("SIGINT caught")
-				// deadlock if without "go"
-				go gw.Stop()
-				continue
+			case syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT:
+				log.Warnf("%v caught. will be shutdown", signal)
+				return gw.Shutdown()
+			case syscall.SIGHUP:
+				log.Warn("SIGHUP caught. will be reloaded")
+				if err := gw.Reload(); err != nil {
+					log.Errorf("reload failed, running config is kept, %v", err)
+				}
 			default:
 				// do nothing
 			}
 		case cmd, _ := <-gw.CmdChan:
-			// cmdChan: messages from command line or ever
-			switch cmd {
-			case "close":
-				log.Warn("close command comes. will be shutdown")
-				for _, b := range gw.Brokers {
-					b.Close()
-				}
-				for _, d := range gw.Devices {
-					d.Stop()
-				}
-				return nil
-			default:
-				log.Warn("unknown command, %v", cmd)
+			// cmdChan: commands from the application embedding fuji
+			if cmd.Type == CmdStop {
+				log.Warn("stop command comes. will be shutdown")
+				err := gw.Shutdown()
+				cmd.reply(Result{Err: err})
+				return err
 			}
+			gw.dispatchCommand(cmd, cmd.reply)
 		}
 	}
 	return nil
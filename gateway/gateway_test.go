@@ -16,11 +16,16 @@ package gateway
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/device"
 	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
 )
 
 func TestNewGateway(t *testing.T) {
@@ -166,3 +171,107 @@ retry_interval = aabbcc
 		assert.NotNil(err)
 	}
 }
+
+func TestDeliver(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[device "dora/dummy"]
+    broker = sango
+    qos = 0
+    interval = 10
+    subscribe = true
+[device "am/dummy"]
+    broker = sango
+    qos = 0
+    interval = 10
+    subscribe = true
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	brokers := []*broker.Broker{{Name: "sango", Priority: 1, Port: 1883, ProtocolVersion: 4, GatewayName: "ham", TopicPrefix: "prefix"}}
+	devices, err := device.NewDevices(conf, brokers)
+	assert.Nil(err)
+	assert.Equal(2, len(devices))
+	gw := &Gateway{Devices: devices}
+
+	dora := devices[0].Inbox()
+	am := devices[1].Inbox()
+	msg := message.Message{Sender: "sango", Type: message.TypeSubscribed, Topic: "prefix/ham/dora"}
+	gw.deliver(msg)
+	assert.Equal(1, len(dora.C))
+	assert.Equal(0, len(am.C))
+
+	// a device which does not read never blocks, and counts drops
+	for i := 0; i < device.DefaultInboxSize+3; i++ {
+		gw.deliver(msg)
+	}
+	assert.Equal(device.DefaultInboxSize, len(dora.C))
+	assert.Equal(uint64(4), dora.Dropped())
+	assert.Equal(uint64(4), gw.deviceInfo(devices[0]).Dropped)
+	assert.Equal(uint64(0), gw.deviceInfo(devices[1]).Dropped)
+	assert.Equal(0, len(am.C))
+}
+
+func TestProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[gateway]
+    name = ham
+[device "dora/dummy"]
+    broker = sango
+    pipeline = split, deadband
+    deadband = 1
+[device "am/dummy"]
+    broker = sango
+[device "dora/serial"]
+    broker = sango
+    serial = /dev/ttyUSB0
+    baud = 9600
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	gw, err := NewGateway(conf)
+	assert.Nil(err)
+	assert.Equal(1, len(gw.Pipelines))
+
+	msgs := gw.process(message.Message{Sender: "dora", SenderType: "dummy", Body: []byte("1,1.5,3")})
+	assert.Equal(2, len(msgs))
+	assert.Equal([]byte("1"), msgs[0].Body)
+	assert.Equal([]byte("3"), msgs[1].Body)
+	assert.Equal(0, len(gw.process(message.Message{Sender: "dora", SenderType: "dummy", Body: []byte("hot")})))
+
+	// events bypass the pipeline
+	msgs = gw.process(message.Message{Sender: "dora", SenderType: "dummy", Type: message.TypeEvent, Body: []byte("offline")})
+	assert.Equal(1, len(msgs))
+
+	// no pipeline
+	msgs = gw.process(message.Message{Sender: "am", SenderType: "dummy", Body: []byte("1,1.5,3")})
+	assert.Equal(1, len(msgs))
+
+	// another device of the same name
+	msgs = gw.process(message.Message{Sender: "dora", SenderType: "serial", Body: []byte("1,1.5,3")})
+	assert.Equal(1, len(msgs))
+
+	conf, err = inidef.LoadConfigByte([]byte(iniStr + "    pipeline = unknown\n"))
+	assert.Nil(err)
+	_, err = NewGateway(conf)
+	assert.NotNil(err)
+}
+
+func TestWatchBrokerStop(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	n := runtime.NumGoroutine()
+	gw.WatchBrokers()
+	assert.Equal(n+len(gw.Brokers), runtime.NumGoroutine())
+
+	// the watchers exit even if nobody reads StateChan
+	gw.cancel()
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(n, runtime.NumGoroutine())
+}
@@ -0,0 +1,275 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/inidef"
+)
+
+// Reload loads the config file again and applies it by ReloadConfig.
+func (gw *Gateway) Reload() error {
+	if gw.Config.Path == "" {
+		return fmt.Errorf("config file is unknown")
+	}
+	conf, err := inidef.LoadConfig(gw.Config.Path)
+	if err != nil {
+		return err
+	}
+	return gw.ReloadConfig(conf)
+}
+
+// ReloadConfig applies the difference between conf and the running
+// config. Brokers and devices which are added, removed or changed are
+// started or stopped, and the others keep running. A broker is changed
+// if its section or its subscriptions are changed. A device is changed
+// if its section is changed or its broker is restarted.
+// If conf is invalid, returns error and nothing is changed.
+func (gw *Gateway) ReloadConfig(conf inidef.Config) error {
+	// validate all before changing anything
+	next, err := NewGateway(conf)
+	if err != nil {
+		return err
+	}
+	if next.Name != gw.Name {
+		return fmt.Errorf("gateway name can not be changed by reload, %s -> %s", gw.Name, next.Name)
+	}
+	// queues are opened after the running ones are handed over
+	brokers, err := broker.ParseBrokers(conf, gw.BrokerChan)
+	if err != nil {
+		return err
+	}
+	bridges, err := broker.NewBridges(conf, brokers)
+	if err != nil {
+		return err
+	}
+	var devices []device.Devicer
+	for _, section := range conf.Sections {
+		if section.Type != "device" {
+			continue
+		}
+		d, err := device.NewDevice(section, brokers)
+		if err != nil {
+			return fmt.Errorf("device %s, %v", section.Name, err)
+		}
+		if err := d.AddSubscribe(); err != nil {
+			return fmt.Errorf("device %s, %v", section.Name, err)
+		}
+		devices = append(devices, d)
+	}
+	if status, err := device.NewStatus(conf); err == nil {
+		devices = append(devices, status)
+	}
+	if next.Remote != nil {
+		next.Remote.AddTo(brokers)
+	}
+
+	// keep running brokers which are not changed
+	kept := make(map[*broker.Broker]bool)
+	for i, nb := range brokers {
+		for _, ob := range gw.Brokers {
+			if ob.Name == nb.Name && ob.Priority == nb.Priority &&
+				sameSection(gw.Config, conf, "broker", nb.Name) &&
+				reflect.DeepEqual(ob.Subscribed.List(), nb.Subscribed.List()) {
+				brokers[i] = ob
+				kept[ob] = true
+			}
+		}
+	}
+	// a failover group is kept if all brokers in it are kept
+	keptGroup := func(name string) bool {
+		for _, b := range brokers.Group(name) {
+			if !kept[b] {
+				return false
+			}
+		}
+		return len(brokers.Group(name)) == len(gw.Brokers.Group(name))
+	}
+
+	// a changed broker takes over the queue of the old one, not to open
+	// the same queue_dir twice. If the queue settings are changed, the
+	// queue is opened after the old broker is closed. Other queues are
+	// opened now.
+	reopen := make(map[*broker.Broker]bool)
+	for _, nb := range brokers {
+		if kept[nb] || nb.Queue == nil {
+			continue
+		}
+		running := false
+		for _, ob := range gw.Brokers {
+			if ob.Queue == nil || ob.Queue.Dir != nb.Queue.Dir {
+				continue
+			}
+			running = true
+			if sameQueue(ob.Queue, nb.Queue) {
+				nb.Queue = ob.Queue
+			} else {
+				reopen[nb] = true
+			}
+		}
+		if !running {
+			if err := nb.Queue.Open(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// keep running devices which are not changed
+	running := make(map[string]device.Devicer)
+	for _, d := range gw.Devices {
+		running[deviceKey(d)] = d
+	}
+	var added, removed []device.Devicer
+	for i, nd := range devices {
+		key := deviceKey(nd)
+		od, ok := running[key]
+		if ok && sameDevice(gw.Config, conf, nd) && keptGroup(deviceBrokerName(conf, nd)) {
+			devices[i] = od
+			delete(running, key)
+			// keep the state of the pipeline
+			if p, ok := gw.Pipelines[key]; ok {
+				next.Pipelines[key] = p
+			}
+			continue
+		}
+		added = append(added, nd)
+	}
+	for _, od := range running {
+		removed = append(removed, od)
+	}
+
+	// apply
+	gw.deviceOps.Wait() // pause or restart_device in progress
+	for _, d := range removed {
+		log.Infof("reload: stop device %s", deviceKey(d))
+		gw.stopDevice(d)
+		delete(gw.paused, deviceKey(d))
+	}
+	for _, b := range gw.Brokers {
+		if !kept[b] {
+			log.Infof("reload: close broker %s(priority %d)", b.Name, b.Priority)
+			b.Close()
+		}
+	}
+	for b := range reopen {
+		if err := b.Queue.Open(); err != nil {
+			log.Errorf("reload: queue of broker %s(priority %d) disabled, %v", b.Name, b.Priority, err)
+			b.Queue = nil
+		}
+	}
+
+	gw.lock.Lock()
+	gw.Brokers = brokers
+	gw.MaxRetryCount = next.MaxRetryCount
+	gw.RetryInterval = next.RetryInterval
+	gw.lock.Unlock()
+	gw.ShutdownTimeout = next.ShutdownTimeout
+	gw.Bridges = bridges
+	gw.Remote = next.Remote
+	gw.Pipelines = next.Pipelines
+	gw.Devices = devices
+	gw.Config = conf
+
+	for _, b := range brokers {
+		if kept[b] {
+			continue
+		}
+		log.Infof("reload: start broker %s(priority %d)", b.Name, b.Priority)
+		gw.watchBroker(b)
+		if err := b.MQTTClientSetup(gw.Name); err != nil {
+			log.Errorf("MQTTClientSetup failed, %v", err)
+		}
+	}
+	for _, d := range added {
+		log.Infof("reload: start device %s", deviceKey(d))
+		gw.startDevice(d)
+	}
+
+	log.Infof("reload completed, brokers: %d kept, %d started, devices: %d stopped, %d started",
+		len(kept), len(brokers)-len(kept), len(removed), len(added))
+	return nil
+}
+
+// sameSection returns true if the sections of the type and the name are
+// the same in both configs.
+func sameSection(old, new inidef.Config, typ, name string) bool {
+	return reflect.DeepEqual(findSections(old, typ, name), findSections(new, typ, name))
+}
+
+func findSections(conf inidef.Config, typ, name string) []inidef.ConfigSection {
+	var ret []inidef.ConfigSection
+	for _, s := range conf.Sections {
+		if s.Type == typ && s.Name == name {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// sameQueue returns true if the queues have the same settings.
+func sameQueue(a, b *broker.Queue) bool {
+	return a.MaxSize == b.MaxSize && a.MaxAge == b.MaxAge && a.Drop == b.Drop
+}
+
+// sameDevice returns true if the sections of the device are the same.
+// Status is the same if all status sections are the same.
+func sameDevice(old, new inidef.Config, d device.Devicer) bool {
+	if d.DeviceType() == "status" {
+		return reflect.DeepEqual(findType(old, "status"), findType(new, "status"))
+	}
+	return reflect.DeepEqual(findDevice(old, d), findDevice(new, d))
+}
+
+func findType(conf inidef.Config, typ string) []inidef.ConfigSection {
+	var ret []inidef.ConfigSection
+	for _, s := range conf.Sections {
+		if s.Type == typ {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func findDevice(conf inidef.Config, d device.Devicer) []inidef.ConfigSection {
+	var ret []inidef.ConfigSection
+	for _, s := range conf.Sections {
+		if s.Type == "device" && s.Name == d.DeviceName() && s.Arg == d.DeviceType() {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// deviceBrokerName returns the broker name which the device publishes to.
+func deviceBrokerName(conf inidef.Config, d device.Devicer) string {
+	if d.DeviceType() == "status" {
+		for _, s := range findType(conf, "status") {
+			if s.Name == "" {
+				return s.Values["broker"]
+			}
+		}
+		return ""
+	}
+	for _, s := range findDevice(conf, d) {
+		return s.Values["broker"]
+	}
+	return ""
+}
@@ -0,0 +1,245 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/device"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+const reloadIni = `
+[gateway]
+name = ham
+[broker "sango"]
+host = 127.0.0.1
+port = 1883
+[broker "akane"]
+host = 127.0.0.1
+port = 1883
+[device "dora/dummy"]
+broker = sango
+interval = 10
+payload = hello
+qos = 0
+[device "tama/dummy"]
+broker = akane
+interval = 10
+payload = hello
+qos = 0
+`
+
+func newReloadGateway(t *testing.T, iniStr string) *Gateway {
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Brokers, err = broker.NewBrokers(conf, gw.BrokerChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Devices, err = device.NewDevices(conf, gw.Brokers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range gw.Devices {
+		d.AddSubscribe()
+	}
+	return gw
+}
+
+func findDeviceByName(gw *Gateway, name string) device.Devicer {
+	for _, d := range gw.Devices {
+		if d.DeviceName() == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func TestReloadConfigKeepsUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	defer gw.Shutdown()
+	sango := gw.Brokers.Group("sango")[0]
+	akane := gw.Brokers.Group("akane")[0]
+	dora := findDeviceByName(gw, "dora")
+
+	// change akane and remove tama
+	conf, err := inidef.LoadConfigByte([]byte(`
+[gateway]
+name = ham
+[broker "sango"]
+host = 127.0.0.1
+port = 1883
+[broker "akane"]
+host = 127.0.0.1
+port = 1884
+[device "dora/dummy"]
+broker = sango
+interval = 10
+payload = hello
+qos = 0
+`))
+	assert.Nil(err)
+	assert.Nil(gw.ReloadConfig(conf))
+
+	assert.Equal(2, len(gw.Brokers))
+	assert.True(sango == gw.Brokers.Group("sango")[0])
+	assert.False(akane == gw.Brokers.Group("akane")[0])
+	assert.Equal(1884, gw.Brokers.Group("akane")[0].Port)
+	assert.Equal(broker.StateClosed, akane.State())
+
+	assert.Equal(1, len(gw.Devices))
+	assert.Equal(dora, findDeviceByName(gw, "dora"))
+	assert.Nil(findDeviceByName(gw, "tama"))
+}
+
+func TestReloadConfigRestartsDeviceOfChangedBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	defer gw.Shutdown()
+	dora := findDeviceByName(gw, "dora")
+	tama := findDeviceByName(gw, "tama")
+
+	// add a device which subscribes, so that the subscriptions of
+	// sango are changed
+	conf, err := inidef.LoadConfigByte([]byte(reloadIni + `
+[device "mike/dummy"]
+broker = sango
+interval = 10
+payload = hello
+qos = 0
+subscribe = true
+`))
+	assert.Nil(err)
+	assert.Nil(gw.ReloadConfig(conf))
+
+	assert.Equal(3, len(gw.Devices))
+	assert.NotEqual(dora, findDeviceByName(gw, "dora"))
+	assert.Equal(tama, findDeviceByName(gw, "tama"))
+	assert.NotNil(findDeviceByName(gw, "mike"))
+	assert.Equal(map[string]byte{"/ham/mike": 0}, gw.Brokers.Group("sango")[0].Subscribed.List())
+}
+
+func TestReloadConfigQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-reload")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	iniStr := func(port, size string) string {
+		return `
+[gateway]
+name = ham
+[broker "sango"]
+host = 127.0.0.1
+port = ` + port + `
+queue_dir = ` + dir + `
+queue_max_size = ` + size + `
+`
+	}
+	gw := newReloadGateway(t, iniStr("1883", "10"))
+	defer gw.Shutdown()
+	q := gw.Brokers[0].Queue
+	assert.Nil(q.Push(message.Message{Sender: "dora", Type: "dummy", Body: []byte("hello")}))
+
+	// the queue is taken over
+	conf, err := inidef.LoadConfigByte([]byte(iniStr("1884", "10")))
+	assert.Nil(err)
+	assert.Nil(gw.ReloadConfig(conf))
+	assert.True(q == gw.Brokers[0].Queue)
+
+	// the queue is opened again with the new settings
+	assert.Nil(q.Push(message.Message{Sender: "dora", Type: "dummy", Body: []byte("hello")}))
+	conf, err = inidef.LoadConfigByte([]byte(iniStr("1884", "20")))
+	assert.Nil(err)
+	assert.Nil(gw.ReloadConfig(conf))
+	assert.False(q == gw.Brokers[0].Queue)
+	assert.Equal(20, gw.Brokers[0].Queue.MaxSize)
+	assert.Equal(2, gw.Brokers[0].Queue.Len())
+
+	// the queue of an added broker is opened
+	q = gw.Brokers[0].Queue
+	conf, err = inidef.LoadConfigByte([]byte(iniStr("1884", "20") + `
+[broker "akane"]
+host = 127.0.0.1
+port = 1885
+queue_dir = ` + dir + `
+`))
+	assert.Nil(err)
+	assert.Nil(gw.ReloadConfig(conf))
+	akane := gw.Brokers.Group("akane")[0]
+	assert.Nil(akane.Queue.Push(message.Message{Sender: "dora", Type: "dummy", Body: []byte("hello")}))
+	assert.Equal(1, akane.Queue.Len())
+	assert.True(q == gw.Brokers.Group("sango")[0].Queue)
+}
+
+func TestReloadConfigInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	defer gw.Shutdown()
+	brokers := gw.Brokers
+	devices := gw.Devices
+
+	for _, iniStr := range []string{
+		// unknown device type
+		reloadIni + "[device \"mike/cat\"]\nbroker = sango\n",
+		// invalid broker
+		reloadIni + "[broker \"kuro\"]\nhost = 127.0.0.1\nport = 99999\n",
+		// gateway name is changed
+		"[gateway]\nname = spam\n",
+	} {
+		conf, err := inidef.LoadConfigByte([]byte(iniStr))
+		assert.Nil(err)
+		assert.NotNil(gw.ReloadConfig(conf), iniStr)
+		assert.Equal(brokers, gw.Brokers)
+		assert.Equal(devices, gw.Devices)
+	}
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newReloadGateway(t, reloadIni)
+	defer gw.Shutdown()
+	assert.NotNil(gw.Reload())
+
+	dir, err := ioutil.TempDir("", "fuji-reload")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.ini")
+	assert.Nil(ioutil.WriteFile(path, []byte(reloadIni), 0644))
+	gw.Config.Path = path
+	assert.Nil(gw.Reload())
+	assert.Equal(path, gw.Config.Path)
+	assert.Equal(2, len(gw.Devices))
+}
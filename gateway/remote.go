@@ -0,0 +1,280 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+const (
+	// RemoteCommandTopic is subscribed on the command broker. The last
+	// level of the topic is the command, ex: fuji/ham/$cmd/list_devices
+	RemoteCommandTopic = "{prefix}/{gateway}/$cmd/#"
+
+	DefaultRemoteReplyTopic = "{prefix}/{gateway}/$reply"
+	remoteQoS               = 1
+)
+
+// DefaultRemoteAllowed is the commands allowed if command_allow is not
+// set. These do not change anything.
+var DefaultRemoteAllowed = []CommandType{
+	CmdListDevices,
+	CmdBrokerStatus,
+	CmdStatusReport,
+	CmdGetConfig,
+}
+
+// remoteCommands are the commands which can be allowed. stop is not
+// since nobody can start the gateway again remotely.
+var remoteCommands = []CommandType{
+	CmdReload,
+	CmdPause,
+	CmdResume,
+	CmdListDevices,
+	CmdBrokerStatus,
+	CmdFlushQueue,
+	CmdRestartDevice,
+	CmdSetStatusInterval,
+	CmdStatusReport,
+	CmdGetConfig,
+}
+
+// Remote runs the commands received from the command topic on the broker,
+// and publishes the results to the reply topic.
+type Remote struct {
+	BrokerName string
+	ReplyTopic message.TopicTemplate
+	Allowed    map[CommandType]bool
+
+	topic message.TopicTemplate
+}
+
+// RemoteRequest is the payload of the command message. All fields are
+// optional. ID is returned in the reply to correlate the request.
+type RemoteRequest struct {
+	ID       string `json:"id"`
+	Device   string `json:"device"`
+	Broker   string `json:"broker"`
+	Interval int    `json:"interval"`
+}
+
+// RemoteReply is the payload of the reply message.
+type RemoteReply struct {
+	ID      string          `json:"id,omitempty"`
+	Command CommandType     `json:"command"`
+	OK      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Devices []DeviceInfo    `json:"devices,omitempty"`
+	Brokers []BrokerInfo    `json:"brokers,omitempty"`
+	Config  []RemoteSection `json:"config,omitempty"`
+}
+
+// RemoteSection is a section of the config in the reply of get_config.
+type RemoteSection struct {
+	Type   string            `json:"type"`
+	Name   string            `json:"name,omitempty"`
+	Arg    string            `json:"arg,omitempty"`
+	Values map[string]string `json:"values"`
+}
+
+// NewRemote reads the command settings of the gateway section. Returns
+// nil if command_broker is not set.
+//
+// example:
+//
+//	command_broker = sango
+//	command_allow = list_devices,broker_status,restart_device
+//	command_reply_topic = {prefix}/{gateway}/$reply
+func NewRemote(values map[string]string, conf inidef.Config) (*Remote, error) {
+	bname := values["command_broker"]
+	if bname == "" {
+		return nil, nil
+	}
+	found := false
+	for _, b := range conf.BrokerNames {
+		if b == bname {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("command_broker does not exists: %s", bname)
+	}
+
+	r := &Remote{
+		BrokerName: bname,
+		Allowed:    make(map[CommandType]bool),
+		topic:      message.TopicTemplate(RemoteCommandTopic),
+	}
+
+	reply := DefaultRemoteReplyTopic
+	if v := values["command_reply_topic"]; v != "" {
+		reply = v
+	}
+	tmpl, err := message.ParseTopicTemplate(reply)
+	if err != nil {
+		return nil, fmt.Errorf("command_reply_topic, %v", err)
+	}
+	r.ReplyTopic = tmpl
+
+	allowed := DefaultRemoteAllowed
+	if v, ok := values["command_allow"]; ok {
+		allowed = nil
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				allowed = append(allowed, CommandType(c))
+			}
+		}
+	}
+	for _, c := range allowed {
+		if !isRemoteCommand(c) {
+			return nil, fmt.Errorf("command_allow, unknown command: %s", c)
+		}
+		r.Allowed[c] = true
+	}
+	return r, nil
+}
+
+func isRemoteCommand(c CommandType) bool {
+	for _, rc := range remoteCommands {
+		if rc == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Remote) filter(b *broker.Broker) string {
+	return r.topic.Render(message.TopicVars{
+		Prefix:  b.TopicPrefix,
+		Gateway: b.GatewayName,
+		Broker:  b.Name,
+	})
+}
+
+// AddTo adds the command topic to Subscribed of the command brokers.
+func (r *Remote) AddTo(brokers []*broker.Broker) {
+	for _, b := range brokers {
+		if b.Name != r.BrokerName {
+			continue
+		}
+		f := r.filter(b)
+		log.Infof("subscribe command topic: %#v", f)
+		b.Subscribed.Add(f, remoteQoS)
+	}
+}
+
+// command returns the command of the message if the message is received
+// from the command topic.
+func (r *Remote) command(msg message.Message, brokers broker.Brokers) (CommandType, bool) {
+	if msg.Type != message.TypeSubscribed || msg.Sender != r.BrokerName {
+		return "", false
+	}
+	for _, b := range brokers.Group(r.BrokerName) {
+		f := r.filter(b)
+		if !message.MatchTopic(f, msg.Topic) {
+			continue
+		}
+		return CommandType(strings.TrimPrefix(msg.Topic, strings.TrimSuffix(f, "#"))), true
+	}
+	return "", false
+}
+
+// handleRemote runs the command message if it is allowed and publishes
+// the reply. The command runs by dispatchCommand, so the reply may be
+// published after it returns. Returns false if the message is not a command.
+func (gw *Gateway) handleRemote(msg message.Message) bool {
+	r := gw.Remote
+	if r == nil {
+		return false
+	}
+	gw.lock.RLock()
+	c, ok := r.command(msg, gw.Brokers)
+	gw.lock.RUnlock()
+	if !ok {
+		return false
+	}
+
+	var req RemoteRequest
+	reply := RemoteReply{Command: c}
+	if len(msg.Body) > 0 {
+		if err := json.Unmarshal(msg.Body, &req); err != nil {
+			reply.Error = fmt.Sprintf("invalid request, %v", err)
+		}
+	}
+	reply.ID = req.ID
+
+	if reply.Error == "" && !r.Allowed[c] {
+		reply.Error = fmt.Sprintf("command not allowed: %s", c)
+	}
+	if reply.Error != "" {
+		gw.sendRemoteReply(r, reply)
+		return true
+	}
+
+	log.Infof("remote command comes, %s, id: %s", c, req.ID)
+	gw.dispatchCommand(Command{
+		Type:     c,
+		Device:   req.Device,
+		Broker:   req.Broker,
+		Interval: req.Interval,
+	}, func(ret Result) {
+		if ret.Err != nil {
+			reply.Error = ret.Err.Error()
+		}
+		reply.Devices = ret.Devices
+		reply.Brokers = ret.Brokers
+		for _, s := range ret.Config {
+			reply.Config = append(reply.Config, RemoteSection{
+				Type:   s.Type,
+				Name:   s.Name,
+				Arg:    s.Arg,
+				Values: s.Values,
+			})
+		}
+		gw.sendRemoteReply(r, reply)
+	})
+	return true
+}
+
+// sendRemoteReply publishes the reply of the remote command by r.
+func (gw *Gateway) sendRemoteReply(r *Remote, reply RemoteReply) {
+	c := reply.Command
+	if reply.Error != "" {
+		log.Warnf("remote command failed, %s, id: %s, %s", c, reply.ID, reply.Error)
+	}
+	reply.OK = reply.Error == ""
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		log.Errorf("remote reply marshal error, %v", err)
+		return
+	}
+	gw.publishAsync(message.Message{
+		Sender:        "command",
+		Type:          "reply",
+		BrokerName:    r.BrokerName,
+		QoS:           remoteQoS,
+		Body:          body,
+		TopicTemplate: r.ReplyTopic,
+	})
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// publishAsync publishes the message in a goroutine, and tracks it until
+// it is published or discarded.
+func (gw *Gateway) publishAsync(msg message.Message) {
+	gw.inflight.Add(1)
+	atomic.AddInt64(&gw.inflightN, 1)
+	go func() {
+		defer gw.inflight.Done()
+		defer atomic.AddInt64(&gw.inflightN, -1)
+		gw.Publish(msg)
+	}()
+}
+
+// Shutdown stops the devices, publishes the messages from the devices
+// within ShutdownTimeout, then disconnects the brokers. Returns error
+// which describes the messages not flushed.
+func (gw *Gateway) Shutdown() error {
+	// stop devices first not to receive new messages
+	gw.deviceOps.Wait()
+	for _, d := range gw.Devices {
+		gw.stopDevice(d)
+	}
+
+	// drain messages which devices already sent
+DRAIN:
+	for {
+		select {
+		case msg := <-gw.MsgChan:
+			for _, m := range gw.process(msg) {
+				gw.publishAsync(m)
+			}
+		default:
+			break DRAIN
+		}
+	}
+
+	var problems []string
+	done := make(chan bool)
+	go func() {
+		gw.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(gw.ShutdownTimeout) * time.Second):
+		n := atomic.LoadInt64(&gw.inflightN)
+		problems = append(problems, fmt.Sprintf("%d messages not published in %ds", n, gw.ShutdownTimeout))
+	}
+
+	for _, b := range gw.Brokers {
+		if b.Queue != nil && b.Queue.Len() > 0 {
+			// stored on the disk and sent after restart
+			problems = append(problems, fmt.Sprintf("%d messages left in queue of broker %s(priority %d)", b.Queue.Len(), b.Name, b.Priority))
+		}
+		b.Close()
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("shutdown: %s", strings.Join(problems, ", "))
+	}
+	log.Info("shutdown completed")
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/broker"
+	"github.com/shiguredo/fuji/inidef"
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewGatewayShutdownTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	iniStr := `
+[gateway]
+name = sango
+`
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	gw, err := NewGateway(conf)
+	assert.Nil(err)
+	assert.Equal(DefaultShutdownTimeout, gw.ShutdownTimeout)
+
+	iniStr = `
+[gateway]
+name = sango
+shutdown_timeout = 30
+`
+	conf, err = inidef.LoadConfigByte([]byte(iniStr))
+	gw, err = NewGateway(conf)
+	assert.Nil(err)
+	assert.Equal(30, gw.ShutdownTimeout)
+
+	for _, v := range []string{"-1", "abc"} {
+		conf, err = inidef.LoadConfigByte([]byte("[gateway]\nname = sango\nshutdown_timeout = " + v + "\n"))
+		_, err = NewGateway(conf)
+		assert.NotNil(err, v)
+	}
+}
+
+func newShutdownGateway(t *testing.T, brokerValues string) *Gateway {
+	iniStr := `
+[gateway]
+name = ham
+max_retry_count = 1
+retry_interval = 1
+[broker "sango"]
+host = 127.0.0.1
+port = 1883
+` + brokerValues
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw, err := NewGateway(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw.Brokers, err = broker.NewBrokers(conf, gw.BrokerChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func TestShutdownDrainsMsgChan(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "fuji-shutdown")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	gw := newShutdownGateway(t, "queue_dir = "+dir+"\n")
+	for i := 0; i < 3; i++ {
+		gw.MsgChan <- message.Message{Sender: "dora", Type: "dummy", BrokerName: "sango", Body: []byte("hello")}
+	}
+
+	// broker is not connected, so the messages are queued
+	err = gw.Shutdown()
+	assert.NotNil(err)
+	assert.True(strings.Contains(err.Error(), "3 messages left in queue of broker sango"), err.Error())
+	assert.Equal(0, len(gw.MsgChan))
+	assert.Equal(broker.StateClosed, gw.Brokers[0].State())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newShutdownGateway(t, "")
+	gw.ShutdownTimeout = 0
+	gw.MsgChan <- message.Message{Sender: "dora", Type: "dummy", BrokerName: "sango", Body: []byte("hello")}
+
+	// retried until RetryInterval passes
+	err := gw.Shutdown()
+	assert.NotNil(err)
+	assert.True(strings.Contains(err.Error(), "1 messages not published"), err.Error())
+}
+
+func TestShutdownNothingLeft(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := newShutdownGateway(t, "")
+	assert.Nil(gw.Shutdown())
+}
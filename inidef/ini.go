@@ -74,6 +74,7 @@ func ValidMqttPublishTopic(v interface{}, param string) error {
 }
 
 type Config struct {
+	Path        string // file path loaded from, empty if loaded from bytes
 	GatewayName string
 	BrokerNames []string
 
@@ -107,7 +108,9 @@ func LoadConfig(confPath string) (Config, error) {
 		return Config{}, err
 	}
 
-	return LoadConfigByte(dat)
+	conf, err := LoadConfigByte(dat)
+	conf.Path = confPath
+	return conf, err
 }
 
 // LoadConfigByte returnes []ConfigSection from []byte.
@@ -0,0 +1,111 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+// writeCBOR encodes v in CBOR(RFC 7049). Only the types in the envelope
+// and the values returned by DecodeBody are supported.
+func writeCBOR(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if t {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int:
+		writeCBORInt(buf, int64(t))
+	case int64:
+		writeCBORInt(buf, t)
+	case uint64:
+		writeCBORHead(buf, cborUint, t)
+	case float64:
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+	case string:
+		writeCBORHead(buf, cborText, uint64(len(t)))
+		buf.WriteString(t)
+	case []byte:
+		writeCBORHead(buf, cborBytes, uint64(len(t)))
+		buf.Write(t)
+	case []interface{}:
+		writeCBORHead(buf, cborArray, uint64(len(t)))
+		for _, e := range t {
+			if err := writeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		return writeCBOR(buf, sortedFields(t))
+	case []field:
+		writeCBORHead(buf, cborMap, uint64(len(t)))
+		for _, f := range t {
+			writeCBOR(buf, f.key)
+			if err := writeCBOR(buf, f.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor, unsupported type: %T", v)
+	}
+	return nil
+}
+
+func writeCBORInt(buf *bytes.Buffer, i int64) {
+	if i >= 0 {
+		writeCBORHead(buf, cborUint, uint64(i))
+		return
+	}
+	writeCBORHead(buf, cborNegInt, uint64(-1-i))
+}
+
+// writeCBORHead writes the major type and the argument in the shortest form.
+func writeCBORHead(buf *bytes.Buffer, major byte, n uint64) {
+	m := major << 5
+	switch {
+	case n < 24:
+		buf.WriteByte(m | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(m | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(m | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(m | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(m | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
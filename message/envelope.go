@@ -0,0 +1,142 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Payload formats of the envelope.
+const (
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+	FormatCBOR    = "cbor"
+)
+
+// TimestampFormat is the format of the timestamp in the envelope. It is
+// always in UTC and has fixed width, so it can be sorted as a string.
+const TimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Envelope wraps the body of the message with where and when it is read.
+type Envelope struct {
+	Gateway   string
+	Device    string
+	Type      string
+	Timestamp time.Time
+	Seq       uint64
+	Body      interface{} // []byte, or the value returned by DecodeBody
+}
+
+// ContentType returns the MIME type of the format.
+func ContentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatMsgpack:
+		return "application/msgpack"
+	case FormatCBOR:
+		return "application/cbor"
+	}
+	return ""
+}
+
+// ValidFormat returns true if the format is supported.
+func ValidFormat(format string) bool {
+	return ContentType(format) != ""
+}
+
+// DecodeBody returns the value of the body. If the body is JSON, returns
+// the decoded value, ex: 20.5 or {"temp": 20.5}. Otherwise returns the
+// body as a string. Returns error if the body is not UTF-8.
+func DecodeBody(body []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err == nil && !d.More() {
+		return numbers(v), nil
+	}
+	if !utf8.Valid(body) {
+		return nil, fmt.Errorf("body is not UTF-8")
+	}
+	return string(body), nil
+}
+
+// numbers converts json.Number in v to int64 or float64.
+func numbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case []interface{}:
+		for i := range t {
+			t[i] = numbers(t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = numbers(t[k])
+		}
+	}
+	return v
+}
+
+// fields returns the fields of the envelope in order.
+func (e Envelope) fields() []field {
+	return []field{
+		{"gateway", e.Gateway},
+		{"device", e.Device},
+		{"type", e.Type},
+		{"timestamp", e.Timestamp.UTC().Format(TimestampFormat)},
+		{"seq", e.Seq},
+		{"body", e.Body},
+	}
+}
+
+// Marshal encodes the envelope in the format. []byte body is encoded as
+// base64 in JSON, and as binary in msgpack and cbor.
+func (e Envelope) Marshal(format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(struct {
+			Gateway   string      `json:"gateway"`
+			Device    string      `json:"device"`
+			Type      string      `json:"type"`
+			Timestamp string      `json:"timestamp"`
+			Seq       uint64      `json:"seq"`
+			Body      interface{} `json:"body"`
+		}{e.Gateway, e.Device, e.Type, e.Timestamp.UTC().Format(TimestampFormat), e.Seq, e.Body})
+	case FormatMsgpack:
+		var buf bytes.Buffer
+		err := writeMsgpack(&buf, e.fields())
+		return buf.Bytes(), err
+	case FormatCBOR:
+		var buf bytes.Buffer
+		err := writeCBOR(&buf, e.fields())
+		return buf.Bytes(), err
+	}
+	return nil, fmt.Errorf("unknown payload format: %s", format)
+}
+
+// field is a key and value of a map which keeps the order.
+type field struct {
+	key   string
+	value interface{}
+}
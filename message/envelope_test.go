@@ -0,0 +1,168 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testEnvelope = Envelope{
+	Gateway:   "ham",
+	Device:    "dora",
+	Type:      "temp",
+	Timestamp: time.Date(2015, 6, 1, 21, 34, 56, 789000000, time.FixedZone("JST", 9*60*60)),
+	Seq:       300,
+	Body:      []byte("20.5"),
+}
+
+func TestEnvelopeJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	buf, err := testEnvelope.Marshal(FormatJSON)
+	assert.Nil(err)
+	assert.Equal(`{"gateway":"ham","device":"dora","type":"temp","timestamp":"2015-06-01T12:34:56.789Z","seq":300,"body":"MjAuNQ=="}`, string(buf))
+
+	e := testEnvelope
+	e.Body, err = DecodeBody([]byte("20.5"))
+	assert.Nil(err)
+	buf, err = e.Marshal(FormatJSON)
+	assert.Nil(err)
+	assert.Contains(string(buf), `"body":20.5}`)
+
+	_, err = e.Marshal("xml")
+	assert.NotNil(err)
+}
+
+func TestDecodeBody(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		body string
+		v    interface{}
+	}{
+		{"20", int64(20)},
+		{"-20.5", -20.5},
+		{" true\n", true},
+		{`{"t": 1, "h": [2.5, null]}`, map[string]interface{}{"t": int64(1), "h": []interface{}{2.5, nil}}},
+		{"hello", "hello"},
+		{"1 2", "1 2"},
+		{"", ""},
+	} {
+		v, err := DecodeBody([]byte(c.body))
+		assert.Nil(err, c.body)
+		assert.Equal(c.v, v, c.body)
+	}
+	_, err := DecodeBody([]byte{0xff, 0xfe})
+	assert.NotNil(err)
+}
+
+func encodeHex(t *testing.T, format string, v interface{}) string {
+	var buf bytes.Buffer
+	var err error
+	if format == FormatMsgpack {
+		err = writeMsgpack(&buf, v)
+	} else {
+		err = writeCBOR(&buf, v)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(buf.Bytes())
+}
+
+func TestMsgpack(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		v   interface{}
+		hex string
+	}{
+		{nil, "c0"},
+		{true, "c3"},
+		{int64(0), "00"},
+		{int64(127), "7f"},
+		{int64(128), "cc80"},
+		{int64(256), "cd0100"},
+		{int64(70000), "ce00011170"},
+		{int64(-1), "ff"},
+		{int64(-32), "e0"},
+		{int64(-33), "d0df"},
+		{int64(-200), "d1ff38"},
+		{uint64(1) << 32, "cf0000000100000000"},
+		{1.5, "cb3ff8000000000000"},
+		{"a", "a161"},
+		{string(make([]byte, 32)), "d920" + hex.EncodeToString(make([]byte, 32))},
+		{[]byte{1, 2}, "c4020102"},
+		{[]interface{}{int64(1), "a"}, "9201a161"},
+		{map[string]interface{}{"b": int64(2), "a": int64(1)}, "82a16101a16202"},
+	} {
+		assert.Equal(c.hex, encodeHex(t, FormatMsgpack, c.v), "%#v", c.v)
+	}
+
+	buf, err := testEnvelope.Marshal(FormatMsgpack)
+	assert.Nil(err)
+	assert.Equal("86"+
+		"a7"+hex.EncodeToString([]byte("gateway"))+"a3"+hex.EncodeToString([]byte("ham"))+
+		"a6"+hex.EncodeToString([]byte("device"))+"a4"+hex.EncodeToString([]byte("dora"))+
+		"a4"+hex.EncodeToString([]byte("type"))+"a4"+hex.EncodeToString([]byte("temp"))+
+		"a9"+hex.EncodeToString([]byte("timestamp"))+"b8"+hex.EncodeToString([]byte("2015-06-01T12:34:56.789Z"))+
+		"a3"+hex.EncodeToString([]byte("seq"))+"cd012c"+
+		"a4"+hex.EncodeToString([]byte("body"))+"c404"+hex.EncodeToString([]byte("20.5")),
+		hex.EncodeToString(buf))
+}
+
+func TestCBOR(t *testing.T) {
+	assert := assert.New(t)
+
+	// examples of RFC 7049 Appendix A
+	for _, c := range []struct {
+		v   interface{}
+		hex string
+	}{
+		{nil, "f6"},
+		{false, "f4"},
+		{int64(0), "00"},
+		{int64(23), "17"},
+		{int64(24), "1818"},
+		{int64(1000), "1903e8"},
+		{int64(1000000), "1a000f4240"},
+		{uint64(1000000000000), "1b000000e8d4a51000"},
+		{int64(-1), "20"},
+		{int64(-100), "3863"},
+		{1.1, "fb3ff199999999999a"},
+		{"IETF", "6449455446"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]interface{}{int64(1), int64(2), int64(3)}, "83010203"},
+		{map[string]interface{}{"b": []interface{}{int64(2), int64(3)}, "a": int64(1)}, "a26161016162820203"},
+	} {
+		assert.Equal(c.hex, encodeHex(t, FormatCBOR, c.v), "%#v", c.v)
+	}
+
+	buf, err := testEnvelope.Marshal(FormatCBOR)
+	assert.Nil(err)
+	assert.Equal("a6"+
+		"67"+hex.EncodeToString([]byte("gateway"))+"63"+hex.EncodeToString([]byte("ham"))+
+		"66"+hex.EncodeToString([]byte("device"))+"64"+hex.EncodeToString([]byte("dora"))+
+		"64"+hex.EncodeToString([]byte("type"))+"64"+hex.EncodeToString([]byte("temp"))+
+		"69"+hex.EncodeToString([]byte("timestamp"))+"7818"+hex.EncodeToString([]byte("2015-06-01T12:34:56.789Z"))+
+		"63"+hex.EncodeToString([]byte("seq"))+"19012c"+
+		"64"+hex.EncodeToString([]byte("body"))+"44"+hex.EncodeToString([]byte("20.5")),
+		hex.EncodeToString(buf))
+}
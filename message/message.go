@@ -14,21 +14,39 @@
 
 package message
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Message represents a message in the Fuji package.
 type Message struct {
 	Sender     string `validate:"max=256,validtopic"`
+	SenderType string // device type of the sender, ex: serial
 	Type       string `validate:"max=256,validtopic"`
 	Body       []byte
 	QoS        byte
 	Retained   bool
 	BrokerName string
 	Topic      string
+
+	SenderPriority int // priority of the broker which received the subscribed message
+
+	TopicTemplate TopicTemplate // overrides the template of the broker if set
+	Seq           uint64        // sequence number on the broker, set by Broker.Publish
+	Timestamp     time.Time     // when the device read the body
+
+	// MQTT 5.0 publish properties. These are ignored on MQTT 3.1.1.
+	ContentType    string
+	MessageExpiry  uint32 // sec, 0 means never expire
+	ResponseTopic  string
+	UserProperties map[string]string
 }
 
 var (
 	TypeSubscribed = "subscribed"
+	TypeBridged    = "bridged" // relayed by a bridge
+	TypeEvent      = "event"   // state change of the device, ex: serial port offline
 )
 
 func (m Message) String() string {
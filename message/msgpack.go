@@ -0,0 +1,162 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// writeMsgpack encodes v in MessagePack. Only the types in the envelope
+// and the values returned by DecodeBody are supported.
+func writeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if t {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		writeMsgpackInt(buf, int64(t))
+	case int64:
+		writeMsgpackInt(buf, t)
+	case uint64:
+		writeMsgpackUint(buf, t)
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(t))
+	case string:
+		n := len(t)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		default:
+			writeMsgpackLen(buf, 0xda, n)
+		}
+		buf.WriteString(t)
+	case []byte:
+		n := len(t)
+		if n <= math.MaxUint8 {
+			buf.WriteByte(0xc4)
+			buf.WriteByte(byte(n))
+		} else {
+			writeMsgpackLen(buf, 0xc5, n)
+		}
+		buf.Write(t)
+	case []interface{}:
+		if n := len(t); n < 16 {
+			buf.WriteByte(0x90 | byte(n))
+		} else {
+			writeMsgpackLen(buf, 0xdc, n)
+		}
+		for _, e := range t {
+			if err := writeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		return writeMsgpack(buf, sortedFields(t))
+	case []field:
+		if n := len(t); n < 16 {
+			buf.WriteByte(0x80 | byte(n))
+		} else {
+			writeMsgpackLen(buf, 0xde, n)
+		}
+		for _, f := range t {
+			writeMsgpack(buf, f.key)
+			if err := writeMsgpack(buf, f.value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack, unsupported type: %T", v)
+	}
+	return nil
+}
+
+// writeMsgpackLen writes the 16 bit code, or the 32 bit code which
+// follows it, and the length.
+func writeMsgpackLen(buf *bytes.Buffer, code16 byte, n int) {
+	if n <= math.MaxUint16 {
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+		return
+	}
+	buf.WriteByte(code16 + 1)
+	binary.Write(buf, binary.BigEndian, uint32(n))
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u < 128:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+// sortedFields returns the fields of the map sorted by the keys.
+func sortedFields(m map[string]interface{}) []field {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]field, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, field{k, m[k]})
+	}
+	return fields
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	matched := [][2]string{
+		{"sport/tennis/player1", "sport/tennis/player1"},
+		{"sport/#", "sport"},
+		{"sport/#", "sport/tennis/player1"},
+		{"#", "sport/tennis"},
+		{"sport/+/player1", "sport/tennis/player1"},
+		{"+/+", "/finance"},
+		{"+", "sport"},
+		{"$SYS/#", "$SYS/broker"},
+	}
+	for _, c := range matched {
+		assert.True(MatchTopic(c[0], c[1]), c[0]+" "+c[1])
+	}
+
+	unmatched := [][2]string{
+		{"sport/tennis", "sport/tennis/player1"},
+		{"sport/+", "sport/tennis/player1"},
+		{"sport/+/player1", "sport/player1"},
+		{"+", "/finance"},
+		{"#", "$SYS/broker"},
+		{"+/broker", "$SYS/broker"},
+	}
+	for _, c := range unmatched {
+		assert.False(MatchTopic(c[0], c[1]), c[0]+" "+c[1])
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, f := range []string{"#", "+", "sport/#", "sport/+/player1", "/+"} {
+		assert.True(ValidTopicFilter(f), f)
+	}
+	for _, f := range []string{"", "sport#", "sport/#/ranking", "sport+", "sport/tennis#"} {
+		assert.False(ValidTopicFilter(f), f)
+	}
+}
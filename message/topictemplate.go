@@ -0,0 +1,138 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultTopicTemplate is used if neither the broker nor the device
+	// has a topic template.
+	DefaultTopicTemplate = "{prefix}/{gateway}/{device}/{type}"
+	// StatusTopicTemplate is used for the messages of the status device
+	// if the broker does not have a topic template. The status device sets
+	// the topic under the prefix by itself.
+	StatusTopicTemplate = "{prefix}/{topic}"
+	// BridgedTopicTemplate publishes the topic rewritten by the bridge as is.
+	BridgedTopicTemplate = "{topic}"
+)
+
+var topicPlaceholders = []string{
+	"prefix",  // topic_prefix of the broker
+	"gateway", // gateway name
+	"device",  // sender of the message
+	"type",    // type of the message
+	"broker",  // broker name
+	"seq",     // sequence number of the message on the broker
+	"topic",   // topic of the message
+}
+
+// TopicTemplate is a topic which has placeholders, ex: {prefix}/{gateway}/{device}.
+type TopicTemplate string
+
+// TopicVars are values of the placeholders.
+type TopicVars struct {
+	Prefix  string
+	Gateway string
+	Device  string
+	Type    string
+	Broker  string
+	Seq     uint64
+	Topic   string
+}
+
+// ParseTopicTemplate returns error if the template has an unknown
+// placeholder, an unbalanced brace or a wildcard.
+func ParseTopicTemplate(s string) (TopicTemplate, error) {
+	if err := checkPlaceholders(s); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(s, "+#") {
+		return "", fmt.Errorf("topic template should not include wildcard: %s", s)
+	}
+	return TopicTemplate(s), nil
+}
+
+// ParseTopicFilterTemplate parses a topic filter which has placeholders,
+// ex: {prefix}/{gateway}/+/cmd. Wildcards are allowed but must occupy an
+// entire level.
+func ParseTopicFilterTemplate(s string) (TopicTemplate, error) {
+	if err := checkPlaceholders(s); err != nil {
+		return "", err
+	}
+	// placeholders never be wildcards, so check with any values
+	filter := TopicTemplate(s).Render(TopicVars{
+		Prefix:  "prefix",
+		Gateway: "gateway",
+		Device:  "device",
+		Type:    "type",
+		Broker:  "broker",
+		Topic:   "topic",
+	})
+	if !ValidTopicFilter(filter) {
+		return "", fmt.Errorf("invalid topic filter: %s", s)
+	}
+	return TopicTemplate(s), nil
+}
+
+// checkPlaceholders returns error if s has an unknown placeholder or an
+// unbalanced brace.
+func checkPlaceholders(s string) error {
+	rest := s
+	for {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			return nil
+		}
+		if rest[open] == '}' {
+			return fmt.Errorf("unbalanced '}' in topic template: %s", s)
+		}
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return fmt.Errorf("unbalanced '{' in topic template: %s", s)
+		}
+		name := rest[open+1 : open+1+end]
+		if !validPlaceholder(name) {
+			return fmt.Errorf("unknown placeholder {%s} in topic template: %s", name, s)
+		}
+		rest = rest[open+1+end+1:]
+	}
+}
+
+func validPlaceholder(name string) bool {
+	for _, p := range topicPlaceholders {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Render returns the topic which the placeholders are replaced with vars.
+func (t TopicTemplate) Render(vars TopicVars) string {
+	r := strings.NewReplacer(
+		"{prefix}", vars.Prefix,
+		"{gateway}", vars.Gateway,
+		"{device}", vars.Device,
+		"{type}", vars.Type,
+		"{broker}", vars.Broker,
+		"{seq}", strconv.FormatUint(vars.Seq, 10),
+		"{topic}", vars.Topic,
+	)
+	return r.Replace(string(t))
+}
@@ -0,0 +1,98 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTopicTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	valids := []string{
+		"",
+		"fixed/topic",
+		DefaultTopicTemplate,
+		StatusTopicTemplate,
+		"{prefix}/devices/{device}/events/{type}/{seq}",
+		"{broker}-{gateway}",
+	}
+	for _, v := range valids {
+		tmpl, err := ParseTopicTemplate(v)
+		assert.Nil(err, v)
+		assert.Equal(TopicTemplate(v), tmpl)
+	}
+
+	invalids := []string{
+		"{prefix}/{unknown}",
+		"{prefix",
+		"prefix}",
+		"{{prefix}}",
+		"{prefix}/+/{device}",
+		"{prefix}/#",
+	}
+	for _, v := range invalids {
+		_, err := ParseTopicTemplate(v)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestParseTopicFilterTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	valids := []string{
+		"fixed/topic",
+		"#",
+		"{prefix}/{gateway}/{device}",
+		"{prefix}/{gateway}/+/cmd",
+		"{prefix}/{gateway}/#",
+	}
+	for _, v := range valids {
+		tmpl, err := ParseTopicFilterTemplate(v)
+		assert.Nil(err, v)
+		assert.Equal(TopicTemplate(v), tmpl)
+	}
+
+	invalids := []string{
+		"",
+		"{prefix}/{unknown}/#",
+		"{prefix}/#/cmd",
+		"{prefix}/{device}+",
+		"{prefix}/{device}#",
+	}
+	for _, v := range invalids {
+		_, err := ParseTopicFilterTemplate(v)
+		assert.NotNil(err, v)
+	}
+}
+
+func TestTopicTemplateRender(t *testing.T) {
+	assert := assert.New(t)
+
+	vars := TopicVars{
+		Prefix:  "prefix",
+		Gateway: "ham",
+		Device:  "dora",
+		Type:    "dummy",
+		Broker:  "sango",
+		Seq:     42,
+		Topic:   "$SYS/gateway/ham/cpu",
+	}
+	assert.Equal("prefix/ham/dora/dummy", TopicTemplate(DefaultTopicTemplate).Render(vars))
+	assert.Equal("prefix/$SYS/gateway/ham/cpu", TopicTemplate(StatusTopicTemplate).Render(vars))
+	assert.Equal("sango/devices/dora/42", TopicTemplate("{broker}/devices/{device}/{seq}").Render(vars))
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"fmt"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// Body modes of the envelope.
+const (
+	BodyBytes = "bytes" // base64 in JSON, binary in msgpack and cbor
+	BodyValue = "value" // decoded JSON value, or string
+)
+
+// Envelope wraps the payload with the gateway name, the device name, the
+// type, the capture timestamp and the sequence number of the device. It
+// is added to the end of the pipeline of the device which sets
+// payload_format.
+type Envelope struct {
+	Gateway string
+	Format  string
+	Body    string
+
+	seq uint64
+}
+
+// NewEnvelope reads payload_format and payload_body of the device section.
+// Returns nil if payload_format is not set.
+//
+// example:
+//
+//	payload_format = json
+//	payload_body = value
+func NewEnvelope(gateway string, values map[string]string) (*Envelope, error) {
+	format := values["payload_format"]
+	if format == "" || format == "raw" {
+		return nil, nil
+	}
+	if !message.ValidFormat(format) {
+		return nil, fmt.Errorf("invalid payload_format: %s", format)
+	}
+	s := &Envelope{Gateway: gateway, Format: format, Body: BodyBytes}
+	if v, ok := values["payload_body"]; ok {
+		if v != BodyBytes && v != BodyValue {
+			return nil, fmt.Errorf("invalid payload_body: %s", v)
+		}
+		s.Body = v
+	}
+	return s, nil
+}
+
+func (s *Envelope) Process(msg message.Message) ([]message.Message, error) {
+	e := message.Envelope{
+		Gateway:   s.Gateway,
+		Device:    msg.Sender,
+		Type:      msg.Type,
+		Timestamp: msg.Timestamp,
+		Body:      msg.Body,
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = now()
+	}
+	if s.Body == BodyValue {
+		v, err := message.DecodeBody(msg.Body)
+		if err != nil {
+			return nil, fmt.Errorf("payload_body, %v", err)
+		}
+		e.Body = v
+	}
+	s.seq++
+	e.Seq = s.seq
+
+	body, err := e.Marshal(s.Format)
+	if err != nil {
+		return nil, err
+	}
+	msg.Body = body
+	if msg.ContentType == "" {
+		msg.ContentType = message.ContentType(s.Format)
+	}
+	return []message.Message{msg}, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+func TestNewEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewEnvelope("ham", map[string]string{})
+	assert.Nil(err)
+	assert.Nil(s)
+	s, err = NewEnvelope("ham", map[string]string{"payload_format": "raw"})
+	assert.Nil(err)
+	assert.Nil(s)
+
+	s, err = NewEnvelope("ham", map[string]string{"payload_format": "cbor"})
+	assert.Nil(err)
+	assert.Equal(&Envelope{Gateway: "ham", Format: message.FormatCBOR, Body: BodyBytes}, s)
+
+	for _, values := range []map[string]string{
+		{"payload_format": "xml"},
+		{"payload_format": "json", "payload_body": "hex"},
+	} {
+		_, err = NewEnvelope("ham", values)
+		assert.NotNil(err, "%v", values)
+	}
+}
+
+func TestEnvelopeProcess(t *testing.T) {
+	assert := assert.New(t)
+	c, restore := setClock()
+	defer restore()
+
+	s, err := NewEnvelope("ham", map[string]string{"payload_format": "json", "payload_body": "value"})
+	assert.Nil(err)
+
+	captured := time.Date(2015, 6, 1, 12, 34, 56, 0, time.UTC)
+	for i, m := range []message.Message{
+		{Sender: "dora", Type: "temp", Body: []byte("20.5"), Timestamp: captured},
+		{Sender: "dora", Type: "temp", Body: []byte("21")}, // without timestamp
+	} {
+		msgs, err := s.Process(m)
+		assert.Nil(err)
+		assert.Equal(1, len(msgs))
+		assert.Equal("application/json", msgs[0].ContentType)
+
+		var e map[string]interface{}
+		assert.Nil(json.Unmarshal(msgs[0].Body, &e))
+		assert.Equal("ham", e["gateway"])
+		assert.Equal("dora", e["device"])
+		assert.Equal("temp", e["type"])
+		assert.Equal(float64(i+1), e["seq"])
+		if i == 0 {
+			assert.Equal("2015-06-01T12:34:56.000Z", e["timestamp"])
+			assert.Equal(20.5, e["body"])
+		} else {
+			assert.Equal(c.now().UTC().Format(message.TimestampFormat), e["timestamp"])
+			assert.Equal(float64(21), e["body"])
+		}
+	}
+
+	// content_type of the device is kept
+	msgs, err := s.Process(message.Message{Body: []byte("1"), ContentType: "application/vnd.ham+json"})
+	assert.Nil(err)
+	assert.Equal("application/vnd.ham+json", msgs[0].ContentType)
+
+	_, err = s.Process(message.Message{Body: []byte{0xff}})
+	assert.NotNil(err)
+}
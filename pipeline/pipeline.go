@@ -0,0 +1,111 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// pipeline processes the messages from the devices before they are
+// published.
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// Stage processes a message. It returns the messages to pass to the next
+// stage, so it can drop the message by returning no message, or fan it out
+// into several messages. If it returns error, the message is dropped.
+type Stage interface {
+	Process(msg message.Message) ([]message.Message, error)
+}
+
+// Factory makes a stage from the values of the device section.
+type Factory func(values map[string]string) (Stage, error)
+
+var factories = map[string]Factory{}
+
+// Register adds the stage which can be used in the pipeline key. It is
+// intended to be called from init of the package which has the stage.
+// Register panics if the name is already registered.
+func Register(name string, f Factory) {
+	if _, ok := factories[name]; ok {
+		panic(fmt.Sprintf("pipeline stage already registered: %s", name))
+	}
+	factories[name] = f
+}
+
+// Names returns the names of the registered stages.
+func Names() []string {
+	var ret []string
+	for name := range factories {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Pipeline chains the stages in order.
+type Pipeline []Stage
+
+// New makes the pipeline from the values of the device section. pipeline
+// is comma separated stage names, and each stage reads its own keys.
+// Returns nil if pipeline is not set.
+//
+// example:
+//
+//	pipeline = strip, deadband, throttle
+//	strip_prefix = T=
+//	deadband = 0.5
+//	throttle_interval = 10
+func New(values map[string]string) (Pipeline, error) {
+	var p Pipeline
+	for _, name := range strings.Split(values["pipeline"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := factories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline stage: %s", name)
+		}
+		stage, err := f(values)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %s, %v", name, err)
+		}
+		p = append(p, stage)
+	}
+	return p, nil
+}
+
+// Process passes the message through all stages. Each message returned
+// from a stage is passed to the next stage.
+func (p Pipeline) Process(msg message.Message) ([]message.Message, error) {
+	msgs := []message.Message{msg}
+	for _, stage := range p {
+		var next []message.Message
+		for _, m := range msgs {
+			out, err := stage.Process(m)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		if len(next) == 0 {
+			return nil, nil
+		}
+		msgs = next
+	}
+	return msgs, nil
+}
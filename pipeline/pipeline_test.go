@@ -0,0 +1,126 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// upper is a stage registered by a test like a plugin.
+type upper struct{}
+
+func (upper) Process(msg message.Message) ([]message.Message, error) {
+	msg.Body = []byte(strings.ToUpper(string(msg.Body)))
+	return []message.Message{msg}, nil
+}
+
+func init() {
+	Register("upper", func(values map[string]string) (Stage, error) {
+		return upper{}, nil
+	})
+}
+
+func bodies(msgs []message.Message) []string {
+	var ret []string
+	for _, m := range msgs {
+		ret = append(ret, string(m.Body))
+	}
+	return ret
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := New(map[string]string{})
+	assert.Nil(err)
+	assert.Nil(p)
+
+	p, err = New(map[string]string{"pipeline": "strip, upper", "strip_prefix": "T="})
+	assert.Nil(err)
+	assert.Equal(2, len(p))
+
+	_, err = New(map[string]string{"pipeline": "unknown"})
+	assert.NotNil(err)
+	_, err = New(map[string]string{"pipeline": "throttle"})
+	assert.NotNil(err)
+	_, err = New(map[string]string{"pipeline": "deadband", "deadband": "abc"})
+	assert.NotNil(err)
+
+	assert.Contains(Names(), "dedup")
+	assert.Contains(Names(), "upper")
+}
+
+func TestRegisterTwice(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Panics(func() {
+		Register("upper", func(values map[string]string) (Stage, error) {
+			return upper{}, nil
+		})
+	})
+}
+
+func TestPipelineProcess(t *testing.T) {
+	assert := assert.New(t)
+
+	// stages run in config order
+	p, err := New(map[string]string{"pipeline": "split, strip, upper", "strip_prefix": "t="})
+	assert.Nil(err)
+	msgs, err := p.Process(message.Message{Body: []byte("t=1,t=2,,x")})
+	assert.Nil(err)
+	assert.Equal([]string{"1", "2", "X"}, bodies(msgs))
+
+	p, err = New(map[string]string{"pipeline": "upper, strip", "strip_prefix": "t="})
+	assert.Nil(err)
+	msgs, err = p.Process(message.Message{Body: []byte("t=1")})
+	assert.Nil(err)
+	assert.Equal([]string{"T=1"}, bodies(msgs))
+
+	// dropped by the first stage
+	p, err = New(map[string]string{"pipeline": "dedup, upper"})
+	assert.Nil(err)
+	msgs, err = p.Process(message.Message{Body: []byte("a")})
+	assert.Equal([]string{"A"}, bodies(msgs))
+	msgs, err = p.Process(message.Message{Body: []byte("a")})
+	assert.Nil(err)
+	assert.Nil(msgs)
+
+	// error drops the message
+	p, err = New(map[string]string{"pipeline": "deadband"})
+	assert.Nil(err)
+	msgs, err = p.Process(message.Message{Body: []byte("abc")})
+	assert.NotNil(err)
+	assert.Nil(msgs)
+}
+
+func ExamplePipeline_Process() {
+	p, _ := New(map[string]string{
+		"pipeline":     "split, strip",
+		"strip_prefix": "temp=",
+	})
+	msgs, _ := p.Process(message.Message{Body: []byte("temp=20,temp=21")})
+	for _, m := range msgs {
+		fmt.Println(string(m.Body))
+	}
+	// Output:
+	// 20
+	// 21
+}
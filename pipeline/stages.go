@@ -0,0 +1,232 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+func init() {
+	Register("dedup", NewDedup)
+	Register("deadband", NewDeadband)
+	Register("throttle", NewThrottle)
+	Register("strip", NewStrip)
+	Register("rewrite", NewRewrite)
+	Register("split", NewSplit)
+}
+
+// key identifies the stream of the messages in a device.
+func key(msg message.Message) string {
+	return msg.Type + "/" + msg.Topic
+}
+
+// parseSec parses the value in seconds. Fractions are allowed.
+func parseSec(values map[string]string, k string) (time.Duration, error) {
+	v, ok := values[k]
+	if !ok {
+		return 0, nil
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", k, v)
+	}
+	return time.Duration(sec * float64(time.Second)), nil
+}
+
+// Dedup drops the message which has the same payload as the previous one
+// within Window. If Window is 0, drops while the payload is not changed.
+type Dedup struct {
+	Window time.Duration
+
+	last map[string]dedupEntry
+}
+
+type dedupEntry struct {
+	body []byte
+	at   time.Time
+}
+
+// NewDedup reads dedup_window in seconds.
+func NewDedup(values map[string]string) (Stage, error) {
+	window, err := parseSec(values, "dedup_window")
+	if err != nil {
+		return nil, err
+	}
+	return &Dedup{Window: window, last: make(map[string]dedupEntry)}, nil
+}
+
+func (s *Dedup) Process(msg message.Message) ([]message.Message, error) {
+	k := key(msg)
+	t := now()
+	if last, ok := s.last[k]; ok && bytes.Equal(last.body, msg.Body) {
+		if s.Window == 0 || t.Sub(last.at) < s.Window {
+			return nil, nil
+		}
+	}
+	s.last[k] = dedupEntry{body: msg.Body, at: t}
+	return []message.Message{msg}, nil
+}
+
+// Deadband drops the message whose numeric payload differs from the last
+// passed value less than Band. If Band is 0, drops while the value is
+// not changed.
+type Deadband struct {
+	Band float64
+
+	last map[string]float64
+}
+
+// NewDeadband reads deadband.
+func NewDeadband(values map[string]string) (Stage, error) {
+	s := &Deadband{last: make(map[string]float64)}
+	if v, ok := values["deadband"]; ok {
+		band, err := strconv.ParseFloat(v, 64)
+		if err != nil || band < 0 {
+			return nil, fmt.Errorf("invalid deadband: %s", v)
+		}
+		s.Band = band
+	}
+	return s, nil
+}
+
+func (s *Deadband) Process(msg message.Message) ([]message.Message, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(msg.Body)), 64)
+	if err != nil {
+		return nil, fmt.Errorf("deadband, payload is not a number: %q", msg.Body)
+	}
+	k := key(msg)
+	if last, ok := s.last[k]; ok {
+		diff := math.Abs(v - last)
+		if diff == 0 || diff < s.Band {
+			return nil, nil
+		}
+	}
+	s.last[k] = v
+	return []message.Message{msg}, nil
+}
+
+// Throttle passes at most one message in Interval.
+type Throttle struct {
+	Interval time.Duration
+
+	last map[string]time.Time
+}
+
+// NewThrottle reads throttle_interval in seconds.
+func NewThrottle(values map[string]string) (Stage, error) {
+	interval, err := parseSec(values, "throttle_interval")
+	if err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		return nil, fmt.Errorf("throttle_interval is required")
+	}
+	return &Throttle{Interval: interval, last: make(map[string]time.Time)}, nil
+}
+
+func (s *Throttle) Process(msg message.Message) ([]message.Message, error) {
+	k := key(msg)
+	t := now()
+	if last, ok := s.last[k]; ok && t.Sub(last) < s.Interval {
+		return nil, nil
+	}
+	s.last[k] = t
+	return []message.Message{msg}, nil
+}
+
+// Strip removes Prefix and Suffix from the payload if it has them.
+type Strip struct {
+	Prefix []byte
+	Suffix []byte
+}
+
+// NewStrip reads strip_prefix and strip_suffix.
+func NewStrip(values map[string]string) (Stage, error) {
+	s := &Strip{
+		Prefix: []byte(values["strip_prefix"]),
+		Suffix: []byte(values["strip_suffix"]),
+	}
+	if len(s.Prefix) == 0 && len(s.Suffix) == 0 {
+		return nil, fmt.Errorf("strip_prefix or strip_suffix is required")
+	}
+	return s, nil
+}
+
+func (s *Strip) Process(msg message.Message) ([]message.Message, error) {
+	msg.Body = bytes.TrimSuffix(bytes.TrimPrefix(msg.Body, s.Prefix), s.Suffix)
+	return []message.Message{msg}, nil
+}
+
+// Rewrite changes the topic template of the message.
+type Rewrite struct {
+	Topic message.TopicTemplate
+}
+
+// NewRewrite reads rewrite_topic which is a topic template, ex:
+// {prefix}/{gateway}/sensors/{device}
+func NewRewrite(values map[string]string) (Stage, error) {
+	v := values["rewrite_topic"]
+	if v == "" {
+		return nil, fmt.Errorf("rewrite_topic is required")
+	}
+	tmpl, err := message.ParseTopicTemplate(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Rewrite{Topic: tmpl}, nil
+}
+
+func (s *Rewrite) Process(msg message.Message) ([]message.Message, error) {
+	msg.TopicTemplate = s.Topic
+	return []message.Message{msg}, nil
+}
+
+// Split fans out the message into a message for each part of the payload
+// separated by Delimiter. Empty parts are dropped.
+type Split struct {
+	Delimiter []byte
+}
+
+// NewSplit reads split_delimiter. Default is ",".
+func NewSplit(values map[string]string) (Stage, error) {
+	d := values["split_delimiter"]
+	if d == "" {
+		d = ","
+	}
+	return &Split{Delimiter: []byte(d)}, nil
+}
+
+func (s *Split) Process(msg message.Message) ([]message.Message, error) {
+	var ret []message.Message
+	for _, part := range bytes.Split(msg.Body, s.Delimiter) {
+		if len(part) == 0 {
+			continue
+		}
+		m := msg
+		m.Body = part
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji/message"
+)
+
+// clock replaces now in the test.
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) add(d time.Duration) { c.t = c.t.Add(d) }
+
+// setClock replaces now. Call the returned func to restore it.
+func setClock() (*clock, func()) {
+	c := &clock{t: time.Unix(1500000000, 0)}
+	now = c.now
+	return c, func() { now = time.Now }
+}
+
+func process(t *testing.T, s Stage, body string) []string {
+	msgs, err := s.Process(message.Message{Body: []byte(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bodies(msgs)
+}
+
+func TestDedup(t *testing.T) {
+	assert := assert.New(t)
+	c, restore := setClock()
+	defer restore()
+
+	s, err := NewDedup(map[string]string{})
+	assert.Nil(err)
+	assert.Equal([]string{"a"}, process(t, s, "a"))
+	c.add(time.Hour)
+	assert.Nil(process(t, s, "a"))
+	assert.Equal([]string{"b"}, process(t, s, "b"))
+	assert.Equal([]string{"a"}, process(t, s, "a"))
+
+	s, err = NewDedup(map[string]string{"dedup_window": "10"})
+	assert.Nil(err)
+	assert.Equal([]string{"a"}, process(t, s, "a"))
+	c.add(5 * time.Second)
+	assert.Nil(process(t, s, "a"))
+	c.add(5 * time.Second)
+	assert.Equal([]string{"a"}, process(t, s, "a"))
+
+	// streams are separated by the type and the topic
+	msgs, err := s.Process(message.Message{Type: "temp", Body: []byte("a")})
+	assert.Nil(err)
+	assert.Equal(1, len(msgs))
+
+	_, err = NewDedup(map[string]string{"dedup_window": "-1"})
+	assert.NotNil(err)
+}
+
+func TestDeadband(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewDeadband(map[string]string{"deadband": "0.5"})
+	assert.Nil(err)
+	assert.Equal([]string{"20.0"}, process(t, s, "20.0"))
+	assert.Nil(process(t, s, "20.4"))
+	assert.Nil(process(t, s, "19.6"))
+	assert.Equal([]string{"20.5\n"}, process(t, s, "20.5\n"))
+	assert.Nil(process(t, s, "20.1"))
+
+	// change only
+	s, err = NewDeadband(map[string]string{})
+	assert.Nil(err)
+	assert.Equal([]string{"1"}, process(t, s, "1"))
+	assert.Nil(process(t, s, "1.0"))
+	assert.Equal([]string{"1.01"}, process(t, s, "1.01"))
+
+	_, err = s.Process(message.Message{Body: []byte("hot")})
+	assert.NotNil(err)
+}
+
+func TestThrottle(t *testing.T) {
+	assert := assert.New(t)
+	c, restore := setClock()
+	defer restore()
+
+	s, err := NewThrottle(map[string]string{"throttle_interval": "0.5"})
+	assert.Nil(err)
+	assert.Equal([]string{"1"}, process(t, s, "1"))
+	c.add(400 * time.Millisecond)
+	assert.Nil(process(t, s, "2"))
+	c.add(100 * time.Millisecond)
+	assert.Equal([]string{"3"}, process(t, s, "3"))
+
+	_, err = NewThrottle(map[string]string{"throttle_interval": "abc"})
+	assert.NotNil(err)
+}
+
+func TestStrip(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewStrip(map[string]string{"strip_prefix": "T=", "strip_suffix": ";"})
+	assert.Nil(err)
+	assert.Equal([]string{"20"}, process(t, s, "T=20;"))
+	assert.Equal([]string{"20"}, process(t, s, "20"))
+
+	_, err = NewStrip(map[string]string{})
+	assert.NotNil(err)
+}
+
+func TestRewrite(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewRewrite(map[string]string{"rewrite_topic": "{prefix}/sensors/{device}"})
+	assert.Nil(err)
+	msgs, err := s.Process(message.Message{Body: []byte("a")})
+	assert.Nil(err)
+	assert.Equal(message.TopicTemplate("{prefix}/sensors/{device}"), msgs[0].TopicTemplate)
+
+	_, err = NewRewrite(map[string]string{"rewrite_topic": "{unknown}"})
+	assert.NotNil(err)
+	_, err = NewRewrite(map[string]string{})
+	assert.NotNil(err)
+}
+
+func TestSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := NewSplit(map[string]string{})
+	assert.Nil(err)
+	assert.Equal([]string{"1", "2"}, process(t, s, "1,2,"))
+
+	s, err = NewSplit(map[string]string{"split_delimiter": ";"})
+	assert.Nil(err)
+	assert.Equal([]string{"1,2", "3"}, process(t, s, "1,2;3"))
+	assert.Nil(process(t, s, ""))
+}
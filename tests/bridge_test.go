@@ -0,0 +1,181 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji"
+	"github.com/shiguredo/fuji/gateway"
+	"github.com/shiguredo/fuji/inidef"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestBridge tests
+// 1. start gateway with two embedded brokers and a bridge between them
+// 2. publish to the local broker
+// 3. check the message is relayed to the cloud broker with rewritten topic
+func TestBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	localPort := freePort(t)
+	cloudPort := freePort(t)
+	iniStr := fmt.Sprintf(`
+	[gateway]
+	    name = bridgeham
+	[broker "local"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	[broker "cloud"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	[bridge "alerts"]
+	    from = local
+	    to = cloud
+	    topic = `+"`alerts/#`"+`
+	    strip_prefix = alerts
+	    add_prefix = site1/alerts
+`, localPort, cloudPort)
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	commandChannel := make(chan gateway.Command)
+	ctx, stopped := context.WithCancel(context.Background())
+	go func() {
+		fuji.StartByFileWithChannel(conf, commandChannel)
+		stopped()
+	}()
+	defer func() { gateway.Do(ctx, commandChannel, gateway.Command{Type: gateway.CmdStop}) }()
+	time.Sleep(1 * time.Second)
+
+	received := make(chan MQTT.Message, 1)
+	sub := connectTestClient(t, cloudPort, "bridgesubscriber")
+	defer sub.Disconnect(250)
+	token := sub.Subscribe("site1/#", 1, func(client *MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	pub := connectTestClient(t, localPort, "bridgepublisher")
+	defer pub.Disconnect(250)
+	pub.Publish("alerts/fire/1", 1, false, []byte("hot")).Wait()
+
+	select {
+	case msg := <-received:
+		assert.Equal("site1/alerts/fire/1", msg.Topic())
+		assert.Equal([]byte("hot"), msg.Payload())
+	case <-time.After(5 * time.Second):
+		t.Error("bridged message not received")
+	}
+}
+
+// TestBridgeFailoverGroup tests
+// 1. start gateway with a bridge from a failover group of two embedded brokers
+// 2. publish to the lower priority broker, which is not used by the group
+// 3. check the message is not relayed
+// 4. publish to the higher priority broker and check it is relayed once
+func TestBridgeFailoverGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	local1Port := freePort(t)
+	local2Port := freePort(t)
+	cloudPort := freePort(t)
+	iniStr := fmt.Sprintf(`
+	[gateway]
+	    name = bridgegroupham
+	[broker "local/1"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	[broker "local/2"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	[broker "cloud"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	[bridge "alerts"]
+	    from = local
+	    to = cloud
+	    topic = `+"`alerts/#`"+`
+`, local1Port, local2Port, cloudPort)
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	commandChannel := make(chan gateway.Command)
+	ctx, stopped := context.WithCancel(context.Background())
+	go func() {
+		fuji.StartByFileWithChannel(conf, commandChannel)
+		stopped()
+	}()
+	defer func() { gateway.Do(ctx, commandChannel, gateway.Command{Type: gateway.CmdStop}) }()
+	time.Sleep(1 * time.Second)
+
+	received := make(chan MQTT.Message, 2)
+	sub := connectTestClient(t, cloudPort, "bridgegroupsubscriber")
+	defer sub.Disconnect(250)
+	token := sub.Subscribe("alerts/#", 1, func(client *MQTT.Client, msg MQTT.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	pub2 := connectTestClient(t, local2Port, "bridgegrouppublisher2")
+	defer pub2.Disconnect(250)
+	pub2.Publish("alerts/fire/2", 1, false, []byte("warm")).Wait()
+	pub1 := connectTestClient(t, local1Port, "bridgegrouppublisher1")
+	defer pub1.Disconnect(250)
+	pub1.Publish("alerts/fire/1", 1, false, []byte("hot")).Wait()
+
+	select {
+	case msg := <-received:
+		assert.Equal("alerts/fire/1", msg.Topic())
+	case <-time.After(5 * time.Second):
+		t.Error("bridged message not received")
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("unexpected message relayed: %s", msg.Topic())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func connectTestClient(t *testing.T, port int, clientID string) *MQTT.Client {
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port))
+	opts.SetClientID(clientID)
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return client
+}
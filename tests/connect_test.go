@@ -62,7 +62,7 @@ func TestConnectLocalPubSub(t *testing.T) {
 	assert.Nil(err)
 
 	// get DummyDevice
-	dummyDevice, err := device.NewDummyDevice(conf.Sections[3], brokerList, gw.DeviceChan)
+	dummyDevice, err := device.NewDummyDevice(conf.Sections[3], brokerList)
 	assert.Nil(err)
 	assert.NotNil(dummyDevice)
 
@@ -0,0 +1,44 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/shiguredo/fuji/broker/embedded"
+)
+
+const localBroker = "localhost:1883"
+
+// TestMain starts the embedded broker on localhost:1883 if no broker
+// is running there, so that tests do not need external mosquitto.
+func TestMain(m *testing.M) {
+	if conn, err := net.Dial("tcp", localBroker); err == nil {
+		conn.Close()
+		os.Exit(m.Run())
+	}
+
+	s := embedded.NewServer(localBroker)
+	if err := s.Start(); err != nil {
+		log.Fatalf("embedded broker start failed, %v", err)
+	}
+	code := m.Run()
+	s.Close()
+	os.Exit(code)
+}
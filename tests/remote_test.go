@@ -0,0 +1,124 @@
+// Copyright 2015 Shiguredo Inc. <fuji@shiguredo.jp>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shiguredo/fuji"
+	"github.com/shiguredo/fuji/gateway"
+	"github.com/shiguredo/fuji/inidef"
+)
+
+// TestRemoteCommand tests
+// 1. start gateway with command_broker
+// 2. publish commands to the command topic
+// 3. check the replies on the reply topic
+func TestRemoteCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	port := freePort(t)
+	iniStr := fmt.Sprintf(`
+	[gateway]
+	    name = remoteham
+	    command_broker = local
+	    command_allow = list_devices,get_config,restart_device
+	[broker "local"]
+	    embedded = true
+	    host = 127.0.0.1
+	    port = %d
+	    topic_prefix = fuji
+	    username = fuji
+	    password = himitsu
+	[device "dora/dummy"]
+	    broker = local
+	    qos = 0
+	    interval = 10
+	    payload = hello
+`, port)
+	conf, err := inidef.LoadConfigByte([]byte(iniStr))
+	assert.Nil(err)
+	commandChannel := make(chan gateway.Command)
+	ctx, stopped := context.WithCancel(context.Background())
+	go func() {
+		fuji.StartByFileWithChannel(conf, commandChannel)
+		stopped()
+	}()
+	defer func() { gateway.Do(ctx, commandChannel, gateway.Command{Type: gateway.CmdStop}) }()
+	time.Sleep(1 * time.Second)
+
+	received := make(chan gateway.RemoteReply, 1)
+	opts := MQTT.NewClientOptions()
+	opts.AddBroker(fmt.Sprintf("tcp://127.0.0.1:%d", port))
+	opts.SetClientID("remotecontroller")
+	opts.SetUsername("fuji")
+	opts.SetPassword("himitsu")
+	client := MQTT.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer client.Disconnect(250)
+	token := client.Subscribe("fuji/remoteham/$reply", 1, func(client *MQTT.Client, msg MQTT.Message) {
+		var reply gateway.RemoteReply
+		assert.Nil(json.Unmarshal(msg.Payload(), &reply))
+		received <- reply
+	})
+	token.Wait()
+	assert.Nil(token.Error())
+
+	call := func(command, body string) gateway.RemoteReply {
+		client.Publish("fuji/remoteham/$cmd/"+command, 1, false, []byte(body)).Wait()
+		select {
+		case reply := <-received:
+			return reply
+		case <-time.After(5 * time.Second):
+			t.Fatalf("reply of %s not received", command)
+		}
+		return gateway.RemoteReply{}
+	}
+
+	reply := call("list_devices", `{"id": "1"}`)
+	assert.Equal("1", reply.ID)
+	assert.True(reply.OK)
+	assert.Equal([]gateway.DeviceInfo{{Name: "dora", Type: "dummy"}}, reply.Devices)
+
+	reply = call("restart_device", `{"id": "2", "device": "dora"}`)
+	assert.Equal("2", reply.ID)
+	assert.True(reply.OK, reply.Error)
+
+	reply = call("get_config", `{"id": "3"}`)
+	assert.True(reply.OK)
+	for _, s := range reply.Config {
+		if s.Type == "broker" {
+			assert.Equal("fuji", s.Values["username"])
+			assert.Equal(gateway.RedactedValue, s.Values["password"])
+		}
+	}
+
+	reply = call("flush_queue", `{"id": "4"}`)
+	assert.Equal("4", reply.ID)
+	assert.False(reply.OK)
+	assert.Equal("command not allowed: flush_queue", reply.Error)
+
+	reply = call("list_devices", `not json`)
+	assert.False(reply.OK)
+}
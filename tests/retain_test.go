@@ -57,7 +57,7 @@ func TestRetainJustPublish(t *testing.T) {
 `
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	assert.Nil(err)
-	commandChannel := make(chan string)
+	commandChannel := make(chan gateway.Command)
 	go fuji.StartByFileWithChannel(conf, commandChannel)
 
 	time.Sleep(2 * time.Second)
@@ -92,7 +92,7 @@ func TestRetainSubscribePublishClose(t *testing.T) {
 	    type = EnOcean
 	    retain = true
 `
-	commandChannel := make(chan string)
+	commandChannel := make(chan gateway.Command)
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	assert.Nil(err)
 	go fuji.StartByFileWithChannel(conf, commandChannel)
@@ -107,7 +107,7 @@ func TestRetainSubscribePublishClose(t *testing.T) {
 		t.Error("Cannot make BrokerList")
 	}
 
-	dummyDevice, err := device.NewDummyDevice(conf.Sections[3], brokerList, gw.DeviceChan)
+	dummyDevice, err := device.NewDummyDevice(conf.Sections[3], brokerList)
 	if err != nil {
 		t.Error("Cannot make DummyDeviceList")
 	}
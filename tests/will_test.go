@@ -51,7 +51,7 @@ func TestWillJustPublish(t *testing.T) {
 `
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	assert.Nil(err)
-	commandChannel := make(chan string)
+	commandChannel := make(chan gateway.Command)
 	go fuji.StartByFileWithChannel(conf, commandChannel)
 	time.Sleep(5 * time.Second)
 
@@ -143,7 +143,7 @@ func genericWillTestDriver(t *testing.T, iniStr string, expectedTopic string, ex
 
 	conf, err := inidef.LoadConfigByte([]byte(iniStr))
 	assert.Nil(err)
-	commandChannel := make(chan string)
+	commandChannel := make(chan gateway.Command)
 	go fuji.StartByFileWithChannel(conf, commandChannel)
 
 	gw, err := gateway.NewGateway(conf)